@@ -71,7 +71,6 @@ import (
 	"fmt"
 	"log"
 	"net/http"
-	"os"
 	"path/filepath"
 	"regexp"
 	"strconv"
@@ -249,8 +248,14 @@ type ANALYZED_TEMPLATE_INFO struct {
 	ZipFilepath string   // full pathname of zipfile
 	ZipFilename string   // Filename of zip file (no path)
 	StyleList   []string // List of styles
+	// Decrypt integrity report; nil if the file wasn't decrypted
+	Report *DecryptReport
 }
 
+// Corrupted bytes are replaced with the ERROR_INDICATOR, which is invisible in a browser, so swap it for
+// something an analyst can spot
+const CORRUPTION_MARKER = "\u2592"
+
 // Search string transformation functions
 //
 // These functions convert particular search strings into more appropriate output for an index table
@@ -344,22 +349,19 @@ func fileGenerateHtmlMarkup(w http.ResponseWriter, req *http.Request) {
 	decryptWriter := bufio.NewWriter(&templateInfo.decryptedFile)
 
 	// split filename into zip file name, and file within the zip
-	segments := strings.SplitAfter(filename, ".zip")
-
-	//		log.Println("segments", segments)
+	templateInfo.ZipFilepath, templateInfo.ZipFilename, templateInfo.Filename = webBundleFile(req, filename)
 
-	templateInfo.ZipFilepath = segments[0]
-	filesplit := strings.Split(segments[0], string(os.PathSeparator))
+	// decryptZipSpecificFile recognizes zips we've already decrypted from their content
 
-	templateInfo.ZipFilename = filesplit[len(filesplit)-1] // Get the zip filename without path
-	templateInfo.Filename = strings.TrimPrefix(segments[1], string(os.PathSeparator))
+	templateInfo.Report, _ = decryptZipSpecificFile(templateInfo.ZipFilepath, templateInfo.Filename, decryptWriter, webDecryptOptions(req))
+	decryptWriter.Flush()
 
-	// Should we handle already decrypted files somehow? A flag, or just use the _d in the name?
-	// Right now decryptZipSpecificFile looks at the filename for _d
-
-	decryptZipSpecificFile(templateInfo.ZipFilepath, templateInfo.Filename, decryptWriter)
+	decrypted := string(templateInfo.decryptedFile.Bytes())
+	if templateInfo.Report != nil && len(templateInfo.Report.Corrupted) > 0 {
+		decrypted = strings.Replace(decrypted, string(ERROR_INDICATOR), CORRUPTION_MARKER, -1)
+	}
 
-	templateInfo.DiagLines = strings.Split(string(templateInfo.decryptedFile.Bytes()), "\n")
+	templateInfo.DiagLines = strings.Split(decrypted, "\n")
 
 	log.Println("number of lines in file", len(templateInfo.DiagLines))
 
@@ -0,0 +1,486 @@
+// backtrace.go
+//
+// Copyright (c) 2016 Drobo Inc. All rights reserved
+//
+// Symbolicated backtraces of the threads in a core dump.
+//
+// Cores don't contain symbols, so the symbol files (the executable and shared libraries, unstripped, with the
+// same names as in the firmware) are loaded from a directory for the firmware version the core came from.
+// Executables are used at their link address; shared libraries are placed using the NT_FILE mappings in the core.
+//
+// The ARM and MIPS code in the firmware isn't built with frame pointers or unwind tables we can rely on, so each
+// frame is unwound by analysing the prologue of its function, as gdb does without debug info:
+//
+//   ARM:  push {..., lr}, str lr, [sp, #-4]!, vpush and sub sp, sp, #imm give the frame size and where lr is saved
+//   MIPS: addiu sp, sp, -imm gives the frame size, and sw ra, off(sp) where ra is saved
+//
+// A function which doesn't save the return address is a leaf; the return address is still in lr (ra), which is
+// only valid for the innermost frame. If a frame can't be unwound (no symbol, Thumb code), the rest of the stack
+// is scanned for words which are return addresses within known functions. Scanned frames may be stale, so they
+// are marked in the report.
+
+package core
+
+import (
+	"debug/elf"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/bits"
+	"path"
+	"path/filepath"
+	"sort"
+)
+
+const (
+	maxFrames        = 64   // Frames unwound per thread
+	maxScannedFrames = 16   // Frames found by scanning the stack
+	maxScanWords     = 4096 // Words of stack scanned
+	maxPrologue      = 64   // Instructions searched for the prologue of a function
+)
+
+// Module is a symbol file, placed at its address in the core
+type Module struct {
+	Name      string
+	File      *elf.File
+	Bias      uint64 // Difference between the load address and the link address
+	Start     uint64 // Address range of the module in the core
+	End       uint64
+	functions []elf.Symbol
+}
+
+// Symbols are the modules used to resolve addresses in a core
+type Symbols struct {
+	Description string // Where the symbols came from, for reports
+	Modules     []*Module
+	files       []*elf.File
+}
+
+// Frame is a frame in a backtrace
+type Frame struct {
+	PC       uint64
+	SP       uint64
+	Function string // Empty if the address couldn't be resolved
+	Offset   uint64 // Offset of PC within the function
+	Module   string
+	Method   string // How the frame was found; pc, prologue, lr or scan
+}
+
+// NoSymbols
+//
+// Return an empty set of symbols, with the reason there aren't any for reports
+func NoSymbols(reason string) *Symbols {
+	return &Symbols{Description: reason}
+}
+
+// LoadSymbols
+//
+// Load the ELF files in a directory as symbols for the core. Files which aren't ELF files are ignored, as are
+// shared libraries which aren't mapped in the core
+func (core *Core) LoadSymbols(dir string) (*Symbols, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	symbols := &Symbols{}
+	var names []string
+
+	for _, info := range files {
+		if info.IsDir() {
+			continue
+		}
+		file, err := elf.Open(filepath.Join(dir, info.Name()))
+		if err != nil {
+			continue
+		}
+		symbols.files = append(symbols.files, file)
+
+		module := core.placeModule(info.Name(), file)
+		if module == nil {
+			continue
+		}
+		symbols.Modules = append(symbols.Modules, module)
+		names = append(names, info.Name())
+	}
+
+	symbols.Description = fmt.Sprintf("%d files from %s %v", len(symbols.Modules), dir, names)
+	return symbols, nil
+}
+
+// Close the symbol files
+func (symbols *Symbols) Close() {
+	for _, file := range symbols.files {
+		file.Close()
+	}
+}
+
+// placeModule
+//
+// Work out where a symbol file is in the core, and read its function symbols. Returns nil if the file can't be placed
+func (core *Core) placeModule(name string, file *elf.File) *Module {
+	if file.Machine != core.File.Machine {
+		return nil
+	}
+
+	// Link address range of the module
+	var low, high uint64 = ^uint64(0), 0
+	for _, prog := range file.Progs {
+		if prog.Type != elf.PT_LOAD {
+			continue
+		}
+		if prog.Vaddr < low {
+			low = prog.Vaddr
+		}
+		if prog.Vaddr+prog.Memsz > high {
+			high = prog.Vaddr + prog.Memsz
+		}
+	}
+	if high == 0 {
+		return nil
+	}
+
+	module := &Module{Name: name, File: file}
+
+	if file.Type == elf.ET_DYN {
+		// Shared libraries are placed by the start of their first mapping
+		placed := false
+		for _, mapped := range core.Mapped {
+			if path.Base(mapped.Name) == name && mapped.Offset == 0 {
+				module.Bias = mapped.Start - low
+				placed = true
+				break
+			}
+		}
+		if !placed {
+			return nil
+		}
+	}
+	module.Start = low + module.Bias
+	module.End = high + module.Bias
+
+	all, _ := file.Symbols()
+	dynamic, _ := file.DynamicSymbols()
+	for _, symbol := range append(all, dynamic...) {
+		if elf.ST_TYPE(symbol.Info) != elf.STT_FUNC || symbol.Value == 0 || symbol.Section == elf.SHN_UNDEF {
+			continue
+		}
+		if file.Machine == elf.EM_ARM {
+			symbol.Value &^= 1 // Thumb functions have the low bit set
+		}
+		module.functions = append(module.functions, symbol)
+	}
+	sort.Slice(module.functions, func(i, j int) bool { return module.functions[i].Value < module.functions[j].Value })
+
+	return module
+}
+
+// Lookup
+//
+// Find the module and function containing an address; either may be nil
+func (symbols *Symbols) Lookup(addr uint64) (*Module, *elf.Symbol) {
+	if symbols == nil {
+		return nil, nil
+	}
+	for _, module := range symbols.Modules {
+		if addr < module.Start || addr >= module.End {
+			continue
+		}
+		linked := addr - module.Bias
+		index := sort.Search(len(module.functions), func(i int) bool { return module.functions[i].Value > linked }) - 1
+		if index < 0 {
+			return module, nil
+		}
+		function := &module.functions[index]
+		if function.Size != 0 && linked >= function.Value+function.Size {
+			return module, nil
+		}
+		return module, function
+	}
+	return nil, nil
+}
+
+// Read a word of code from a module at a (loaded) address
+func (module *Module) readCode(addr uint64) (uint32, bool) {
+	linked := addr - module.Bias
+	for _, prog := range module.File.Progs {
+		if prog.Type != elf.PT_LOAD || linked < prog.Vaddr || linked+4 > prog.Vaddr+prog.Filesz {
+			continue
+		}
+		data := make([]byte, 4)
+		if _, err := prog.ReadAt(data, int64(linked-prog.Vaddr)); err != nil {
+			return 0, false
+		}
+		return module.File.ByteOrder.Uint32(data), true
+	}
+	return 0, false
+}
+
+// ReadMemory
+//
+// Read memory saved in the core. Fails if any of the range isn't in the core
+func (core *Core) ReadMemory(addr uint64, data []byte) error {
+	for _, prog := range core.File.Progs {
+		if prog.Type != elf.PT_LOAD || addr < prog.Vaddr || addr+uint64(len(data)) > prog.Vaddr+prog.Filesz {
+			continue
+		}
+		_, err := prog.ReadAt(data, int64(addr-prog.Vaddr))
+		return err
+	}
+	return fmt.Errorf("address %s is not in the core", core.Address(addr))
+}
+
+// Read a word (C long) of memory from the core
+func (core *Core) readWord(addr uint64) (uint64, bool) {
+	data := make([]byte, core.wordSize())
+	if core.ReadMemory(addr, data) != nil {
+		return 0, false
+	}
+	return core.word(data), true
+}
+
+// Fill in the symbol for a frame
+func (symbols *Symbols) resolve(frame *Frame, lookup uint64) {
+	module, function := symbols.Lookup(lookup)
+	if module != nil {
+		frame.Module = module.Name
+	}
+	if function != nil {
+		frame.Function = function.Name
+		frame.Offset = frame.PC - (function.Value + module.Bias)
+	}
+}
+
+// Backtrace
+//
+// Unwind the stack of a thread
+func (core *Core) Backtrace(thread Thread, symbols *Symbols) []Frame {
+	var frames []Frame
+
+	pc, sp, lr := thread.PC, thread.SP, thread.LR
+	method := "pc"
+	thumb := thread.thumb()
+
+	for depth := 0; depth < maxFrames; depth++ {
+		if core.File.Machine == elf.EM_ARM {
+			// Return addresses into Thumb code have the low bit set
+			if depth > 0 {
+				thumb = pc&1 != 0
+			}
+			pc &^= 1
+		}
+		frame := Frame{PC: pc, SP: sp, Method: method}
+
+		// Return addresses are after the call, which may be the last instruction of the function
+		lookup := pc
+		if depth > 0 {
+			lookup--
+		}
+		symbols.resolve(&frame, lookup)
+		frames = append(frames, frame)
+
+		callerPC, callerSP, how, ok := core.unwindFrame(symbols, lookup, pc, sp, lr, thumb, depth == 0)
+		if !ok {
+			if symbols != nil && len(symbols.Modules) > 0 {
+				frames = append(frames, core.scanStack(symbols, sp)...)
+			}
+			break
+		}
+		if callerPC == 0 || callerSP < sp || (callerPC == pc && callerSP == sp) {
+			break // End of the stack, or the unwind has gone wrong
+		}
+		pc, sp, lr, method = callerPC, callerSP, 0, how
+	}
+	return frames
+}
+
+// unwindFrame
+//
+// Find the caller of a frame; its pc and sp, and how it was found
+func (core *Core) unwindFrame(symbols *Symbols, lookup, pc, sp, lr uint64, thumb, innermost bool) (uint64, uint64, string, bool) {
+	module, function := symbols.Lookup(lookup)
+
+	if function != nil {
+		start := function.Value + module.Bias
+		var frameSize, raOffset int64
+		var ok bool
+
+		switch core.File.Machine {
+		case elf.EM_ARM:
+			// Only ARM mode prologues are recognized
+			if !thumb {
+				frameSize, raOffset, ok = armPrologue(module, start, pc)
+			}
+		case elf.EM_MIPS:
+			frameSize, raOffset, ok = mipsPrologue(module, start, pc)
+		}
+
+		if ok {
+			callerSP := sp + uint64(frameSize)
+			if raOffset >= 0 {
+				ra, read := core.readWord(sp + uint64(raOffset))
+				if !read {
+					return 0, 0, "", false
+				}
+				return ra, callerSP, "prologue", true
+			}
+			if innermost && lr != 0 {
+				return lr, callerSP, "lr", true
+			}
+			return 0, 0, "", false
+		}
+	}
+
+	// Without the prologue, lr is the best guess for the caller of the innermost frame, but the frame size is unknown
+	if innermost && lr != 0 {
+		return lr, sp, "lr", true
+	}
+	return 0, 0, "", false
+}
+
+// Return true if an ARM thread is running Thumb code (the T bit in the cpsr)
+func (thread Thread) thumb() bool {
+	for _, reg := range thread.Registers {
+		if reg.Name == "cpsr" {
+			return reg.Value&(1<<5) != 0
+		}
+	}
+	return false
+}
+
+// armPrologue
+//
+// Analyse the prologue of an ARM function, up to pc. Returns the size of the frame, and the offset of the saved
+// lr from sp (-1 if lr isn't saved)
+func armPrologue(module *Module, start, pc uint64) (int64, int64, bool) {
+	var frame int64
+	var lrSlot int64 = -1 // Distance of the saved lr below sp on entry
+
+prologue:
+	for addr := start; addr < pc && addr < start+maxPrologue*4; addr += 4 {
+		insn, ok := module.readCode(addr)
+		if !ok {
+			return 0, 0, false
+		}
+
+		switch {
+		case insn&0xffff0000 == 0xe92d0000: // push {reglist} (stmdb sp!, {reglist})
+			list := insn & 0xffff
+			count := int64(bits.OnesCount32(list))
+			if list&(1<<14) != 0 {
+				// Registers are stored in ascending order, so lr is above the registers numbered below it
+				below := int64(bits.OnesCount32(list & (1<<14 - 1)))
+				lrSlot = frame + 4*count - 4*below
+			}
+			frame += 4 * count
+		case insn == 0xe52de004: // str lr, [sp, #-4]!
+			frame += 4
+			lrSlot = frame
+		case insn&0xffbf0f00 == 0xed2d0b00: // vpush {dN-dM}
+			frame += 4 * int64(insn&0xff)
+		case insn&0xfffff000 == 0xe24dd000: // sub sp, sp, #imm
+			rotate := int((insn >> 8 & 0xf) * 2)
+			frame += int64(bits.RotateLeft32(insn&0xff, -rotate))
+		case insn&0x0fffffff == 0x012fff1e: // bx lr; the end of the function
+			break prologue
+		}
+	}
+
+	if lrSlot < 0 {
+		return frame, -1, true
+	}
+	return frame, frame - lrSlot, true
+}
+
+// mipsPrologue
+//
+// Analyse the prologue of a MIPS function, up to pc. Returns the size of the frame, and the offset of the saved
+// ra from sp (-1 if ra isn't saved)
+func mipsPrologue(module *Module, start, pc uint64) (int64, int64, bool) {
+	var frame int64
+	var raOffset int64 = -1
+
+prologue:
+	for addr := start; addr < pc && addr < start+maxPrologue*4; addr += 4 {
+		insn, ok := module.readCode(addr)
+		if !ok {
+			return 0, 0, false
+		}
+
+		switch op := insn >> 16; {
+		case op == 0x27bd || op == 0x67bd: // addiu/daddiu sp, sp, imm
+			if imm := int64(int16(insn)); imm < 0 {
+				frame -= imm
+			}
+		case op == 0xafbf || op == 0xffbf: // sw/sd ra, offset(sp)
+			raOffset = int64(int16(insn))
+		case insn == 0x03e00008: // jr ra; the end of the function
+			break prologue
+		}
+	}
+	return frame, raOffset, true
+}
+
+// scanStack
+//
+// Scan the stack for words which look like return addresses; within a known function, but not its first instruction
+func (core *Core) scanStack(symbols *Symbols, sp uint64) []Frame {
+	var frames []Frame
+	word := uint64(core.wordSize())
+
+	for i := uint64(1); i < maxScanWords && len(frames) < maxScannedFrames; i++ {
+		value, ok := core.readWord(sp + i*word)
+		if !ok {
+			break
+		}
+		module, function := symbols.Lookup(value - 1)
+		if function == nil || value == function.Value+module.Bias {
+			continue
+		}
+		frame := Frame{PC: value, SP: sp + i*word, Method: "scan"}
+		symbols.resolve(&frame, value-1)
+		frames = append(frames, frame)
+	}
+	return frames
+}
+
+// Backtraces
+//
+// Write a backtrace for each thread
+func (core *Core) Backtraces(w io.Writer, symbols *Symbols) {
+	if symbols == nil {
+		symbols = NoSymbols("none")
+	}
+
+	fmt.Fprintln(w, "------------------- BACKTRACES -------------------")
+	fmt.Fprintf(w, "Symbols: %s\n", symbols.Description)
+	fmt.Fprintln(w, "Frames marked [lr] assume the return address is still in the link register; frames marked [scan] were")
+	fmt.Fprintln(w, "found by scanning the stack, and may be stale")
+
+	for index, thread := range core.Threads {
+		fmt.Fprintln(w)
+		fmt.Fprintf(w, "Thread %d: LWP %d", index+1, thread.Pid)
+		if thread.Signal != 0 {
+			fmt.Fprintf(w, ", signal %d", thread.Signal)
+		}
+		fmt.Fprintln(w)
+
+		for depth, frame := range core.Backtrace(thread, symbols) {
+			fmt.Fprintf(w, "  #%-2d %s in ", depth, core.Address(frame.PC))
+			if frame.Function != "" {
+				fmt.Fprintf(w, "%s+0x%x", frame.Function, frame.Offset)
+			} else {
+				fmt.Fprint(w, "??")
+			}
+			if frame.Module != "" {
+				fmt.Fprintf(w, " (%s)", frame.Module)
+			} else if mapped := core.MappedAt(frame.PC); mapped != nil {
+				fmt.Fprintf(w, " (%s)", path.Base(mapped.Name))
+			}
+			if frame.Method == "lr" || frame.Method == "scan" {
+				fmt.Fprintf(w, " [%s]", frame.Method)
+			}
+			fmt.Fprintln(w)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+// compress.go
+//
+// Copyright (c) 2016 Drobo Inc. All rights reserved
+//
+// Decompression of Unix compress (.Z) files.
+//
+// compress uses LZW with variable width codes, starting at 9 bits, up to the maximum given in the header. This
+// isn't the same variant as compress/lzw (which is for GIF, TIFF and PDF). Codes are written in groups of 8, so a
+// group of n bit codes is n bytes. When the code width changes, or the table is cleared, the rest of the current
+// group is skipped.
+//
+// Header: 0x1f 0x9d, then a flags byte; the maximum code width (bits 0-4) and block mode (bit 7). In block mode,
+// code 256 clears the table.
+
+package core
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+const (
+	compressInitBits = 9
+	compressMaxBits  = 16
+	compressClear    = 256
+	compressBlock    = 0x80
+)
+
+// compressReader decodes the codes from a compress stream
+type compressReader struct {
+	src       *bufio.Reader
+	maxBits   uint
+	blockMode bool
+
+	bits  uint   // Current code width
+	group []byte // Current group of codes
+	codes int    // Number of codes in the group
+	next  int    // Next code in the group
+}
+
+// Return the next code, or io.EOF at the end of the stream
+func (cr *compressReader) readCode() (int, error) {
+	if cr.next >= cr.codes {
+		cr.group = cr.group[:cr.bits]
+		n, err := io.ReadFull(cr.src, cr.group)
+		if n == 0 {
+			if err == io.ErrUnexpectedEOF {
+				err = io.EOF
+			}
+			return 0, err
+		}
+		cr.codes = n * 8 / int(cr.bits)
+		cr.next = 0
+		if cr.codes == 0 {
+			return 0, io.EOF
+		}
+	}
+
+	// Codes are packed least significant bit first
+	offset := uint(cr.next) * cr.bits
+	code := 0
+	for bit := uint(0); bit < cr.bits; bit++ {
+		position := offset + bit
+		if cr.group[position/8]&(1<<(position%8)) != 0 {
+			code |= 1 << bit
+		}
+	}
+	cr.next++
+	return code, nil
+}
+
+// Skip the rest of the current group, and change the code width
+func (cr *compressReader) setBits(bits uint) {
+	cr.next = cr.codes
+	cr.bits = bits
+}
+
+// newCompressReader
+//
+// Return a reader of the decompressed contents of a compress stream
+func newCompressReader(src *bufio.Reader) (io.Reader, error) {
+	header := make([]byte, 3)
+	_, err := io.ReadFull(src, header)
+	if err != nil {
+		return nil, err
+	}
+	if header[0] != 0x1f || header[1] != 0x9d {
+		return nil, fmt.Errorf("not a compress file")
+	}
+
+	cr := &compressReader{
+		src:       src,
+		maxBits:   uint(header[2] & 0x1f),
+		blockMode: header[2]&compressBlock != 0,
+		bits:      compressInitBits,
+		group:     make([]byte, compressMaxBits),
+	}
+	if cr.maxBits < compressInitBits || cr.maxBits > compressMaxBits {
+		return nil, fmt.Errorf("compress file uses unsupported %d bit codes", cr.maxBits)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(cr.decompress(bufio.NewWriter(pw)))
+	}()
+	return pr, nil
+}
+
+// decompress
+//
+// Decode the whole stream to the writer
+func (cr *compressReader) decompress(w *bufio.Writer) error {
+	maxMaxCode := 1 << cr.maxBits
+	prefix := make([]uint16, maxMaxCode)
+	suffix := make([]byte, maxMaxCode)
+	for code := 0; code < 256; code++ {
+		suffix[code] = byte(code)
+	}
+	stack := make([]byte, 0, maxMaxCode)
+
+	maxCode := 1<<cr.bits - 1
+	freeEntry := 256
+	if cr.blockMode {
+		freeEntry = 257
+	}
+	oldCode := -1
+	var finChar byte
+
+	for {
+		if freeEntry > maxCode && cr.bits < cr.maxBits {
+			cr.setBits(cr.bits + 1)
+			maxCode = 1<<cr.bits - 1
+			if cr.bits == cr.maxBits {
+				maxCode = maxMaxCode
+			}
+		}
+
+		code, err := cr.readCode()
+		if err == io.EOF {
+			return w.Flush()
+		}
+		if err != nil {
+			return err
+		}
+
+		if oldCode == -1 {
+			if code >= 256 {
+				return fmt.Errorf("compress data is corrupt; first code is %d", code)
+			}
+			oldCode = code
+			finChar = byte(code)
+			w.WriteByte(finChar)
+			continue
+		}
+
+		if code == compressClear && cr.blockMode {
+			// The entry added after a clear is never used, as code 256 is the clear code
+			freeEntry = 256
+			cr.setBits(compressInitBits)
+			maxCode = 1<<cr.bits - 1
+			continue
+		}
+
+		inCode := code
+		stack = stack[:0]
+
+		// KwKwK; the code is the entry about to be added
+		if code >= freeEntry {
+			if code > freeEntry {
+				return fmt.Errorf("compress data is corrupt; code %d beyond table (%d)", code, freeEntry)
+			}
+			stack = append(stack, finChar)
+			code = oldCode
+		}
+
+		for code >= 256 {
+			stack = append(stack, suffix[code])
+			code = int(prefix[code])
+		}
+		finChar = suffix[code]
+		stack = append(stack, finChar)
+
+		for i := len(stack) - 1; i >= 0; i-- {
+			w.WriteByte(stack[i])
+		}
+
+		if freeEntry < maxMaxCode {
+			prefix[freeEntry] = uint16(oldCode)
+			suffix[freeEntry] = finChar
+			freeEntry++
+		}
+		oldCode = inCode
+	}
+}
@@ -0,0 +1,430 @@
+// core.go
+//
+// Copyright (c) 2016 Drobo Inc. All rights reserved
+//
+// Methods for inspecting core dumps from Drobo diagnostics
+//
+// RTPCore1.z is a compressed core dump of the main user mode (RTP) process running BeyondRAID. The core is a standard
+// ELF core file, so it can be loaded into gdb, but a summary of the threads, their registers and the mapped memory
+// is often enough to get started, without leaving the tool.
+//
+// The ELF program headers describe the memory segments in the core (PT_LOAD) and the notes (PT_NOTE). The notes
+// hold the process info (NT_PRPSINFO), the registers of each thread (NT_PRSTATUS) and the files mapped into
+// memory (NT_FILE). The layout of the register set depends on the architecture; ARM and MIPS are used by Drobo
+// platforms. Registers for other architectures are reported as a plain list.
+
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Note types found in Linux core files
+const (
+	NT_PRSTATUS = 1
+	NT_PRFPREG  = 2
+	NT_PRPSINFO = 3
+	NT_AUXV     = 6
+	NT_SIGINFO  = 0x53494749
+	NT_FILE     = 0x46494c45
+)
+
+// First line of a core summary
+const SummaryBanner = "------------------- CORE DUMP -------------------"
+
+var noteNames = map[uint32]string{
+	NT_PRSTATUS: "NT_PRSTATUS",
+	NT_PRFPREG:  "NT_PRFPREG",
+	NT_PRPSINFO: "NT_PRPSINFO",
+	NT_AUXV:     "NT_AUXV",
+	NT_SIGINFO:  "NT_SIGINFO",
+	NT_FILE:     "NT_FILE",
+}
+
+// Decompress
+//
+// Return a reader of the uncompressed core. Cores are compressed with Unix compress (.Z), zlib or gzip, which are
+// recognized from their header; an uncompressed ELF file is returned as it is
+func Decompress(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(4)
+	if err != nil {
+		return nil, fmt.Errorf("reading core: %v", err)
+	}
+
+	switch {
+	case bytes.Equal(magic, []byte(elf.ELFMAG)):
+		return br, nil
+	case magic[0] == 0x1f && magic[1] == 0x9d:
+		return newCompressReader(br)
+	case magic[0] == 0x1f && magic[1] == 0x8b:
+		return gzip.NewReader(br)
+	case magic[0]&0x0f == 8 && (uint16(magic[0])<<8|uint16(magic[1]))%31 == 0:
+		// zlib header; deflate compression and a valid header checksum
+		return zlib.NewReader(br)
+	}
+	return nil, fmt.Errorf("core is not an ELF file, or a compressed ELF file")
+}
+
+// Note is an ELF note
+type Note struct {
+	Name string
+	Type uint32
+	Desc []byte
+}
+
+// Register is a named register value
+type Register struct {
+	Name  string
+	Value uint64
+}
+
+// Thread is the state of a thread when the core was generated, from its NT_PRSTATUS note
+type Thread struct {
+	Pid       uint32
+	Signal    uint16 // Signal that caused the core, if any, for the thread
+	Registers []Register
+	PC        uint64 // Program counter
+	SP        uint64 // Stack pointer
+	LR        uint64 // Link register (ARM) or return address (MIPS)
+	FP        uint64 // Frame pointer (r11 on ARM, s8/fp on MIPS)
+}
+
+// Segment is a memory segment saved in the core
+type Segment struct {
+	Vaddr  uint64
+	Filesz uint64
+	Memsz  uint64
+	Flags  elf.ProgFlag
+	Offset uint64
+}
+
+// MappedFile is a file mapped into the memory of the process, from the NT_FILE note
+type MappedFile struct {
+	Start  uint64
+	End    uint64
+	Offset uint64 // Offset within the file, in bytes
+	Name   string
+}
+
+// Core is a parsed ELF core file
+type Core struct {
+	File     *elf.File
+	Process  string // Name of the process
+	Args     string // Process command line
+	Notes    []Note
+	Threads  []Thread
+	Segments []Segment
+	Mapped   []MappedFile
+}
+
+// Open
+//
+// Parse an ELF core file of the size given. Segments are read no further than the end of the file, so a corrupt
+// segment size in a core from a crashing unit can't make us allocate more than the core itself
+func Open(r io.ReaderAt, size int64) (*Core, error) {
+	file, err := elf.NewFile(r)
+	if err != nil {
+		return nil, err
+	}
+	if file.Type != elf.ET_CORE {
+		return nil, fmt.Errorf("ELF file is %v, not a core file", file.Type)
+	}
+
+	core := &Core{File: file}
+
+	for _, prog := range file.Progs {
+		switch prog.Type {
+		case elf.PT_LOAD:
+			core.Segments = append(core.Segments, Segment{prog.Vaddr, prog.Filesz, prog.Memsz, prog.Flags, prog.Off})
+		case elf.PT_NOTE:
+			filesz := prog.Filesz
+			if prog.Off > uint64(size) {
+				filesz = 0
+			} else if filesz > uint64(size)-prog.Off {
+				filesz = uint64(size) - prog.Off
+			}
+			data := make([]byte, filesz)
+			_, err := prog.ReadAt(data, 0)
+			if err != nil {
+				return nil, fmt.Errorf("reading notes: %v", err)
+			}
+			core.Notes = append(core.Notes, parseNotes(data, file.ByteOrder)...)
+		}
+	}
+
+	for _, note := range core.Notes {
+		switch note.Type {
+		case NT_PRSTATUS:
+			thread, err := core.parsePrstatus(note.Desc)
+			if err != nil {
+				return nil, err
+			}
+			core.Threads = append(core.Threads, thread)
+		case NT_PRPSINFO:
+			core.parsePrpsinfo(note.Desc)
+		case NT_FILE:
+			core.parseFileNote(note.Desc)
+		}
+	}
+
+	return core, nil
+}
+
+// Round up to a 4 byte boundary, as used for ELF note names and descriptors. Sizes are 64 bit so a corrupt 32 bit
+// size can't wrap round to 0
+func align4(n uint64) uint64 {
+	return (n + 3) &^ 3
+}
+
+// Parse the notes in a PT_NOTE segment, stopping at the first note which doesn't fit in the segment
+func parseNotes(data []byte, order binary.ByteOrder) []Note {
+	var notes []Note
+
+	for len(data) >= 12 {
+		namesz := uint64(order.Uint32(data[0:]))
+		descsz := uint64(order.Uint32(data[4:]))
+		noteType := order.Uint32(data[8:])
+		data = data[12:]
+
+		if align4(namesz)+align4(descsz) > uint64(len(data)) {
+			break // Truncated
+		}
+
+		name := string(bytes.TrimRight(data[:namesz], "\x00"))
+		data = data[align4(namesz):]
+		desc := data[:descsz]
+		data = data[align4(descsz):]
+
+		notes = append(notes, Note{name, noteType, desc})
+	}
+	return notes
+}
+
+// Size of a C long in the core
+func (core *Core) wordSize() int {
+	if core.File.Class == elf.ELFCLASS64 {
+		return 8
+	}
+	return 4
+}
+
+// Read a C long from the core
+func (core *Core) word(data []byte) uint64 {
+	if core.wordSize() == 8 {
+		return core.File.ByteOrder.Uint64(data)
+	}
+	return uint64(core.File.ByteOrder.Uint32(data))
+}
+
+// Register names for ARM; r0-r15, cpsr and orig_r0
+var armRegisters = []string{"r0", "r1", "r2", "r3", "r4", "r5", "r6", "r7", "r8", "r9", "r10", "fp", "ip", "sp", "lr", "pc",
+	"cpsr", "orig_r0"}
+
+// Register names for MIPS; the first six slots of the register set are unused
+var mipsRegisters = []string{"", "", "", "", "", "",
+	"zero", "at", "v0", "v1", "a0", "a1", "a2", "a3", "t0", "t1", "t2", "t3", "t4", "t5", "t6", "t7",
+	"s0", "s1", "s2", "s3", "s4", "s5", "s6", "s7", "t8", "t9", "k0", "k1", "gp", "sp", "s8", "ra",
+	"lo", "hi", "epc", "badvaddr", "status", "cause", ""}
+
+// parsePrstatus
+//
+// Parse an NT_PRSTATUS note (struct elf_prstatus) into a thread.
+//
+//	struct elf_prstatus {
+//	    struct elf_siginfo pr_info;     // 3 ints
+//	    short pr_cursig;
+//	    unsigned long pr_sigpend;
+//	    unsigned long pr_sighold;
+//	    pid_t pr_pid, pr_ppid, pr_pgrp, pr_sid;
+//	    struct timeval pr_utime, pr_stime, pr_cutime, pr_cstime;
+//	    elf_gregset_t pr_reg;
+//	    int pr_fpvalid;
+//	};
+func (core *Core) parsePrstatus(desc []byte) (Thread, error) {
+	order := core.File.ByteOrder
+	word := core.wordSize()
+
+	// Offsets of the fields following the alignment of longs
+	sigpend := 16
+	pid := sigpend + 2*word
+	reg := pid + 4*4 + 4*2*word
+
+	if len(desc) < reg+4 {
+		return Thread{}, fmt.Errorf("NT_PRSTATUS note is too short (%d bytes)", len(desc))
+	}
+
+	thread := Thread{
+		Pid:    order.Uint32(desc[pid:]),
+		Signal: order.Uint16(desc[12:]),
+	}
+
+	var names []string
+	switch core.File.Machine {
+	case elf.EM_ARM:
+		names = armRegisters
+	case elf.EM_MIPS:
+		names = mipsRegisters
+	}
+
+	// The register set fills the space up to pr_fpvalid
+	count := (len(desc) - reg - 4) / word
+	for i := 0; i < count; i++ {
+		value := core.word(desc[reg+i*word:])
+		name := fmt.Sprintf("reg%d", i)
+		if names != nil {
+			if i >= len(names) || names[i] == "" {
+				continue
+			}
+			name = names[i]
+		}
+		thread.Registers = append(thread.Registers, Register{name, value})
+
+		switch name {
+		case "pc", "epc":
+			thread.PC = value
+		case "sp":
+			thread.SP = value
+		case "lr", "ra":
+			thread.LR = value
+		case "fp", "s8":
+			thread.FP = value
+		}
+	}
+
+	return thread, nil
+}
+
+// Parse an NT_PRPSINFO note; the process name (16 bytes) and arguments (80 bytes) are at the end of the note
+func (core *Core) parsePrpsinfo(desc []byte) {
+	if len(desc) < 96 {
+		return
+	}
+	core.Process = cString(desc[len(desc)-96 : len(desc)-80])
+	core.Args = cString(desc[len(desc)-80:])
+}
+
+// Parse an NT_FILE note; a count and page size, count (start, end, page offset) triples, and count filenames
+func (core *Core) parseFileNote(desc []byte) {
+	word := core.wordSize()
+	if len(desc) < 2*word {
+		return
+	}
+	count := int(core.word(desc))
+	pageSize := core.word(desc[word:])
+
+	names := 2*word + count*3*word
+	if count < 0 || names > len(desc) {
+		return
+	}
+	filenames := bytes.Split(desc[names:], []byte{0})
+
+	for i := 0; i < count && i < len(filenames); i++ {
+		entry := desc[2*word+i*3*word:]
+		core.Mapped = append(core.Mapped, MappedFile{
+			Start:  core.word(entry),
+			End:    core.word(entry[word:]),
+			Offset: core.word(entry[2*word:]) * pageSize,
+			Name:   string(filenames[i]),
+		})
+	}
+}
+
+// Convert a null terminated C string
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+// Return the name of the file mapped at an address, if any
+func (core *Core) MappedAt(addr uint64) *MappedFile {
+	index := sort.Search(len(core.Mapped), func(i int) bool { return core.Mapped[i].End > addr })
+	if index < len(core.Mapped) && core.Mapped[index].Start <= addr {
+		return &core.Mapped[index]
+	}
+	return nil
+}
+
+// Format an address in the word size of the core
+func (core *Core) Address(addr uint64) string {
+	if core.wordSize() == 8 {
+		return fmt.Sprintf("0x%016x", addr)
+	}
+	return fmt.Sprintf("0x%08x", addr)
+}
+
+// Summary
+//
+// Write a text summary of the core; the process, each thread and its registers, the notes, and the memory segments
+func (core *Core) Summary(w io.Writer) {
+	file := core.File
+
+	fmt.Fprintln(w, SummaryBanner)
+	fmt.Fprintf(w, "ELF %v %v core for %v\n", file.Class, file.Data, file.Machine)
+	if core.Process != "" {
+		fmt.Fprintf(w, "Process: %s\n", core.Process)
+		fmt.Fprintf(w, "Command line: %s\n", core.Args)
+	}
+	fmt.Fprintf(w, "%d threads, %d memory segments, %d mapped files\n", len(core.Threads), len(core.Segments), len(core.Mapped))
+
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "------------------- THREADS -------------------")
+	for index, thread := range core.Threads {
+		fmt.Fprintf(w, "Thread %d: LWP %d", index+1, thread.Pid)
+		if thread.Signal != 0 {
+			fmt.Fprintf(w, ", signal %d", thread.Signal)
+		}
+		fmt.Fprintf(w, ", pc %s", core.Address(thread.PC))
+		if mapped := core.MappedAt(thread.PC); mapped != nil {
+			fmt.Fprintf(w, " in %s", mapped.Name)
+		}
+		fmt.Fprintln(w)
+
+		for i, reg := range thread.Registers {
+			fmt.Fprintf(w, "  %-8s %s", reg.Name, core.Address(reg.Value))
+			if i%4 == 3 || i == len(thread.Registers)-1 {
+				fmt.Fprintln(w)
+			}
+		}
+	}
+
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "------------------- NOTES -------------------")
+	for _, note := range core.Notes {
+		name, ok := noteNames[note.Type]
+		if !ok {
+			name = fmt.Sprintf("type 0x%x", note.Type)
+		}
+		fmt.Fprintf(w, "%-8s %-12s %d bytes\n", note.Name, name, len(note.Desc))
+	}
+
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "------------------- SEGMENTS -------------------")
+	fmt.Fprintf(w, "%-18s %-18s %10s %10s  %s\n", "Start", "End", "File size", "Mem size", "Flags")
+	for _, segment := range core.Segments {
+		fmt.Fprintf(w, "%-18s %-18s %10d %10d  %v", core.Address(segment.Vaddr), core.Address(segment.Vaddr+segment.Memsz),
+			segment.Filesz, segment.Memsz, segment.Flags)
+		if mapped := core.MappedAt(segment.Vaddr); mapped != nil {
+			fmt.Fprintf(w, "  %s", mapped.Name)
+		}
+		fmt.Fprintln(w)
+	}
+
+	if len(core.Mapped) > 0 {
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "------------------- MAPPED FILES -------------------")
+		for _, mapped := range core.Mapped {
+			fmt.Fprintf(w, "%s-%s %10d  %s\n", core.Address(mapped.Start), core.Address(mapped.End), mapped.Offset, mapped.Name)
+		}
+	}
+}
@@ -0,0 +1,382 @@
+// core_test
+package core
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"debug/elf"
+	"encoding/binary"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testSegment is a memory segment in a test core
+type testSegment struct {
+	vaddr uint64
+	data  []byte
+}
+
+// Build a note
+func testNote(name string, noteType uint32, desc []byte) []byte {
+	var note bytes.Buffer
+	order := binary.LittleEndian
+	binary.Write(&note, order, uint32(len(name)+1))
+	binary.Write(&note, order, uint32(len(desc)))
+	binary.Write(&note, order, noteType)
+	note.WriteString(name)
+	note.Write(make([]byte, align4(uint64(len(name)+1))-uint64(len(name))))
+	note.Write(desc)
+	note.Write(make([]byte, align4(uint64(len(desc)))-uint64(len(desc))))
+	return note.Bytes()
+}
+
+// Build an ARM NT_PRSTATUS note from a register set
+func testPrstatus(pid uint32, signal uint16, regs [18]uint32) []byte {
+	desc := make([]byte, 148)
+	order := binary.LittleEndian
+	order.PutUint16(desc[12:], signal)
+	order.PutUint32(desc[24:], pid)
+	for i, reg := range regs {
+		order.PutUint32(desc[72+i*4:], reg)
+	}
+	return testNote("CORE", NT_PRSTATUS, desc)
+}
+
+// buildTestCore
+//
+// Build a little endian 32 bit ARM core, with the given notes and memory segments
+func buildTestCore(notes [][]byte, segments []testSegment) []byte {
+	order := binary.LittleEndian
+	const ehsize, phentsize = 52, 32
+
+	var noteData []byte
+	for _, note := range notes {
+		noteData = append(noteData, note...)
+	}
+
+	phnum := 1 + len(segments)
+	offset := uint32(ehsize + phnum*phentsize)
+
+	var core bytes.Buffer
+	ident := [elf.EI_NIDENT]byte{0x7f, 'E', 'L', 'F', byte(elf.ELFCLASS32), byte(elf.ELFDATA2LSB), byte(elf.EV_CURRENT)}
+
+	header := elf.Header32{
+		Type:      uint16(elf.ET_CORE),
+		Machine:   uint16(elf.EM_ARM),
+		Version:   uint32(elf.EV_CURRENT),
+		Phoff:     ehsize,
+		Ehsize:    ehsize,
+		Phentsize: phentsize,
+		Phnum:     uint16(phnum),
+	}
+	copy(header.Ident[:], ident[:])
+	binary.Write(&core, order, header)
+
+	binary.Write(&core, order, elf.Prog32{Type: uint32(elf.PT_NOTE), Off: offset, Filesz: uint32(len(noteData))})
+	offset += uint32(len(noteData))
+	for _, segment := range segments {
+		binary.Write(&core, order, elf.Prog32{Type: uint32(elf.PT_LOAD), Off: offset, Vaddr: uint32(segment.vaddr),
+			Filesz: uint32(len(segment.data)), Memsz: uint32(len(segment.data)), Flags: uint32(elf.PF_R | elf.PF_W), Align: 4})
+		offset += uint32(len(segment.data))
+	}
+
+	core.Write(noteData)
+	for _, segment := range segments {
+		core.Write(segment.data)
+	}
+	return core.Bytes()
+}
+
+// A core with two threads, process info and a mapped file
+func testCore() []byte {
+	prpsinfo := make([]byte, 124)
+	copy(prpsinfo[124-96:], "RTPMain")
+	copy(prpsinfo[124-80:], "/bin/RTPMain -d")
+
+	fileNote := make([]byte, 8+12)
+	binary.LittleEndian.PutUint32(fileNote[0:], 1)
+	binary.LittleEndian.PutUint32(fileNote[4:], 4096)
+	binary.LittleEndian.PutUint32(fileNote[8:], 0x8000)
+	binary.LittleEndian.PutUint32(fileNote[12:], 0x9000)
+	binary.LittleEndian.PutUint32(fileNote[16:], 0)
+	fileNote = append(fileNote, "/bin/RTPMain\x00"...)
+
+	var crashed, idle [18]uint32
+	crashed[11], crashed[13], crashed[14], crashed[15] = 0x7ff0100c, 0x7ff01000, 0x8100, 0x8204
+	idle[13], idle[15] = 0x7ff01080, 0x8300
+
+	// Stack; the return address saved by main_loop for the crashed thread, and a return address for the idle thread
+	// to be found by scanning
+	stack := make([]byte, 0x100)
+	binary.LittleEndian.PutUint32(stack[28:], 0x800c)
+	binary.LittleEndian.PutUint32(stack[0x88:], 0x800c)
+
+	return buildTestCore([][]byte{
+		testNote("CORE", NT_PRPSINFO, prpsinfo),
+		testPrstatus(100, 11, crashed),
+		testPrstatus(101, 0, idle),
+		testNote("CORE", NT_FILE, fileNote),
+	}, []testSegment{{0x8000, make([]byte, 0x1000)}, {0x7ff01000, stack}})
+}
+
+// Threads, registers, process info and segments are read from a core
+func TestOpen(t *testing.T) {
+	core, err := Open(bytes.NewReader(testCore()), int64(len(testCore())))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if core.Process != "RTPMain" || core.Args != "/bin/RTPMain -d" {
+		t.Errorf("Unexpected process %q %q", core.Process, core.Args)
+	}
+	if len(core.Threads) != 2 {
+		t.Fatalf("Unexpected threads %v", core.Threads)
+	}
+	thread := core.Threads[0]
+	if thread.Pid != 100 || thread.Signal != 11 || thread.PC != 0x8204 || thread.SP != 0x7ff01000 ||
+		thread.LR != 0x8100 || thread.FP != 0x7ff0100c || len(thread.Registers) != 18 {
+		t.Errorf("Unexpected thread %+v", thread)
+	}
+	if len(core.Segments) != 2 || core.Segments[1].Vaddr != 0x7ff01000 || core.Segments[1].Filesz != 0x100 {
+		t.Errorf("Unexpected segments %+v", core.Segments)
+	}
+	if len(core.Mapped) != 1 || core.Mapped[0].Name != "/bin/RTPMain" || core.MappedAt(0x8204) == nil || core.MappedAt(0x9000) != nil {
+		t.Errorf("Unexpected mapped files %+v", core.Mapped)
+	}
+
+	var summary bytes.Buffer
+	core.Summary(&summary)
+	for _, expected := range []string{"Process: RTPMain", "Thread 1: LWP 100, signal 11, pc 0x00008204 in /bin/RTPMain",
+		"Thread 2: LWP 101", "NT_PRSTATUS", "0x7ff01000"} {
+		if !strings.Contains(summary.String(), expected) {
+			t.Errorf("Summary doesn't contain %q\n%s", expected, summary.String())
+		}
+	}
+
+	if _, err := Open(bytes.NewReader([]byte("not a core")), 10); err == nil {
+		t.Error("Open accepted a file which isn't a core")
+	}
+}
+
+// Notes with a size past the end of the segment, including sizes which would wrap when aligned, end the notes
+// rather than panicking
+func TestParseNotesCorrupt(t *testing.T) {
+	good := testNote("CORE", NT_PRPSINFO, make([]byte, 8))
+	corrupt := func(namesz uint32, descsz uint32) []byte {
+		note := make([]byte, 12+16)
+		binary.LittleEndian.PutUint32(note[0:], namesz)
+		binary.LittleEndian.PutUint32(note[4:], descsz)
+		return note
+	}
+
+	tests := []struct {
+		name  string
+		data  []byte
+		notes int
+	}{
+		{"valid", append(append([]byte{}, good...), good...), 2},
+		{"name wraps", append(append([]byte{}, good...), corrupt(0xfffffffd, 0)...), 1},
+		{"descriptor wraps", corrupt(4, 0xffffffff), 0},
+		{"both wrap", corrupt(0xfffffffe, 0xfffffffe), 0},
+		{"descriptor past the end", corrupt(4, 13), 0},
+		{"header only", good[:12], 0},
+	}
+	for _, test := range tests {
+		if notes := parseNotes(test.data, binary.LittleEndian); len(notes) != test.notes {
+			t.Errorf("%s: %d notes, want %d", test.name, len(notes), test.notes)
+		}
+	}
+
+	// A note segment larger than the core is read to the end of the core
+	data := testCore()
+	binary.LittleEndian.PutUint32(data[52+16:], 0xfffffff0)
+	core, err := Open(bytes.NewReader(data), int64(len(data)))
+	if err != nil || len(core.Threads) != 2 {
+		t.Errorf("Unexpected core %v", err)
+	}
+}
+
+func FuzzParseNotes(f *testing.F) {
+	f.Add(testNote("CORE", NT_PRSTATUS, make([]byte, 148)))
+	f.Add([]byte{0xfd, 0xff, 0xff, 0xff, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		parseNotes(data, binary.LittleEndian)
+		parseNotes(data, binary.BigEndian)
+	})
+}
+
+// Cores can be uncompressed, or compressed with compress, zlib or gzip
+func TestDecompress(t *testing.T) {
+	core := testCore()
+
+	var zlibCore, gzipCore bytes.Buffer
+	zw := zlib.NewWriter(&zlibCore)
+	zw.Write(core)
+	zw.Close()
+	gw := gzip.NewWriter(&gzipCore)
+	gw.Write(core)
+	gw.Close()
+
+	for name, data := range map[string][]byte{"elf": core, "zlib": zlibCore.Bytes(), "gzip": gzipCore.Bytes()} {
+		reader, err := Decompress(bytes.NewReader(data))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		decompressed, err := ioutil.ReadAll(reader)
+		if err != nil || !bytes.Equal(decompressed, core) {
+			t.Errorf("%s: not decompressed %v", name, err)
+		}
+	}
+
+	// "TOBEORNOTTOBEORTOBEORNOT\n" compressed with compress
+	compressed := []byte{0x1f, 0x9d, 0x90, 0x54, 0x9e, 0x08, 0x29, 0xf2, 0x44, 0x8a, 0x93, 0x27, 0x54, 0x02, 0x0e, 0x2c,
+		0xa8, 0x90, 0xa0, 0x41, 0x84, 0x0a, 0x00}
+	reader, err := Decompress(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decompressed, err := ioutil.ReadAll(reader)
+	if err != nil || string(decompressed) != "TOBEORNOTTOBEORTOBEORNOT\n" {
+		t.Errorf("compress: got %q %v", decompressed, err)
+	}
+
+	if _, err := Decompress(strings.NewReader("plain text, not a core")); err == nil {
+		t.Error("Decompress accepted a file which isn't a core")
+	}
+}
+
+// testFunction is a function in a test executable
+type testFunction struct {
+	name string
+	addr uint32
+	code []uint32
+	size uint32
+}
+
+// buildTestExecutable
+//
+// Build a little endian 32 bit ARM executable, with the given functions in its text and symbol table
+func buildTestExecutable(functions []testFunction) []byte {
+	order := binary.LittleEndian
+	const ehsize, phentsize, shentsize, textAddr = 52, 32, 40, 0x8000
+
+	var text []byte
+	strtab := []byte{0}
+	symtab := make([]byte, 16) // The null symbol
+	for _, function := range functions {
+		end := int(function.addr-textAddr) + int(function.size)
+		if end > len(text) {
+			text = append(text, make([]byte, end-len(text))...)
+		}
+		for i, insn := range function.code {
+			order.PutUint32(text[int(function.addr-textAddr)+i*4:], insn)
+		}
+
+		var symbol bytes.Buffer
+		binary.Write(&symbol, order, elf.Sym32{Name: uint32(len(strtab)), Value: function.addr, Size: function.size,
+			Info: elf.ST_INFO(elf.STB_GLOBAL, elf.STT_FUNC), Shndx: 1})
+		symtab = append(symtab, symbol.Bytes()...)
+		strtab = append(strtab, function.name+"\x00"...)
+	}
+	shstrtab := []byte("\x00.text\x00.symtab\x00.strtab\x00.shstrtab\x00")
+
+	textOffset := uint32(ehsize + phentsize)
+	symtabOffset := textOffset + uint32(len(text))
+	strtabOffset := symtabOffset + uint32(len(symtab))
+	shstrtabOffset := strtabOffset + uint32(len(strtab))
+	shoff := shstrtabOffset + uint32(len(shstrtab))
+
+	var file bytes.Buffer
+	header := elf.Header32{
+		Type:      uint16(elf.ET_EXEC),
+		Machine:   uint16(elf.EM_ARM),
+		Version:   uint32(elf.EV_CURRENT),
+		Phoff:     ehsize,
+		Shoff:     shoff,
+		Ehsize:    ehsize,
+		Phentsize: phentsize,
+		Phnum:     1,
+		Shentsize: shentsize,
+		Shnum:     5,
+		Shstrndx:  4,
+	}
+	copy(header.Ident[:], []byte{0x7f, 'E', 'L', 'F', byte(elf.ELFCLASS32), byte(elf.ELFDATA2LSB), byte(elf.EV_CURRENT)})
+	binary.Write(&file, order, header)
+	binary.Write(&file, order, elf.Prog32{Type: uint32(elf.PT_LOAD), Off: textOffset, Vaddr: textAddr,
+		Filesz: uint32(len(text)), Memsz: uint32(len(text)), Flags: uint32(elf.PF_R | elf.PF_X), Align: 4})
+
+	file.Write(text)
+	file.Write(symtab)
+	file.Write(strtab)
+	file.Write(shstrtab)
+
+	for _, section := range []elf.Section32{
+		{},
+		{Name: 1, Type: uint32(elf.SHT_PROGBITS), Flags: uint32(elf.SHF_ALLOC | elf.SHF_EXECINSTR), Addr: textAddr,
+			Off: textOffset, Size: uint32(len(text)), Addralign: 4},
+		{Name: 7, Type: uint32(elf.SHT_SYMTAB), Off: symtabOffset, Size: uint32(len(symtab)), Link: 3, Info: 1,
+			Addralign: 4, Entsize: 16},
+		{Name: 15, Type: uint32(elf.SHT_STRTAB), Off: strtabOffset, Size: uint32(len(strtab)), Addralign: 1},
+		{Name: 23, Type: uint32(elf.SHT_STRTAB), Off: shstrtabOffset, Size: uint32(len(shstrtab)), Addralign: 1},
+	} {
+		binary.Write(&file, order, section)
+	}
+	return file.Bytes()
+}
+
+// Threads are unwound using the prologues of the functions in the symbol files, or by scanning the stack
+func TestBacktrace(t *testing.T) {
+	dir := t.TempDir()
+	executable := buildTestExecutable([]testFunction{
+		// push {r4, lr}; sub sp, sp, #8; bl main_loop
+		{"start", 0x8000, []uint32{0xe92d4010, 0xe24dd008, 0xeb00003e}, 0x20},
+		// push {r4, r5, fp, lr}; sub sp, sp, #16
+		{"main_loop", 0x8100, []uint32{0xe92d4830, 0xe24dd010}, 0x200},
+	})
+	ioutil.WriteFile(filepath.Join(dir, "RTPMain"), executable, 0644)
+	ioutil.WriteFile(filepath.Join(dir, "README.txt"), []byte("not a symbol file"), 0644)
+
+	core, err := Open(bytes.NewReader(testCore()), int64(len(testCore())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	symbols, err := core.LoadSymbols(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer symbols.Close()
+	if len(symbols.Modules) != 1 {
+		t.Fatalf("Unexpected symbols %s", symbols.Description)
+	}
+
+	frames := core.Backtrace(core.Threads[0], symbols)
+	if len(frames) != 2 || frames[0].Function != "main_loop" || frames[0].Offset != 0x104 ||
+		frames[1].Function != "start" || frames[1].PC != 0x800c || frames[1].SP != 0x7ff01020 || frames[1].Method != "prologue" {
+		t.Errorf("Unexpected backtrace %+v", frames)
+	}
+
+	// No symbol for the pc, so the stack is scanned
+	frames = core.Backtrace(core.Threads[1], symbols)
+	if len(frames) != 2 || frames[0].Function != "" || frames[1].Function != "start" || frames[1].Method != "scan" {
+		t.Errorf("Unexpected backtrace %+v", frames)
+	}
+
+	var report bytes.Buffer
+	core.Backtraces(&report, symbols)
+	for _, expected := range []string{"#0  0x00008204 in main_loop+0x104 (RTPMain)", "#1  0x0000800c in start+0xc (RTPMain)",
+		"#1  0x0000800c in start+0xc (RTPMain) [scan]"} {
+		if !strings.Contains(report.String(), expected) {
+			t.Errorf("Backtraces don't contain %q\n%s", expected, report.String())
+		}
+	}
+
+	// Without symbols, only the pc and lr are known
+	frames = core.Backtrace(core.Threads[0], nil)
+	if len(frames) != 2 || frames[1].PC != 0x8100 || frames[1].Method != "lr" {
+		t.Errorf("Unexpected backtrace without symbols %+v", frames)
+	}
+}
@@ -25,82 +25,42 @@
 package binary
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"strings"
 	"time"
 
 	// Might want to move this up to main for scalability
 	//	_ "decryptDiags/binary/eventlog"
 )
 
-// Should this be a type?
-const (
-	BinaryFile_FlashEventLog = iota
-	BinaryFile_DiskEventLog
-	BinaryFile_CachedEventLog
-	BinaryFile_ZoneTable
-	BinaryFile_PerfLog
-)
-
-//var BinaryType = map[uint32]string{
-//	iota: "flasheventlog",
-//	iota: "diskeventlog",
-//	iota: "cacheeventlog",
-//	iota: "zonetable",
-//}
-
-const (
-	BinaryFile_ArchARM = iota
-	BinaryFile_ArchMIPS
-)
-
-// VxWorks version defined in HostAppManager.h
-const (
-	BinaryFile_PlatformDrobo = iota
-	BinaryFile_PlatformDrobie
-	BinaryFile_PlatformDroboPro
-	BinaryFile_PlatformDrobo3
-	BinaryFile_PlatformDroboNAS
-	BinaryFile_PlatformGort
-	BinaryFile_PlatformVoltron
-	BinaryFile_PlatformB800i
-	BinaryFile_PlatformB800fs
-	BinaryFile_Platform5D
-	BinaryFile_Platform5N
-	BinaryFile_PlatformB810n
-	BinaryFile_PlatformB810i
-	BinaryFile_PlatformBender
-	BinaryFile_PlatformGerty
-)
-
-const (
-	BinaryFile_OSVxWorks = iota
-	BinaryFile_OSLinux
-	BinaryFile_OSMac
-	BinaryFile_OSWindows
-)
+// First line of a decoded binary file, which allows a decoded file to be recognized
+const DecodeBanner = "------------------- BINARY DECODE -------------------"
 
 const (
 	BinaryFile_FirmwareVersion_Len = 32
 	BinaryFile_OSVersion_Len       = 32
 )
 
-// Header information to encode the type of binary file. Encode this as JSON?
+// Header information to encode the type of binary file. The typed fields are in types.go
 type BinaryHdr struct {
 	HeaderVersion uint32
 
-	DiagBinaryType          uint32 // What data is this? Use a string?
-	DiagBinaryFormatVersion uint32 // Which version?
+	DiagBinaryType          BinaryType // What data is this?
+	DiagBinaryFormatVersion uint32     // Which version?
 
-	Platform          uint32 // 5D, 5N, etc
-	Architecture      uint32 // ARM, MIPS
-	Endianness        uint32 // LittleEndian, BigEndian
+	Platform          Platform     // 5D, 5N, etc
+	Architecture      Architecture // ARM, MIPS
+	Endianness        Endianness   // LittleEndian, BigEndian
 	FirmwareVersion   [BinaryFile_FirmwareVersion_Len]byte
-	OS                uint32 // VxWorks, Linux, Mac, Windows, etc.
+	OS                OperatingSystem // VxWorks, Linux, Mac, Windows, etc.
 	OSVersion         [BinaryFile_OSVersion_Len]byte
 	CreationTimestamp uint32
 	Reserved1         uint32
@@ -110,7 +70,7 @@ type BinaryHdr struct {
 	// Data follows immediately after header
 }
 
-// Header information to encode the type of binary file. Encode this as JSON?
+// JSON form of the header, with the typed fields by name (see MarshalJSON)
 type droboDiagBinaryHdr struct {
 	HeaderVersion uint32 `json:"headerVersion"`
 
@@ -125,12 +85,29 @@ type droboDiagBinaryHdr struct {
 	OSVersion         string `json:"OSVersion"`
 	CreationTimestamp uint32 `json:"creationTimestamp"`
 
-	ImageSize uint32 `json:"imageSize"` // Is this needed
-	// Data follows immediately after header
-	// Payload ... an array of base64 encoding? A binary array? What's best to encode in JSON?
+	ImageSize uint32 `json:"imageSize"`
+}
+
+// MarshalJSON
+//
+// Emit the header as JSON, in its droboDiagBinaryHdr form
+func (binHdr BinaryHdr) MarshalJSON() ([]byte, error) {
+	return json.Marshal(droboDiagBinaryHdr{
+		HeaderVersion:           binHdr.HeaderVersion,
+		DiagBinaryType:          binHdr.DiagBinaryType.String(),
+		DiagBinaryFormatVersion: binHdr.DiagBinaryFormatVersion,
+		Platform:                binHdr.Platform.String(),
+		Architecture:            binHdr.Architecture.String(),
+		Endianness:              binHdr.Endianness == BinaryFile_BigEndian,
+		FirmwareVersion:         binHdr.Firmware(),
+		OS:                      binHdr.OS.String(),
+		OSVersion:               binHdr.OSVersionString(),
+		CreationTimestamp:       binHdr.CreationTimestamp,
+		ImageSize:               binHdr.ImageSize,
+	})
 }
 
-func DecodeDataFile(filename string, decodeFilename string) {
+func DecodeDataFile(filename string, decodeFilename string, opts DecodeOptions) {
 	reader, err := os.Open(filename)
 	if err != nil {
 		fmt.Println(err)
@@ -146,63 +123,237 @@ func DecodeDataFile(filename string, decodeFilename string) {
 	defer writer.Close()
 	fmt.Println("Decoded to", decodeFilename)
 
-	DecodeFile(reader, writer)
+	err = DecodeFileWithOptions(reader, writer, opts)
+	if err != nil {
+		fmt.Println("Decode of", filename, "incomplete:", err)
+	}
 }
 
-// Move this to its own file, and make an interface?
-func DecodeFile(reader io.Reader, writer io.Writer) {
-
+// ReadHeader
+//
+// Read the header at the start of a binary file. The header is in network byte order, except in files from older
+// versions of the convert tool, which wrote it little endian; these are recognized from their header version
+func ReadHeader(reader io.Reader) (BinaryHdr, error) {
 	var binHdr BinaryHdr
+	header := make([]byte, HeaderSize)
+	_, err := io.ReadFull(reader, header)
+	if err != nil {
+		return binHdr, err
+	}
+
+	binary.Read(bytes.NewReader(header), binary.BigEndian, &binHdr)
+	if binHdr.HeaderVersion == headerVersionConvertSwapped {
+		binary.Read(bytes.NewReader(header), binary.LittleEndian, &binHdr)
+	}
+	return binHdr, nil
+}
+
+// Header string field without the null padding
+func nullPadded(field []byte) string {
+	l := bytes.IndexByte(field, 0) // find the EOL
+	if l < 0 {
+		l = len(field)
+	}
+	return string(field[:l])
+}
+
+// Firmware version from the header, without the null padding
+func (binHdr *BinaryHdr) Firmware() string {
+	return nullPadded(binHdr.FirmwareVersion[:])
+}
+
+// OS version from the header, without the null padding
+func (binHdr *BinaryHdr) OSVersionString() string {
+	return nullPadded(binHdr.OSVersion[:])
+}
+
+// DecodeFile
+//
+// Decode a binary file to text. The header is validated (see header.go) before the payload is passed to the
+// decoder for its type. A file which can't be decoded gets an undecodable section saying why, and the error is
+// returned. A payload which isn't the size given in the header is still decoded as far as possible, with a warning,
+// and the size error is returned
+func DecodeFile(reader io.Reader, writer io.Writer) error {
+	return DecodeFileWithOptions(reader, writer, DecodeOptions{})
+}
+
+// DecodeFileWithOptions
+//
+// Decode a binary file to text as DecodeFile, with options for the decoders which take them (see OptionsDecoder).
+// Any format other than text writes the records of the file instead (see records.go)
+func DecodeFileWithOptions(reader io.Reader, writer io.Writer, opts DecodeOptions) error {
+	if opts.Format != "" && opts.Format != FormatText {
+		return decodeFormatted(reader, writer, opts)
+	}
+
+	fmt.Fprintln(writer, DecodeBanner)
 
 	// Read in header, and pass rest of file through to decoder to process
-	// Main header is in network byte order
-	err := binary.Read(reader, binary.BigEndian, &binHdr)
+	header := make([]byte, HeaderSize)
+	n, err := io.ReadFull(reader, header)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = &TruncatedHeaderError{n}
+	}
 	if err != nil {
-		fmt.Println(err)
-		return
+		writeUndecodable(writer, err, header[:n])
+		return err
+	}
+	binHdr, _ := ReadHeader(bytes.NewReader(header))
+
+	payload, err := ioutil.ReadAll(reader)
+	if err != nil {
+		writeUndecodable(writer, err, payload)
+		return err
 	}
 
 	// Report binary file header
 
-	fmt.Fprintln(writer, "------------------- BINARY DECODE -------------------")
 	t := time.Unix(int64(binHdr.CreationTimestamp), 0)
-	fmt.Fprintf(writer, "Decode of binary file format %d (version %d) created at %s\n", binHdr.DiagBinaryType, binHdr.DiagBinaryFormatVersion, t.UTC().Format(time.UnixDate))
+	fmt.Fprintf(writer, "Decode of binary file format %v (version %d) created at %s\n", binHdr.DiagBinaryType, binHdr.DiagBinaryFormatVersion, t.UTC().Format(time.UnixDate))
 
-	l := bytes.IndexByte(binHdr.FirmwareVersion[:], 0) // find the EOL
-	if l < 0 {
-		l = BinaryFile_FirmwareVersion_Len
+	if firmware := binHdr.Firmware(); firmware != "" {
+		io.WriteString(writer, "Firmware version: "+firmware)
+	}
+
+	fmt.Fprintf(writer, " Platform %v Architecture %v Endianness %v OS %v\n", binHdr.Platform, binHdr.Architecture, binHdr.Endianness, binHdr.OS)
+	if unknown := binHdr.UnknownFields(); len(unknown) > 0 {
+		fmt.Fprintf(writer, "WARNING: unknown %s; decoding anyway\n", strings.Join(unknown, ", "))
+	}
+
+	// The header as JSON, so it can be recovered from the decode (see DecodedHeader)
+	if headerJSON, err := json.Marshal(binHdr); err == nil {
+		fmt.Fprintf(writer, "%s%s\n", HeaderJSONPrefix, headerJSON)
 	}
-	if l > 0 {
-		io.WriteString(writer, "Firmware version: "+string(binHdr.FirmwareVersion[:l]))
+	fmt.Fprintln(writer)
+
+	err = binHdr.Validate()
+	if err != nil {
+		writeUndecodable(writer, err, payload)
+
+		// A valid header for a type (or version) we don't have a decoder for, e.g. from newer firmware
+		switch err.(type) {
+		case *UnknownTypeError, *UnsupportedVersionError:
+			hexDumpDecoder.Decoder(binHdr, writer, bytes.NewReader(payload))
+		}
+		return err
 	}
 
-	fmt.Fprintf(writer, " Platform %d Architecture %d Endianness %d OS %d\n\n", binHdr.Platform, binHdr.Architecture, binHdr.Endianness, binHdr.OS)
+	sizeErr := binHdr.checkImageSize(payload)
+	if sizeErr != nil {
+		fmt.Fprintf(writer, "WARNING: %v\n\n", sizeErr)
+		if len(payload) > int(binHdr.ImageSize) {
+			payload = payload[:binHdr.ImageSize]
+		}
+	}
 
 	// The callHandler should work out which which function to call from the binaryHdr
-	_ = callHandler(binHdr, writer, reader)
+	err = callHandler(binHdr, writer, bytes.NewReader(payload), opts)
+	if err != nil {
+		writeUndecodable(writer, fmt.Errorf("decoder failed: %v", err), nil)
+		return err
+	}
+	return sizeErr
+}
+
+// Start of the line of a decode giving the header as JSON
+const HeaderJSONPrefix = "Header JSON: "
+
+// DecodedHeader
+//
+// Return the header of a binary file as JSON, from its decode. The header line is near the start of the decode,
+// so only the first few lines are read
+func DecodedHeader(reader io.Reader) (json.RawMessage, error) {
+	scanner := bufio.NewScanner(reader)
+	for line := 0; line < 10 && scanner.Scan(); line++ {
+		if strings.HasPrefix(scanner.Text(), HeaderJSONPrefix) {
+			return json.RawMessage(strings.TrimPrefix(scanner.Text(), HeaderJSONPrefix)), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("no header in the decode")
+}
+
+// First line of the section explaining why a file couldn't be decoded
+const UndecodableBanner = "------------------- UNDECODABLE -------------------"
+
+// writeUndecodable
+//
+// Report why a file (or the rest of it) couldn't be decoded
+func writeUndecodable(writer io.Writer, err error, data []byte) {
+	fmt.Fprintln(writer)
+	fmt.Fprintln(writer, UndecodableBanner)
+	fmt.Fprintln(writer, "Unable to decode:", err)
+	if data != nil {
+		fmt.Fprintf(writer, "%d bytes not decoded\n", len(data))
+	}
 }
 
 type Decoder interface {
 	Decoder(b BinaryHdr, w io.Writer, r io.Reader) error
 }
 
+// OptionsDecoder is implemented by decoders which take decode options, e.g. event log filters. Decoders which
+// don't implement it are called without them
+type OptionsDecoder interface {
+	DecoderWithOptions(b BinaryHdr, w io.Writer, r io.Reader, opts DecodeOptions) error
+}
+
+// DecodeOptions control what is included in a decode
+type DecodeOptions struct {
+	Events EventFilter // Events included from event logs
+	Format string      // Output format; text (the default), jsonl, csv or a registered format (see records.go)
+}
+
+// EventFilter selects events from event logs, by the severity and category in their message ID. The zero
+// filter selects every event
+type EventFilter struct {
+	MinSeverity uint8   // Least severe event included
+	Categories  []uint8 // Categories included; every category if empty
+}
+
+// Return true if the filter selects every event
+func (filter EventFilter) All() bool {
+	return filter.MinSeverity == 0 && len(filter.Categories) == 0
+}
+
+// Return true if an event of the severity and category is selected
+func (filter EventFilter) Match(severity uint8, category uint8) bool {
+	if severity < filter.MinSeverity {
+		return false
+	}
+	if len(filter.Categories) == 0 {
+		return true
+	}
+	for _, c := range filter.Categories {
+		if c == category {
+			return true
+		}
+	}
+	return false
+}
+
 //Handler registration - basically a map; is there a package to auto handle this?
 
 // need to change this to have a calling signature - probably a writer, and the JSON containing the header; maybe a reader if we're not
 // read the payload into memory yet
-var handlers = map[uint32]Decoder{}
+var handlers = map[BinaryType]Decoder{}
 
-func RegisterDecoder(id uint32, d Decoder) {
+func RegisterDecoder(id BinaryType, d Decoder) {
 	handlers[id] = d
 	log.Println("Register diag decoder handler for", id)
 }
 
-func callHandler(b BinaryHdr, w io.Writer, r io.Reader) error {
+func callHandler(b BinaryHdr, w io.Writer, r io.Reader, opts DecodeOptions) error {
 	if decoder, ok := handlers[b.DiagBinaryType]; ok {
 		log.Println("Calling diag decoder handler for", b.DiagBinaryType)
+		if withOptions, ok := decoder.(OptionsDecoder); ok {
+			return withOptions.DecoderWithOptions(b, w, r, opts)
+		}
 		return decoder.Decoder(b, w, r)
 	} else {
 		log.Println("Failed to find diag decoder for", b.DiagBinaryType)
 	}
-	return nil // should this return some indication that the handler wasn't found?
+	return &UnknownTypeError{b.DiagBinaryType}
 }
@@ -4,13 +4,18 @@
 //
 // Methods for decoding binary eventlog files from Drobo diagnostics
 //
+// Each event is shown with the severity, category and template ID from its message ID, and the events shown can
+// be filtered by minimum severity or category (see binary.EventFilter). The events are also available as records
+// (see DecodeRecords)
+//
 package eventlog
 
 import (
 	"bytes"
 	binDecode "decryptDiags/binary"
-	"encoding/binary"
 	"fmt"
+	"strconv"
+	"strings"
 
 	"io"
 	"time"
@@ -35,7 +40,7 @@ const (
 	EVENT_LOG_ENTRIES           = 1600 * 5
 	EVENT_CACHE_ENTRIES         = 1600 * 5
 	EVENT_FLASH_ENTRIES         = 1600 * 5
-	EVENT_LOG_VERSION           = 0x0003 // only supported version
+	EVENT_LOG_VERSION           = 0x0003 // format version of the current (6.2.5) layout; see layout.go
 
 	PACK_STREAM_BITS = 16
 	PACK_VER_MASK    = ((1 << PACK_STREAM_BITS) - 1)
@@ -47,6 +52,98 @@ type eventLogRecord struct {
 	EventText [MAX_EL_STR]byte // was char
 }
 
+// Severity of an event, from the top 8 bits of the message ID. Least severe first, so events can be filtered by
+// minimum severity
+type Severity uint8
+
+const (
+	SeverityInfo Severity = iota
+	SeverityWarning
+	SeverityError
+	SeverityCritical
+)
+
+var severityNames = []string{"Info", "Warning", "Error", "Critical"}
+
+// Name of the severity, or its number if it doesn't have one
+func (s Severity) String() string {
+	if int(s) < len(severityNames) {
+		return severityNames[s]
+	}
+	return strconv.Itoa(int(s))
+}
+
+// Severities with names, least severe first
+func Severities() []Severity {
+	severities := make([]Severity, len(severityNames))
+	for index := range severities {
+		severities[index] = Severity(index)
+	}
+	return severities
+}
+
+// ParseSeverity
+//
+// Look up a severity from its name, ignoring case, or its number
+func ParseSeverity(name string) (Severity, error) {
+	name = strings.TrimSpace(name)
+	for value, n := range severityNames {
+		if strings.EqualFold(n, name) {
+			return Severity(value), nil
+		}
+	}
+	if value, err := strconv.ParseUint(name, 0, 8); err == nil {
+		return Severity(value), nil
+	}
+	return 0, fmt.Errorf("unknown severity %q; expected one of %s, or a number", name, strings.Join(severityNames, ", "))
+}
+
+// Event is an event from an event log
+type Event struct {
+	Time      time.Time
+	MessageID uint32 // 8 bits severity; 8 bits category; 16 bits template ID
+	Text      string
+}
+
+// Fields of the message ID
+func (e Event) Severity() Severity {
+	return Severity(e.MessageID >> 24)
+}
+
+func (e Event) Category() uint8 {
+	return uint8(e.MessageID >> 16)
+}
+
+func (e Event) Template() uint16 {
+	return uint16(e.MessageID)
+}
+
+// Event line, with the severity, category and template ID from the message ID
+func (e Event) String() string {
+	return fmt.Sprintf("%s:%-8s [category %d, template %d] %s", e.Time.UTC().Format(time.UnixDate), e.Severity(), e.Category(),
+		e.Template(), e.Text)
+}
+
+// Fields of the event, as a record (see binary.Record)
+func (e Event) Fields() []binDecode.Field {
+	return []binDecode.Field{
+		{Name: "time", Value: e.Time},
+		{Name: "severity", Value: e.Severity().String()},
+		{Name: "category", Value: e.Category()},
+		{Name: "template", Value: e.Template()},
+		{Name: "text", Value: e.Text},
+	}
+}
+
+// Return the event of a record
+func (rec *eventLogRecord) event() Event {
+	l := bytes.IndexByte(rec.EventText[:], 0) // find the EOL
+	if l < 0 {
+		l = MAX_EL_STR
+	}
+	return Event{time.Unix(int64(rec.Timestamp), 0).UTC(), rec.MessageID, string(rec.EventText[:l])}
+}
+
 type FlashLogDecoder struct{}
 
 var flashLogDecoder FlashLogDecoder
@@ -58,61 +155,104 @@ func init() {
 	binDecode.RegisterDecoder(binDecode.BinaryFile_CachedEventLog, &flashLogDecoder)
 }
 
-func (flashlog *FlashLogDecoder) DumpRecords(rec eventLogRecord, w io.Writer) {
-	l := bytes.IndexByte(rec.EventText[:], 0) // find the EOL
-	if l < 0 {
-		l = MAX_EL_STR
-	}
-	t := time.Unix(int64(rec.Timestamp), 0)
-	if l > 0 {
-		io.WriteString(w, t.UTC().Format(time.UnixDate)+":"+string(rec.EventText[:l])+"\n")
+// DumpRecords
+//
+// Write an event, with the severity, category and template ID from its message ID. Returns false if the event has
+// no text, and wasn't written
+func (flashlog *FlashLogDecoder) DumpRecords(event Event, w io.Writer) bool {
+	if event.Text == "" {
+		return false
 	}
-
+	io.WriteString(w, event.String()+"\n")
+	return true
 }
 
 func (flashlog *FlashLogDecoder) Decoder(b binDecode.BinaryHdr, w io.Writer, r io.Reader) error {
+	return flashlog.DecoderWithOptions(b, w, r, binDecode.DecodeOptions{})
+}
 
-	var el eventLogHdr
-	var byteOrder binary.ByteOrder
-	byteOrder = binary.LittleEndian
-	if b.Endianness != 0 {
-		byteOrder = binary.BigEndian
+// Describe an event filter, for the decode
+func describeFilter(filter binDecode.EventFilter) string {
+	var terms []string
+	if filter.MinSeverity > 0 {
+		terms = append(terms, "severity "+Severity(filter.MinSeverity).String()+" and above")
 	}
-	err := binary.Read(r, byteOrder, &el)
-	if err != nil {
+	if len(filter.Categories) > 0 {
+		categories := make([]string, len(filter.Categories))
+		for index, category := range filter.Categories {
+			categories[index] = strconv.Itoa(int(category))
+		}
+		terms = append(terms, "categories "+strings.Join(categories, ", "))
+	}
+	return strings.Join(terms, "; ")
+}
+
+func (flashlog *FlashLogDecoder) DecoderWithOptions(b binDecode.BinaryHdr, w io.Writer, r io.Reader, opts binDecode.DecodeOptions) error {
+
+	log, err := ReadLog(b, r)
+	if log == nil {
 		fmt.Println("loader hdr: ", err)
 		return err
 	}
 
 	// Decode header
 
-	l := bytes.IndexByte(el.SoftwareVersion[:], 0) // find the EOL
-	if l < 0 {
-		l = ELM_SOFTWARE_VER_STRING_LEN
+	fmt.Fprintln(w, "EventLog CREATED with s/w version :", log.SoftwareVersion,
+		"with disk pack version :", (log.PackVersion >> PACK_STREAM_BITS), "/", (log.PackVersion & PACK_VER_MASK))
+
+	fmt.Fprintln(w, "Unsafe bootcount :", log.UnsafeBootCount)
+	fmt.Fprintln(w, "Entries :", log.NumEntries)
+	if log.NullEntries > 0 {
+		fmt.Fprintln(w, "Null entries skipped :", log.NullEntries)
+	}
+	if log.Wrapped {
+		fmt.Fprintln(w, "Log has wrapped; shown from the oldest entry")
+	}
+	if log.UnknownVersion {
+		fmt.Fprintf(w, "WARNING: no layout for format version %d; read as the 6.2.5 stream of entries\n", b.DiagBinaryFormatVersion)
+	}
+	if log.TrailingBytes > 0 {
+		fmt.Fprintf(w, "WARNING: %d bytes after the last entry\n", log.TrailingBytes)
+	}
+	filter := opts.Events
+	if !filter.All() {
+		fmt.Fprintln(w, "Showing events with", describeFilter(filter))
 	}
+	io.WriteString(w, "\n")
 
-	fmt.Fprintln(w, "EventLog CREATED with s/w version :", string(el.SoftwareVersion[:l]),
-		"with disk pack version :", (el.PackVer >> PACK_STREAM_BITS), "/", (el.PackVer & PACK_VER_MASK))
+	shown := 0
+	for _, event := range log.Events {
+		if filter.Match(uint8(event.Severity()), event.Category()) && flashlog.DumpRecords(event, w) {
+			shown++
+		}
+	}
 
-	fmt.Fprintln(w, "Unsafe bootcount :", el.UnsafeBootCount)
-	io.WriteString(w, "\n")
+	if !filter.All() {
+		fmt.Fprintf(w, "\n%d of %d events shown\n", shown, len(log.Events))
+	}
+	if err != nil {
+		fmt.Println("end of records ", err, len(log.Events))
+	}
+	return err
+}
 
-	// Dump records from read offset, and wrap back to beginning
+// DecodeRecords
+//
+// Decode the events with text selected by the filter in the options as records. The events before an error
+// reading the log are still passed to emit
+func (flashlog *FlashLogDecoder) DecodeRecords(b binDecode.BinaryHdr, r io.Reader, opts binDecode.DecodeOptions, emit func(binDecode.Record) error) error {
+	log, err := ReadLog(b, r)
+	if log == nil {
+		return err
+	}
 
-	var rec eventLogRecord
-	count := 0
-	for true {
-		err := binary.Read(r, byteOrder, &rec)
-		if err == io.EOF {
-			return nil
+	for _, event := range log.Events {
+		if event.Text == "" || !opts.Events.Match(uint8(event.Severity()), event.Category()) {
+			continue
 		}
-		if err != nil {
-			fmt.Println("end of records ", err, count)
-			return err
+		if emitErr := emit(event); emitErr != nil {
+			return emitErr
 		}
-
-		flashlog.DumpRecords(rec, w)
-		count++
 	}
-	return nil
+	return err
 }
@@ -0,0 +1,223 @@
+// eventlog_test
+package eventlog
+
+import (
+	"bytes"
+	binDecode "decryptDiags/binary"
+	"decryptDiags/internal/eventlogtest"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"testing"
+)
+
+var testEvents = []eventlogtest.Event{
+	eventlogtest.NewEvent(1000, uint8(SeverityInfo), 1, 10, "Drobo started"),
+	eventlogtest.NewEvent(2000, uint8(SeverityWarning), 2, 20, "Disk 2 is hot"),
+	eventlogtest.NewEvent(3000, uint8(SeverityCritical), 3, 0x1234, "Disk 3 failed"),
+}
+
+// Events are shown with their severity, category and template, and can be filtered on severity and category
+func TestEventFilter(t *testing.T) {
+	header := binDecode.BinaryHdr{DiagBinaryType: binDecode.BinaryFile_DiskEventLog, Endianness: binDecode.BinaryFile_BigEndian}
+	payload := eventlogtest.Payload(binary.BigEndian, testEvents)
+
+	tests := []struct {
+		filter   binDecode.EventFilter
+		expected []string // Event texts shown
+	}{
+		{binDecode.EventFilter{}, []string{"Drobo started", "Disk 2 is hot", "Disk 3 failed"}},
+		{binDecode.EventFilter{MinSeverity: uint8(SeverityWarning)}, []string{"Disk 2 is hot", "Disk 3 failed"}},
+		{binDecode.EventFilter{Categories: []uint8{1, 3}}, []string{"Drobo started", "Disk 3 failed"}},
+		{binDecode.EventFilter{MinSeverity: uint8(SeverityError), Categories: []uint8{2}}, nil},
+	}
+
+	for _, test := range tests {
+		var output bytes.Buffer
+		err := flashLogDecoder.DecoderWithOptions(header, &output, bytes.NewReader(payload), binDecode.DecodeOptions{Events: test.filter})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		shown := 0
+		for _, event := range testEvents {
+			if strings.Contains(output.String(), event.Text) {
+				shown++
+			}
+		}
+		if shown != len(test.expected) {
+			t.Errorf("Filter %+v showed %d events, want %v\n%s", test.filter, shown, test.expected, output.String())
+		}
+		for _, text := range test.expected {
+			if !strings.Contains(output.String(), text) {
+				t.Errorf("Filter %+v didn't show %q\n%s", test.filter, text, output.String())
+			}
+		}
+	}
+
+	var output bytes.Buffer
+	flashLogDecoder.Decoder(header, &output, bytes.NewReader(payload))
+	if !strings.Contains(output.String(), "Critical [category 3, template 4660] Disk 3 failed") {
+		t.Errorf("Message ID not decoded\n%s", output.String())
+	}
+
+	for name, expected := range map[string]Severity{"critical": SeverityCritical, "1": SeverityWarning, "Info": SeverityInfo} {
+		if severity, err := ParseSeverity(name); err != nil || severity != expected {
+			t.Errorf("ParseSeverity(%q) = %v, %v", name, severity, err)
+		}
+	}
+	if _, err := ParseSeverity("loud"); err == nil {
+		t.Errorf("ParseSeverity accepted an unknown severity")
+	}
+}
+
+// Event logs are merged into time order, with events found in more than one log shown once, tagged with each source
+func TestTimeline(t *testing.T) {
+	flash := eventlogtest.Payload(binary.LittleEndian, []eventlogtest.Event{
+		eventlogtest.NewEvent(1000, uint8(SeverityInfo), 1, 10, "Drobo started"),
+		eventlogtest.NewEvent(3000, uint8(SeverityCritical), 3, 30, "Disk 3 failed"),
+		eventlogtest.NewEvent(3000, uint8(SeverityCritical), 3, 30, "Disk 3 failed"),
+	})
+	disk := eventlogtest.Payload(binary.BigEndian, []eventlogtest.Event{
+		eventlogtest.NewEvent(2000, uint8(SeverityWarning), 2, 20, "Disk 2 is hot"),
+		eventlogtest.NewEvent(3000, uint8(SeverityCritical), 3, 30, "Disk 3 failed"),
+		eventlogtest.NewEvent(4000, uint8(SeverityInfo), 1, 40, ""),
+	})
+
+	timeline := &Timeline{}
+	for _, source := range []struct {
+		header  binDecode.BinaryHdr
+		payload []byte
+	}{
+		{binDecode.BinaryHdr{DiagBinaryType: binDecode.BinaryFile_FlashEventLog}, flash},
+		{binDecode.BinaryHdr{DiagBinaryType: binDecode.BinaryFile_DiskEventLog, Endianness: binDecode.BinaryFile_BigEndian}, disk},
+	} {
+		log, err := ReadLog(source.header, bytes.NewReader(source.payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		timeline.Add(log)
+	}
+
+	var text bytes.Buffer
+	timeline.WriteText(&text, binDecode.EventFilter{})
+	lines := strings.Split(strings.TrimSpace(text.String()), "\n")
+	expected := []string{"[flash] ", "Drobo started", "[disk] ", "Disk 2 is hot", "[flash+disk] ", "Disk 3 failed", "[flash] ", "Disk 3 failed"}
+	if len(lines) != 4 {
+		t.Fatalf("Unexpected timeline\n%s", text.String())
+	}
+	for index, line := range lines {
+		if !strings.HasPrefix(line, expected[index*2]) || !strings.HasSuffix(line, expected[index*2+1]) {
+			t.Errorf("Line %d is %q, want %q ... %q", index, line, expected[index*2], expected[index*2+1])
+		}
+	}
+
+	// The JSON timeline reads back as the same timeline
+	var encoded bytes.Buffer
+	timeline.WriteJSON(&encoded, binDecode.EventFilter{MinSeverity: uint8(SeverityWarning)})
+	decoded, err := ReadTimelineJSON(&encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filtered := timeline.Filtered(binDecode.EventFilter{MinSeverity: uint8(SeverityWarning)})
+	if len(decoded.Events) != 3 || len(filtered) != 3 {
+		t.Fatalf("Unexpected filtered timeline %+v", decoded.Events)
+	}
+	for index, event := range decoded.Events {
+		if !event.Time.Equal(filtered[index].Time) || event.MessageID != filtered[index].MessageID ||
+			event.Text != filtered[index].Text || event.SourceTag() != filtered[index].SourceTag() {
+			t.Errorf("Event %d read back as %+v, want %+v", index, event, filtered[index])
+		}
+	}
+}
+
+// Event logs are read in the layout for their format version, bounded by the entries in the header
+func TestReadLogLayouts(t *testing.T) {
+	// A stream is bounded by the entries in the header, and null entries are skipped
+	stream := eventlogtest.Payload(binary.LittleEndian, append([]eventlogtest.Event{eventlogtest.NewEvent(0, 0, 0, 0, "")}, testEvents...))
+	binary.LittleEndian.PutUint32(stream, 3)
+	header := binDecode.BinaryHdr{DiagBinaryType: binDecode.BinaryFile_DiskEventLog, DiagBinaryFormatVersion: EVENT_LOG_VERSION}
+	log, err := ReadLog(header, bytes.NewReader(stream))
+	if err != nil || len(log.Events) != 2 || log.NullEntries != 1 || log.TrailingBytes != binary.Size(eventLogRecord{}) ||
+		log.UnknownVersion || log.Wrapped || log.Layout != streamLayout.name {
+		t.Errorf("Unexpected stream %+v %v", log, err)
+	}
+
+	binary.LittleEndian.PutUint32(stream, 5)
+	log, err = ReadLog(header, bytes.NewReader(stream))
+	if err == nil || len(log.Events) != 3 {
+		t.Errorf("Truncated stream not reported %v", err)
+	}
+
+	binary.LittleEndian.PutUint32(stream, EVENT_LOG_ENTRIES+1)
+	var invalid *binDecode.InvalidHeaderError
+	if _, err = ReadLog(header, bytes.NewReader(stream)); !errors.As(err, &invalid) {
+		t.Errorf("Too many entries not reported %v", err)
+	}
+
+	// A wrapped ring is read from the oldest entry, and a clock reset is sorted by time
+	wrapped := []eventlogtest.Event{testEvents[2], eventlogtest.NewEvent(0, 0, 0, 0, ""), testEvents[0], testEvents[1]}
+	log, err = ReadLog(header, bytes.NewReader(eventlogtest.Payload(binary.LittleEndian, wrapped)))
+	if err != nil || !log.Wrapped || log.NullEntries != 1 || len(log.Events) != 3 || log.Events[0].Text != "Drobo started" ||
+		log.Events[2].Text != "Disk 3 failed" {
+		t.Errorf("Unexpected wrapped log %+v %v", log, err)
+	}
+	reset := []eventlogtest.Event{testEvents[0], testEvents[2], testEvents[1], eventlogtest.NewEvent(500, 0, 0, 0, "Clock reset")}
+	log, err = ReadLog(header, bytes.NewReader(eventlogtest.Payload(binary.LittleEndian, reset)))
+	if err != nil || !log.Wrapped || log.Events[0].Text != "Clock reset" || log.Events[3].Text != "Disk 3 failed" {
+		t.Errorf("Unexpected reordered log %+v %v", log, err)
+	}
+
+	var text bytes.Buffer
+	flashLogDecoder.Decoder(header, &text, bytes.NewReader(eventlogtest.Payload(binary.LittleEndian, wrapped)))
+	if !strings.Contains(text.String(), "Log has wrapped") || strings.Index(text.String(), "Drobo started") > strings.Index(text.String(), "Disk 3 failed") {
+		t.Errorf("Wrapped log not shown from the oldest entry\n%s", text.String())
+	}
+
+	// Versions without a known layout are read as the stream, with a warning
+	binary.LittleEndian.PutUint32(stream, 4)
+	header.HeaderVersion, header.DiagBinaryFormatVersion = binDecode.BinaryFile_HeaderVersion, 7
+	var file, output bytes.Buffer
+	binary.Write(&file, binary.BigEndian, header)
+	file.Write(stream)
+	if err := binDecode.DecodeFile(&file, &output); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(output.String(), "WARNING: no layout for format version 7") || !strings.Contains(output.String(), "Disk 3 failed") {
+		t.Errorf("Unknown version not read as the stream\n%s", output.String())
+	}
+}
+
+// Events are decoded to records, available from DecodeRecords and written as JSON lines or CSV
+func TestEventRecords(t *testing.T) {
+	header := binDecode.BinaryHdr{HeaderVersion: binDecode.BinaryFile_HeaderVersion, DiagBinaryType: binDecode.BinaryFile_DiskEventLog,
+		DiagBinaryFormatVersion: EVENT_LOG_VERSION}
+	var file bytes.Buffer
+	binary.Write(&file, binary.BigEndian, header)
+	file.Write(eventlogtest.Payload(binary.LittleEndian, testEvents))
+
+	opts := binDecode.DecodeOptions{Events: binDecode.EventFilter{MinSeverity: uint8(SeverityWarning)}}
+	_, records, err := binDecode.DecodeRecords(bytes.NewReader(file.Bytes()), opts)
+	if err != nil || len(records) != 2 || records[1].(Event).Text != "Disk 3 failed" {
+		t.Fatalf("Unexpected records %+v %v", records, err)
+	}
+
+	expected := map[string]string{
+		binDecode.FormatJSONLines: `{"time":"1970-01-01T00:50:00Z","severity":"Critical","category":3,"template":4660,"text":"Disk 3 failed"}`,
+		binDecode.FormatCSV:       "time,severity,category,template,text\n1970-01-01T00:33:20Z,Warning,2,20,Disk 2 is hot\n",
+	}
+	for format, text := range expected {
+		opts.Format = format
+		var output bytes.Buffer
+		if err := binDecode.DecodeFileWithOptions(bytes.NewReader(file.Bytes()), &output, opts); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(output.String(), text) || strings.Contains(output.String(), "Drobo started") {
+			t.Errorf("Unexpected %s decode\n%s", format, output.String())
+		}
+	}
+
+	if _, err := binDecode.ParseFormat("xml"); err == nil {
+		t.Errorf("ParseFormat accepted an unknown format")
+	}
+}
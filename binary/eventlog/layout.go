@@ -0,0 +1,164 @@
+// layout.go
+//
+// Copyright (c) 2016 Drobo Inc. All rights reserved
+//
+// Reading event logs, with the layout given by the format version in the binary file header.
+//
+// Layouts are keyed by format version (see layouts). From 6.2.5 the upload is a reduced header followed by a stream
+// of the entries (HISTORY.md, "new model for uploading event logs"). This is the only layout we have samples of, so
+// other format versions are read as the stream too, with a warning, rather than being undecodable. Layouts of
+// earlier firmware (the in-memory ring uploaded before 6.2.5) can be added to layouts once there is a real sample to
+// check against.
+//
+// The number of entries in the header is checked against the size of the log, and bounds the entries read. Null
+// entries are skipped. The entries are in the order of the slots of the log, which is a ring; once it has wrapped,
+// the newest entries are at the start. The events are put back in time order, starting from the oldest entry
+
+package eventlog
+
+import (
+	"bytes"
+	binDecode "decryptDiags/binary"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+)
+
+// layout is how the entries of an event log are stored, following the event log header
+type layout struct {
+	name        string
+	readEntries func(log *Log, el eventLogHdr, r io.Reader, byteOrder binary.ByteOrder) error
+}
+
+var streamLayout = layout{"6.2.5 stream of entries", readStream}
+
+// Layouts by format version (BinaryHdr.DiagBinaryFormatVersion)
+var layouts = map[uint32]layout{
+	0:                 streamLayout, // Files without a format version, e.g. from the convert tool
+	EVENT_LOG_VERSION: streamLayout, // Reduced header and a stream of entries, from 6.2.5
+}
+
+// Size of the log of each type, in entries
+var capacities = map[binDecode.BinaryType]uint32{
+	binDecode.BinaryFile_FlashEventLog:  EVENT_FLASH_ENTRIES,
+	binDecode.BinaryFile_DiskEventLog:   EVENT_LOG_ENTRIES,
+	binDecode.BinaryFile_CachedEventLog: EVENT_CACHE_ENTRIES,
+}
+
+// Log is a decoded event log
+type Log struct {
+	Source          binDecode.BinaryType // Flash, disk or cached event log
+	SoftwareVersion string               // Software version the pack was created with
+	PackVersion     uint32
+	UnsafeBootCount uint32
+	NumEntries      uint32  // Entries in use, from the header
+	Events          []Event // In time order, from the oldest entry, without the null entries
+
+	Layout         string // Name of the layout the log was read with
+	NullEntries    int    // Null entries skipped
+	TrailingBytes  int    // Bytes after the last entry
+	UnknownVersion bool   // The format version isn't known, and the log was read as the stream layout
+	Wrapped        bool   // The ring has wrapped, and the events were reordered from the oldest entry
+}
+
+// A null entry is an unused entry
+func (rec *eventLogRecord) null() bool {
+	return rec.Timestamp == 0 && rec.MessageID == 0 && rec.EventText[0] == 0
+}
+
+// ReadLog
+//
+// Read an event log payload, in the layout for its format version. Format versions without a known layout are read
+// as the stream layout, flagged in the log. If the entries are truncated, the events before are returned along with
+// the error
+func ReadLog(b binDecode.BinaryHdr, r io.Reader) (*Log, error) {
+	byteOrder := b.Endianness.ByteOrder()
+
+	var el eventLogHdr
+	err := binary.Read(r, byteOrder, &el)
+	if err != nil {
+		return nil, err
+	}
+
+	capacity, ok := capacities[b.DiagBinaryType]
+	if !ok {
+		capacity = EVENT_LOG_ENTRIES
+	}
+	if el.NumEntries > capacity {
+		return nil, &binDecode.InvalidHeaderError{Field: "event log entries", Value: el.NumEntries}
+	}
+
+	l := bytes.IndexByte(el.SoftwareVersion[:], 0) // find the EOL
+	if l < 0 {
+		l = ELM_SOFTWARE_VER_STRING_LEN
+	}
+	log := &Log{Source: b.DiagBinaryType, SoftwareVersion: string(el.SoftwareVersion[:l]), PackVersion: el.PackVer,
+		UnsafeBootCount: el.UnsafeBootCount, NumEntries: el.NumEntries}
+
+	lay, ok := layouts[b.DiagBinaryFormatVersion]
+	if !ok {
+		lay = streamLayout
+		log.UnknownVersion = true
+	}
+	log.Layout = lay.name
+
+	err = lay.readEntries(log, el, r, byteOrder)
+	log.Wrapped = unwrap(log.Events)
+	return log, err
+}
+
+// readStream
+//
+// Read the entries of the stream layout; the entries in use, as given in the header, and nothing after
+func readStream(log *Log, el eventLogHdr, r io.Reader, byteOrder binary.ByteOrder) error {
+	var rec eventLogRecord
+	for entry := uint32(0); entry < el.NumEntries; entry++ {
+		err := binary.Read(r, byteOrder, &rec)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = fmt.Errorf("event log truncated; %d of %d entries", entry, el.NumEntries)
+		}
+		if err != nil {
+			return err
+		}
+
+		if rec.null() {
+			log.NullEntries++
+			continue
+		}
+		log.Events = append(log.Events, rec.event())
+	}
+
+	trailing, err := io.Copy(ioutil.Discard, r)
+	log.TrailingBytes = int(trailing)
+	return err
+}
+
+// unwrap
+//
+// Put the events of a ring back in time order, from the oldest entry. Once the ring has wrapped, the entries after
+// the newest are older than those before it, so the events are in order apart from one step back in time, and are
+// rotated to start from there. Any other steps back (e.g. the clock being reset) can't be told apart from a wrap,
+// so the events are then sorted by time, keeping the order of events with the same time. Returns true if the events
+// were reordered
+func unwrap(events []Event) bool {
+	var steps []int
+	for index := 1; index < len(events); index++ {
+		if events[index].Time.Before(events[index-1].Time) {
+			steps = append(steps, index)
+		}
+	}
+
+	switch {
+	case len(steps) == 0:
+		return false
+	case len(steps) == 1 && !events[0].Time.Before(events[len(events)-1].Time):
+		oldest := append([]Event{}, events[steps[0]:]...)
+		copy(events[len(oldest):], events[:steps[0]])
+		copy(events, oldest)
+	default:
+		sort.SliceStable(events, func(i, j int) bool { return events[i].Time.Before(events[j].Time) })
+	}
+	return true
+}
@@ -0,0 +1,215 @@
+// timeline.go
+//
+// Copyright (c) 2016 Drobo Inc. All rights reserved
+//
+// A timeline of the events from the flash, disk and cached event logs in a set of diags, merged into time order.
+//
+// The same event is often in more than one log (e.g. written to flash, and to the disk pack once it's loaded). An
+// event from one log with the same time, message ID and text as an event from another log is shown once, tagged
+// with both sources. Repeats of an event within a single log are kept, as they are separate events
+
+package eventlog
+
+import (
+	binDecode "decryptDiags/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Short names of the event log types, used to tag timeline events
+var sourceNames = map[binDecode.BinaryType]string{
+	binDecode.BinaryFile_FlashEventLog:  "flash",
+	binDecode.BinaryFile_DiskEventLog:   "disk",
+	binDecode.BinaryFile_CachedEventLog: "cache",
+}
+
+// Return true for the binary types which are event logs
+func IsEventLog(t binDecode.BinaryType) bool {
+	_, ok := sourceNames[t]
+	return ok
+}
+
+// Short name of an event log type
+func SourceName(t binDecode.BinaryType) string {
+	if name, ok := sourceNames[t]; ok {
+		return name
+	}
+	return t.String()
+}
+
+// TimelineEvent is an event in a timeline, with the logs it was found in
+type TimelineEvent struct {
+	Event
+	Sources []binDecode.BinaryType
+}
+
+// Tags of the logs the event was found in, e.g. flash+disk
+func (e TimelineEvent) SourceTag() string {
+	names := make([]string, len(e.Sources))
+	for index, source := range e.Sources {
+		names[index] = SourceName(source)
+	}
+	return strings.Join(names, "+")
+}
+
+func (e TimelineEvent) hasSource(source binDecode.BinaryType) bool {
+	for _, s := range e.Sources {
+		if s == source {
+			return true
+		}
+	}
+	return false
+}
+
+// Timeline is the events from a set of event logs, merged into time order
+type Timeline struct {
+	Events []TimelineEvent
+}
+
+// Events are duplicates across logs if all of these are the same
+type timelineKey struct {
+	time      int64
+	messageID uint32
+	text      string
+}
+
+func (e Event) key() timelineKey {
+	return timelineKey{e.Time.Unix(), e.MessageID, e.Text}
+}
+
+// Add
+//
+// Add the events from an event log to the timeline. Events without text are left out
+func (timeline *Timeline) Add(log *Log) {
+	existing := map[timelineKey][]int{} // Indices of the events already in the timeline with each key
+	for index, event := range timeline.Events {
+		existing[event.key()] = append(existing[event.key()], index)
+	}
+
+	for _, event := range log.Events {
+		if event.Text == "" {
+			continue
+		}
+
+		duplicate := false
+		for _, index := range existing[event.key()] {
+			if !timeline.Events[index].hasSource(log.Source) {
+				timeline.Events[index].Sources = append(timeline.Events[index].Sources, log.Source)
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			timeline.Events = append(timeline.Events, TimelineEvent{event, []binDecode.BinaryType{log.Source}})
+		}
+	}
+
+	// Events at the same time stay in the order they were added
+	sort.SliceStable(timeline.Events, func(i, j int) bool {
+		return timeline.Events[i].Time.Before(timeline.Events[j].Time)
+	})
+}
+
+// Filtered
+//
+// Return the events selected by the filter
+func (timeline *Timeline) Filtered(filter binDecode.EventFilter) []TimelineEvent {
+	if filter.All() {
+		return timeline.Events
+	}
+
+	var events []TimelineEvent
+	for _, event := range timeline.Events {
+		if filter.Match(uint8(event.Severity()), event.Category()) {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// WriteText
+//
+// Write the timeline as text; an event per line, tagged with its sources
+func (timeline *Timeline) WriteText(w io.Writer, filter binDecode.EventFilter) error {
+	for _, event := range timeline.Filtered(filter) {
+		_, err := fmt.Fprintf(w, "%-16s %s\n", "["+event.SourceTag()+"]", event.Event)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// JSON form of a timeline event
+type timelineEventJSON struct {
+	Time     time.Time `json:"time"`
+	Severity string    `json:"severity"`
+	Category uint8     `json:"category"`
+	Template uint16    `json:"template"`
+	Text     string    `json:"text"`
+	Sources  []string  `json:"sources"`
+}
+
+// WriteJSON
+//
+// Write the timeline as a JSON array of events, with the severity by name
+func (timeline *Timeline) WriteJSON(w io.Writer, filter binDecode.EventFilter) error {
+	events := []timelineEventJSON{}
+	for _, event := range timeline.Filtered(filter) {
+		sources := make([]string, len(event.Sources))
+		for index, source := range event.Sources {
+			sources[index] = SourceName(source)
+		}
+		events = append(events, timelineEventJSON{event.Time, event.Severity().String(), event.Category(), event.Template(),
+			event.Text, sources})
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(events)
+}
+
+// ReadTimelineJSON
+//
+// Read a timeline written by WriteJSON
+func ReadTimelineJSON(r io.Reader) (*Timeline, error) {
+	var events []timelineEventJSON
+	err := json.NewDecoder(r).Decode(&events)
+	if err != nil {
+		return nil, err
+	}
+
+	timeline := &Timeline{}
+	for _, event := range events {
+		severity, err := ParseSeverity(event.Severity)
+		if err != nil {
+			return nil, err
+		}
+		messageID := uint32(severity)<<24 | uint32(event.Category)<<16 | uint32(event.Template)
+
+		entry := TimelineEvent{Event: Event{event.Time, messageID, event.Text}}
+		for _, name := range event.Sources {
+			source, err := parseSourceName(name)
+			if err != nil {
+				return nil, err
+			}
+			entry.Sources = append(entry.Sources, source)
+		}
+		timeline.Events = append(timeline.Events, entry)
+	}
+	return timeline, nil
+}
+
+// Look up an event log type from its short name
+func parseSourceName(name string) (binDecode.BinaryType, error) {
+	for source, sourceName := range sourceNames {
+		if sourceName == name {
+			return source, nil
+		}
+	}
+	return binDecode.ParseBinaryType(name)
+}
@@ -0,0 +1,154 @@
+// header.go
+//
+// Copyright (c) 2016 Drobo Inc. All rights reserved
+//
+// Validation of the common header on binary diag files.
+//
+// The header is checked before the file is passed to a decoder, so a file which isn't what its name suggests
+// (a text file named EventLog.txt, a truncated upload, a type from newer firmware) is reported as undecodable,
+// rather than being decoded as garbage or producing an empty decode. Each problem is reported as a typed error,
+// so callers can tell them apart.
+
+package binary
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Size of the header on the start of a binary file
+var HeaderSize = binary.Size(BinaryHdr{})
+
+// Header versions
+const (
+	BinaryFile_HeaderVersion        = 1
+	BinaryFile_HeaderVersionConvert = 0xdeadbeef // Written by the convert tool (binary/internal/convert)
+
+	// The convert tool used to write the whole header little endian, so the version reads byte swapped
+	headerVersionConvertSwapped = 0xefbeadde
+)
+
+// TruncatedHeaderError
+//
+// The file is too short to hold a header
+type TruncatedHeaderError struct {
+	Size int // Bytes in the file
+}
+
+func (e *TruncatedHeaderError) Error() string {
+	return fmt.Sprintf("truncated header; file is %d bytes, header is %d bytes", e.Size, HeaderSize)
+}
+
+// InvalidHeaderError
+//
+// A header field is out of range
+type InvalidHeaderError struct {
+	Field string
+	Value uint32
+}
+
+func (e *InvalidHeaderError) Error() string {
+	return fmt.Sprintf("invalid header; %s %d (0x%x) is out of range", e.Field, e.Value, e.Value)
+}
+
+// UnknownTypeError
+//
+// There isn't a decoder for the type of binary file
+type UnknownTypeError struct {
+	Type BinaryType
+}
+
+func (e *UnknownTypeError) Error() string {
+	return fmt.Sprintf("unknown binary file type %v", e.Type)
+}
+
+// UnsupportedVersionError
+//
+// The decoder for the type doesn't support the format version of the file
+type UnsupportedVersionError struct {
+	Type      BinaryType
+	Version   uint32
+	Supported []uint32
+}
+
+func (e *UnsupportedVersionError) Error() string {
+	return fmt.Sprintf("unsupported format version %d for binary file type %v; supported versions are %v", e.Version, e.Type, e.Supported)
+}
+
+// SizeMismatchError
+//
+// The payload following the header isn't the size given in the header
+type SizeMismatchError struct {
+	ImageSize uint32 // Size in the header
+	Actual    int    // Size of the payload
+}
+
+func (e *SizeMismatchError) Error() string {
+	if e.Actual < int(e.ImageSize) {
+		return fmt.Sprintf("payload is truncated; %d of %d bytes", e.Actual, e.ImageSize)
+	}
+	return fmt.Sprintf("payload size mismatch; header gives %d bytes, payload is %d bytes", e.ImageSize, e.Actual)
+}
+
+// VersionedDecoder is implemented by decoders which only support some format versions. Decoders which don't
+// implement it are given every version
+type VersionedDecoder interface {
+	FormatVersions() []uint32
+}
+
+// Validate
+//
+// Check the header version and endianness, and there is a decoder for the type and format version. The platform,
+// architecture and OS don't affect the decode, so values without a name (see UnknownFields) aren't rejected
+func (binHdr *BinaryHdr) Validate() error {
+	if binHdr.HeaderVersion != BinaryFile_HeaderVersion && binHdr.HeaderVersion != BinaryFile_HeaderVersionConvert {
+		return &InvalidHeaderError{"header version", binHdr.HeaderVersion}
+	}
+	if !binHdr.Endianness.Known() {
+		return &InvalidHeaderError{"endianness", uint32(binHdr.Endianness)}
+	}
+
+	decoder, ok := handlers[binHdr.DiagBinaryType]
+	if !ok {
+		return &UnknownTypeError{binHdr.DiagBinaryType}
+	}
+
+	if versioned, ok := decoder.(VersionedDecoder); ok {
+		supported := versioned.FormatVersions()
+		for _, version := range supported {
+			if version == binHdr.DiagBinaryFormatVersion {
+				return nil
+			}
+		}
+		return &UnsupportedVersionError{binHdr.DiagBinaryType, binHdr.DiagBinaryFormatVersion, supported}
+	}
+	return nil
+}
+
+// UnknownFields
+//
+// Header fields with a value without a name, e.g. a platform from newer firmware, with their values. The file is
+// still decoded, with a warning giving them
+func (binHdr *BinaryHdr) UnknownFields() []string {
+	var unknown []string
+	if !binHdr.Platform.Known() {
+		unknown = append(unknown, fmt.Sprintf("platform %d", binHdr.Platform))
+	}
+	if !binHdr.Architecture.Known() {
+		unknown = append(unknown, fmt.Sprintf("architecture %d", binHdr.Architecture))
+	}
+	if !binHdr.OS.Known() {
+		unknown = append(unknown, fmt.Sprintf("OS %d", binHdr.OS))
+	}
+	return unknown
+}
+
+// checkImageSize
+//
+// Check the payload is the size given in the header. Files which don't record a size (0) aren't checked
+func (binHdr *BinaryHdr) checkImageSize(payload []byte) error {
+	if binHdr.ImageSize != 0 && int(binHdr.ImageSize) != len(payload) {
+		return &SizeMismatchError{binHdr.ImageSize, len(payload)}
+	}
+	return nil
+}
@@ -0,0 +1,217 @@
+// header_test
+package binary
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+const testBinaryType = 100
+
+// testDecoder outputs the size of the payload, and only supports format version 2
+type testDecoder struct{}
+
+func (d *testDecoder) Decoder(b BinaryHdr, w io.Writer, r io.Reader) error {
+	payload, err := ioutil.ReadAll(r)
+	fmt.Fprintf(w, "payload %d bytes\n", len(payload))
+	return err
+}
+
+func (d *testDecoder) FormatVersions() []uint32 {
+	return []uint32{2}
+}
+
+func init() {
+	RegisterDecoder(testBinaryType, &testDecoder{})
+}
+
+// Build a binary file with a header
+func testBinaryFile(modify func(*BinaryHdr), payload []byte) []byte {
+	header := BinaryHdr{
+		HeaderVersion:           BinaryFile_HeaderVersion,
+		DiagBinaryType:          testBinaryType,
+		DiagBinaryFormatVersion: 2,
+		Platform:                BinaryFile_Platform5N,
+		ImageSize:               uint32(len(payload)),
+	}
+	if modify != nil {
+		modify(&header)
+	}
+
+	var file bytes.Buffer
+	binary.Write(&file, binary.BigEndian, header)
+	file.Write(payload)
+	return file.Bytes()
+}
+
+// Headers are validated before decoding, and each problem is reported as a typed error and an undecodable section
+func TestDecodeFileValidation(t *testing.T) {
+	payload := make([]byte, 64)
+
+	tests := []struct {
+		name        string
+		file        []byte
+		err         interface{} // Pointer to the expected error type; nil if the decode succeeds
+		decoded     bool        // The decoder is called
+		undecodable bool
+	}{
+		{"valid", testBinaryFile(nil, payload), nil, true, false},
+		{"truncated header", []byte("short"), new(*TruncatedHeaderError), false, true},
+		{"text file", []byte(strings.Repeat("Not a binary diag file\n", 20)), new(*InvalidHeaderError), false, true},
+		{"unknown platform", testBinaryFile(func(h *BinaryHdr) { h.Platform = 99 }, payload), nil, true, false},
+		{"endianness", testBinaryFile(func(h *BinaryHdr) { h.Endianness = 2 }, payload), new(*InvalidHeaderError), false, true},
+		{"unknown type", testBinaryFile(func(h *BinaryHdr) { h.DiagBinaryType = 99 }, payload), new(*UnknownTypeError), false, true},
+		{"format version", testBinaryFile(func(h *BinaryHdr) { h.DiagBinaryFormatVersion = 3 }, payload), new(*UnsupportedVersionError), false, true},
+		{"truncated payload", testBinaryFile(func(h *BinaryHdr) { h.ImageSize = 128 }, payload), new(*SizeMismatchError), true, false},
+		{"no image size", testBinaryFile(func(h *BinaryHdr) { h.ImageSize = 0 }, payload), nil, true, false},
+	}
+
+	for _, test := range tests {
+		var output bytes.Buffer
+		err := DecodeFile(bytes.NewReader(test.file), &output)
+
+		if test.err == nil && err != nil {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		}
+		if test.err != nil && !errors.As(err, test.err) {
+			t.Errorf("%s: got error %v (%T), want %T", test.name, err, err, test.err)
+		}
+		if !strings.HasPrefix(output.String(), DecodeBanner) {
+			t.Errorf("%s: no decode banner", test.name)
+		}
+		if decoded := strings.Contains(output.String(), "payload 64 bytes"); decoded != test.decoded {
+			t.Errorf("%s: decoded %v, want %v\n%s", test.name, decoded, test.decoded, output.String())
+		}
+		if undecodable := strings.Contains(output.String(), UndecodableBanner); undecodable != test.undecodable {
+			t.Errorf("%s: undecodable section %v, want %v\n%s", test.name, undecodable, test.undecodable, output.String())
+		}
+	}
+}
+
+// Platforms, architectures and OSes without a name, e.g. from newer models, are decoded, with a warning giving them
+func TestUnknownPlatform(t *testing.T) {
+	file := testBinaryFile(func(h *BinaryHdr) { h.Platform, h.Architecture, h.OS = 17, 2, 9 }, make([]byte, 64))
+
+	var output bytes.Buffer
+	err := DecodeFile(bytes.NewReader(file), &output)
+	if err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	for _, expected := range []string{"Platform 17 Architecture 2 Endianness little OS 9",
+		"WARNING: unknown platform 17, architecture 2, OS 9; decoding anyway", "payload 64 bytes"} {
+		if !strings.Contains(output.String(), expected) {
+			t.Errorf("Decode doesn't contain %q\n%s", expected, output.String())
+		}
+	}
+
+	file = testBinaryFile(nil, nil)
+	if header, _ := ReadHeader(bytes.NewReader(file)); len(header.UnknownFields()) != 0 {
+		t.Errorf("Unexpected unknown fields %v", header.UnknownFields())
+	}
+}
+
+// Types without a decoder are shown as an annotated hex dump, with the strings and the record size
+func TestHexDumpFallback(t *testing.T) {
+	// 50 records of 24 bytes; a sequence number, a flag and a null terminated name
+	var payload bytes.Buffer
+	for index := 0; index < 50; index++ {
+		record := make([]byte, 24)
+		binary.LittleEndian.PutUint32(record, uint32(index))
+		record[4] = 0x81
+		copy(record[8:], fmt.Sprintf("zone%03d", index))
+		payload.Write(record)
+	}
+
+	if stride, _ := guessStride(payload.Bytes()); stride != 24 {
+		t.Errorf("Record size guessed as %d, want 24", stride)
+	}
+	if stride, _ := guessStride(make([]byte, 4096)); stride != 0 {
+		t.Errorf("Record size guessed as %d for zeros", stride)
+	}
+
+	found := nullTerminatedStrings(payload.Bytes())
+	if len(found) != 50 || found[1].offset != 32 || found[1].text != "zone001" {
+		t.Errorf("Unexpected strings %v", found)
+	}
+
+	var output bytes.Buffer
+	err := DecodeFile(bytes.NewReader(testBinaryFile(func(h *BinaryHdr) { h.DiagBinaryType = 99 }, payload.Bytes())), &output)
+	var unknown *UnknownTypeError
+	if !errors.As(err, &unknown) {
+		t.Errorf("Unexpected error %v", err)
+	}
+	for _, expected := range []string{HexDumpBanner, "Possible record size: 24 bytes (50 records", `0x00000020  "zone001"`,
+		"Record 1:\n00000018  01 00 00 00 81 00 00 00  7a 6f 6e 65 30 30 31 00  |........zone001.|"} {
+		if !bytes.Contains(output.Bytes(), []byte(expected)) {
+			t.Errorf("Hex dump doesn't contain %q\n%s", expected, output.String())
+		}
+	}
+}
+
+// Header fields are shown by name, looked up from their names or numbers, and emitted as JSON by name
+func TestHeaderNames(t *testing.T) {
+	if BinaryFile_Platform5N.String() != "5N" || BinaryFile_ArchMIPS.String() != "MIPS" || BinaryFile_ZoneTable.String() != "zonetable" {
+		t.Errorf("Unexpected names %v %v %v", BinaryFile_Platform5N, BinaryFile_ArchMIPS, BinaryFile_ZoneTable)
+	}
+	if Platform(99).String() != "99" || Platform(99).Known() {
+		t.Errorf("Unknown platform shown as %v", Platform(99))
+	}
+
+	for _, name := range []string{"5n", "10", "0xa", BinaryFile_Platform5N.String()} {
+		if platform, err := ParsePlatform(name); err != nil || platform != BinaryFile_Platform5N {
+			t.Errorf("ParsePlatform(%q) = %v, %v", name, platform, err)
+		}
+	}
+	if _, err := ParseOperatingSystem("BeOS"); err == nil {
+		t.Errorf("ParseOperatingSystem accepted an unknown OS")
+	}
+	if BinaryFile_BigEndian.ByteOrder() != binary.BigEndian || BinaryFile_LittleEndian.ByteOrder() != binary.LittleEndian {
+		t.Errorf("Unexpected byte orders")
+	}
+
+	header := BinaryHdr{DiagBinaryType: BinaryFile_DiskEventLog, Platform: BinaryFile_PlatformB810n, Architecture: BinaryFile_ArchARM,
+		Endianness: BinaryFile_BigEndian, OS: BinaryFile_OSLinux}
+	copy(header.FirmwareVersion[:], "4.1.2")
+	encoded, err := json.Marshal(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded map[string]interface{}
+	json.Unmarshal(encoded, &decoded)
+	expected := map[string]interface{}{"diagBinaryType": "diskeventlog", "platform": "B810n", "arch": "ARM", "endianness": true,
+		"OS": "Linux", "firmwareVersion": "4.1.2", "OSVersion": ""}
+	for field, value := range expected {
+		if decoded[field] != value {
+			t.Errorf("JSON %s is %v, want %v: %s", field, decoded[field], value, encoded)
+		}
+	}
+
+	var output bytes.Buffer
+	DecodeFile(bytes.NewReader(testBinaryFile(nil, nil)), &output)
+	if !strings.Contains(output.String(), "Platform 5N Architecture ARM Endianness little OS VxWorks") {
+		t.Errorf("Header not shown by name\n%s", output.String())
+	}
+
+	// The header can be recovered from the decode
+	recovered, err := DecodedHeader(&output)
+	if err != nil || !bytes.Contains(recovered, []byte(`"platform":"5N"`)) {
+		t.Errorf("Header not recovered from the decode: %s %v", recovered, err)
+	}
+
+	// Older versions of the convert tool wrote the header little endian
+	header.HeaderVersion, header.DiagBinaryType, header.DiagBinaryFormatVersion = BinaryFile_HeaderVersionConvert, testBinaryType, 2
+	var converted bytes.Buffer
+	binary.Write(&converted, binary.LittleEndian, header)
+	read, err := ReadHeader(&converted)
+	if err != nil || read.HeaderVersion != BinaryFile_HeaderVersionConvert || read.Platform != BinaryFile_PlatformB810n ||
+		read.Validate() != nil {
+		t.Errorf("Little endian converted header read as %+v %v", read, err)
+	}
+}
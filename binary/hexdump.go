@@ -0,0 +1,230 @@
+// hexdump.go
+//
+// Copyright (c) 2016 Drobo Inc. All rights reserved
+//
+// Fallback decoder for binary files without a decoder for their type (or format version), typically new binary
+// types from newer firmware. The payload is shown as an annotated hex dump, so it can still be inspected before a
+// proper decoder exists:
+//
+// - The null terminated strings in the payload, with their offsets
+// - A guess at the size of repeated records, from how often bytes repeat at each stride. Most binary diag files
+//   are arrays of fixed size records, whose fields (flags, small counts, padding) repeat from record to record
+// - A hex dump with offsets and an ASCII column. If a record size was found, each record starts a new line
+//   and is numbered. Repeated lines are shown as *, like hexdump -C
+
+package binary
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+)
+
+const (
+	HexDumpBanner = "------------------- HEX DUMP -------------------"
+
+	hexDumpWidth     = 16        // Bytes per line
+	hexDumpMaxBytes  = 256 << 10 // Payload dumped; the strings and stride guess cover the whole payload
+	minStringLength  = 4         // Shortest run of printable characters reported as a string
+	maxStrings       = 500
+	maxStringDisplay = 80
+	minStride        = 4
+	maxStride        = 2048
+	strideSample     = 16 << 10 // Bytes used to guess the stride
+	minStrideScore   = 0.3      // Fraction of bytes repeating at the stride for it to be reported
+)
+
+// HexDumpDecoder decodes any binary file as an annotated hex dump
+type HexDumpDecoder struct{}
+
+var hexDumpDecoder HexDumpDecoder
+
+func (hexdump *HexDumpDecoder) Decoder(b BinaryHdr, w io.Writer, r io.Reader) error {
+	payload, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, HexDumpBanner)
+	fmt.Fprintf(w, "Binary file type %v (version %d), %d byte payload\n", b.DiagBinaryType, b.DiagBinaryFormatVersion, len(payload))
+
+	stride, score := guessStride(payload)
+	if stride > 0 {
+		fmt.Fprintf(w, "Possible record size: %d bytes (%d records, %d remaining bytes; %.0f%% of bytes repeat at this stride)\n",
+			stride, len(payload)/stride, len(payload)%stride, score*100)
+	} else {
+		fmt.Fprintln(w, "No repeating record size found")
+	}
+
+	strings := nullTerminatedStrings(payload)
+	fmt.Fprintf(w, "\nStrings (%d):\n", len(strings))
+	for index, s := range strings {
+		if index == maxStrings {
+			fmt.Fprintf(w, "  ... %d more\n", len(strings)-maxStrings)
+			break
+		}
+		text := s.text
+		if len(text) > maxStringDisplay {
+			text = text[:maxStringDisplay] + "..."
+		}
+		fmt.Fprintf(w, "  0x%08x  %s\n", s.offset, strconv.Quote(text))
+	}
+
+	fmt.Fprintln(w, "\nDump:")
+	dump := payload
+	if len(dump) > hexDumpMaxBytes {
+		dump = dump[:hexDumpMaxBytes]
+	}
+	writeHexDump(w, dump, stride)
+	if len(dump) < len(payload) {
+		fmt.Fprintf(w, "... %d more bytes not shown\n", len(payload)-len(dump))
+	}
+	return nil
+}
+
+// binaryString is a null terminated string found in a payload
+type binaryString struct {
+	offset int
+	text   string
+}
+
+// Printable ASCII
+func printable(b byte) bool {
+	return b >= 0x20 && b < 0x7f
+}
+
+// nullTerminatedStrings
+//
+// Find the runs of at least minStringLength printable characters followed by a null
+func nullTerminatedStrings(data []byte) []binaryString {
+	var strings []binaryString
+	start := 0
+	for index, b := range data {
+		switch {
+		case printable(b) || b == '\t' || b == '\n':
+			continue
+		case b == 0 && index-start >= minStringLength:
+			strings = append(strings, binaryString{start, string(data[start:index])})
+		}
+		start = index + 1
+	}
+	return strings
+}
+
+// guessStride
+//
+// Guess the size of the records in a payload. For each stride, count how many non-zero bytes are the same as the
+// byte a stride later. Multiples of the record size score as well as the record size, so the smallest stride
+// scoring close to the best is chosen. Zero bytes are ignored, as zero padding repeats at every stride.
+// Returns 0 if no stride repeats often enough
+func guessStride(data []byte) (int, float64) {
+	if len(data) > strideSample {
+		data = data[:strideSample]
+	}
+
+	scores := map[int]float64{}
+	best := 0.0
+	for stride := minStride; stride <= maxStride && stride*4 <= len(data); stride++ {
+		matches, counted := 0, 0
+		for index := 0; index+stride < len(data); index++ {
+			if data[index] == 0 {
+				continue
+			}
+			counted++
+			if data[index] == data[index+stride] {
+				matches++
+			}
+		}
+		if counted < 16 {
+			continue
+		}
+		score := float64(matches) / float64(counted)
+		scores[stride] = score
+		if score > best {
+			best = score
+		}
+	}
+
+	if best < minStrideScore {
+		return 0, 0
+	}
+	for stride := minStride; stride <= maxStride; stride++ {
+		if score, ok := scores[stride]; ok && score >= best*0.9 {
+			return stride, score
+		}
+	}
+	return 0, 0
+}
+
+// writeHexDump
+//
+// Write a hex dump; offset, 16 bytes in hex, and as ASCII. If the record size (stride) is known, each record
+// starts a new line, headed by its number
+func writeHexDump(w io.Writer, data []byte, stride int) {
+	record := len(data)
+	if stride > 0 {
+		record = stride
+	}
+
+	for start := 0; start < len(data); start += record {
+		end := start + record
+		if end > len(data) {
+			end = len(data)
+		}
+		if stride > 0 {
+			fmt.Fprintf(w, "Record %d:\n", start/stride)
+		}
+
+		var previous []byte
+		repeated := false
+		for line := start; line < end; line += hexDumpWidth {
+			lineEnd := line + hexDumpWidth
+			if lineEnd > end {
+				lineEnd = end
+			}
+			bytesOnLine := data[line:lineEnd]
+
+			// Collapse lines repeating the previous line
+			if previous != nil && bytes.Equal(bytesOnLine, previous) && lineEnd < end {
+				if !repeated {
+					fmt.Fprintln(w, "*")
+					repeated = true
+				}
+				continue
+			}
+			previous = bytesOnLine
+			repeated = false
+
+			writeHexLine(w, line, bytesOnLine)
+		}
+	}
+}
+
+// Write a single line of a hex dump
+func writeHexLine(w io.Writer, offset int, data []byte) {
+	var line bytes.Buffer
+	fmt.Fprintf(&line, "%08x  ", offset)
+	for index := 0; index < hexDumpWidth; index++ {
+		if index < len(data) {
+			fmt.Fprintf(&line, "%02x ", data[index])
+		} else {
+			line.WriteString("   ")
+		}
+		if index == hexDumpWidth/2-1 {
+			line.WriteByte(' ')
+		}
+	}
+	line.WriteString(" |")
+	for _, b := range data {
+		if printable(b) {
+			line.WriteByte(b)
+		} else {
+			line.WriteByte('.')
+		}
+	}
+	line.WriteString("|\n")
+	w.Write(line.Bytes())
+}
@@ -16,7 +16,12 @@ import (
 const shorthand = " (shorthand)"
 
 var dataFilename string
-var binaryType uint
+var binaryType binDecode.BinaryType
+var platform binDecode.Platform
+var architecture binDecode.Architecture
+var endianness binDecode.Endianness
+var operatingSystem binDecode.OperatingSystem
+var firmware string
 
 // Tie the command-line flag to the dataFilename variable and set usage info
 func init() {
@@ -28,14 +33,44 @@ func init() {
 	flag.StringVar(&dataFilename, "dataFilename", defaultFilename, usage)
 }
 
+// The header fields take their names (e.g. zonetable, 5N, ARM), or numbers
+func init() {
+	const usage = "The binary type (flasheventlog, diskeventlog, cacheeventlog, zonetable, perflog)"
+	flag.Var(&binaryType, "b", usage+shorthand)
+	flag.Var(&binaryType, "binaryType", usage)
+}
+
+func init() {
+	const usage = "The platform (e.g. 5D, 5N, B810n)"
+	flag.Var(&platform, "p", usage+shorthand)
+	flag.Var(&platform, "platform", usage)
+}
+
+func init() {
+	const usage = "The architecture (ARM, MIPS)"
+	flag.Var(&architecture, "a", usage+shorthand)
+	flag.Var(&architecture, "arch", usage)
+}
+
+func init() {
+	const usage = "The byte order of the data file (little, big)"
+	flag.Var(&endianness, "e", usage+shorthand)
+	flag.Var(&endianness, "endianness", usage)
+}
+
+func init() {
+	const usage = "The OS (VxWorks, Linux, Mac, Windows)"
+	flag.Var(&operatingSystem, "o", usage+shorthand)
+	flag.Var(&operatingSystem, "os", usage)
+}
+
 func init() {
 	const (
-		defaultType = 0
-		usage       = "The binary type"
+		defaultFirmware = ""
+		usage           = "The firmware version"
 	)
-	flag.UintVar(&binaryType, "b", defaultType, usage+shorthand)
-	flag.UintVar(&binaryType, "binaryType", defaultType, usage)
-
+	flag.StringVar(&firmware, "fw", defaultFirmware, usage+shorthand)
+	flag.StringVar(&firmware, "firmware", defaultFirmware, usage)
 }
 
 func convertDataFile(filename string, convertFilename string) {
@@ -70,13 +105,18 @@ func convertFile(reader io.Reader, writer io.Writer) {
 		return
 	}
 
-	binHdr.HeaderVersion = 0xdeadbeef
-	binHdr.DiagBinaryType = uint32(binaryType)
+	binHdr.HeaderVersion = binDecode.BinaryFile_HeaderVersionConvert
+	binHdr.DiagBinaryType = binaryType
+	binHdr.Platform = platform
+	binHdr.Architecture = architecture
+	binHdr.Endianness = endianness
+	binHdr.OS = operatingSystem
+	copy(binHdr.FirmwareVersion[:], firmware)
 	binHdr.ImageSize = uint32(binary.Size(bs))
 
-	// Write out header
+	// Write out header; the header is in network byte order, as DecodeFile expects
 
-	err = binary.Write(writer, binary.LittleEndian, &binHdr)
+	err = binary.Write(writer, binary.BigEndian, &binHdr)
 	if err != nil {
 		fmt.Println(err)
 		return
@@ -98,7 +138,8 @@ func main() {
 	convertFileSplit[0] += ".bin"
 	var convertFilename string = strings.Join(convertFileSplit, ".")
 
-	fmt.Println("Convert", dataFilename, "to", convertFilename, "with binaryType", binaryType)
+	fmt.Println("Convert", dataFilename, "to", convertFilename, "with binaryType", binaryType, "platform", platform,
+		"architecture", architecture, "endianness", endianness, "OS", operatingSystem)
 
 	convertDataFile(dataFilename, convertFilename)
 	//		path = pathToOpen(decodeFilename)
@@ -63,6 +63,10 @@ type PerfLogHeaderMIPS struct {
 }
 
 func (hdr *PerfLogHeaderMIPS) convertArmHdrToMips(armHdr *PerfLogHeaderARM) {
+	hdr.Name = armHdr.Name
+	hdr.PauseReason = armHdr.PauseReason
+	hdr.RecordEntries = armHdr.RecordEntries
+	hdr.NextLogIndex = armHdr.NextLogIndex
 	for i := 0; i < NUM_LOG_ENTRIES; i++ {
 		hdr.EntryTimes[i].FastTicksVal = uint64(armHdr.EntryTimes[i].FastTicksVal)
 		hdr.EntryTimes[i].TimeTs = armHdr.EntryTimes[i].TimeTs
@@ -156,14 +160,13 @@ func (perflog *PerfLogDecoder) DumpRecord(hdr PerfLogHeaderMIPS, ple PerfLogEntr
 	fmt.Fprintln(w)
 }
 
-func (perflog *PerfLogDecoder) Decoder(b binDecode.BinaryHdr, w io.Writer, r io.Reader) error {
+// readHeader
+//
+// Read the perf log header, converting an ARM header to the MIPS layout
+func readHeader(b binDecode.BinaryHdr, r io.Reader) (PerfLogHeaderMIPS, error) {
 
 	var hdr PerfLogHeaderMIPS
-	var byteOrder binary.ByteOrder
-	byteOrder = binary.LittleEndian
-	if b.Endianness != 0 {
-		byteOrder = binary.BigEndian
-	}
+	byteOrder := b.Endianness.ByteOrder()
 
 	var err error
 
@@ -182,15 +185,15 @@ func (perflog *PerfLogDecoder) Decoder(b binDecode.BinaryHdr, w io.Writer, r io.
 		err = binary.Read(r, byteOrder, &tmpHdr)
 		hdr.convertArmHdrToMips(&tmpHdr)
 	}
-	if err == io.EOF {
-		return nil
-	}
-	if err != nil {
-		fmt.Println("Bad perflog header", err)
-		return err
-	}
+	return hdr, err
+}
 
-	fmt.Fprintln(w, "PerfLog:", ByteToString(hdr.Name[:], NAME_LEN), "PauseReason", hdr.PauseReason, "Entries per record", hdr.RecordEntries)
+// readEntries
+//
+// Read the log entries following the header, passing each to fn. Reading stops at the end of the file, or at the
+// first error from fn
+func readEntries(b binDecode.BinaryHdr, r io.Reader, fn func(PerfLogEntry) error) error {
+	byteOrder := b.Endianness.ByteOrder()
 
 	var rec PerfLogEntry
 	count := 0
@@ -204,9 +207,82 @@ func (perflog *PerfLogDecoder) Decoder(b binDecode.BinaryHdr, w io.Writer, r io.
 			return err
 		}
 
-		perflog.DumpRecord(hdr, rec, w)
+		if err = fn(rec); err != nil {
+			return err
+		}
 		count++
 	}
 
 	return nil
 }
+
+func (perflog *PerfLogDecoder) Decoder(b binDecode.BinaryHdr, w io.Writer, r io.Reader) error {
+
+	hdr, err := readHeader(b, r)
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		fmt.Println("Bad perflog header", err)
+		return err
+	}
+
+	fmt.Fprintln(w, "PerfLog:", ByteToString(hdr.Name[:], NAME_LEN), "PauseReason", hdr.PauseReason, "Entries per record", hdr.RecordEntries)
+
+	return readEntries(b, r, func(rec PerfLogEntry) error {
+		perflog.DumpRecord(hdr, rec, w)
+		return nil
+	})
+}
+
+// PerfSample is a sample of a statistic from a perf log
+type PerfSample struct {
+	Statistic   string
+	Description string
+	Time        time.Time
+	Value       uint64
+}
+
+// Fields of the sample, as a record (see binary.Record)
+func (sample PerfSample) Fields() []binDecode.Field {
+	return []binDecode.Field{
+		{Name: "statistic", Value: sample.Statistic},
+		{Name: "description", Value: sample.Description},
+		{Name: "time", Value: sample.Time},
+		{Name: "value", Value: sample.Value},
+	}
+}
+
+// DecodeRecords
+//
+// Decode the samples of each statistic as records, oldest first. Samples without a time are from log entries
+// which haven't been written yet, and are left out
+func (perflog *PerfLogDecoder) DecodeRecords(b binDecode.BinaryHdr, r io.Reader, opts binDecode.DecodeOptions, emit func(binDecode.Record) error) error {
+
+	hdr, err := readHeader(b, r)
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	oldestIndex := int(hdr.NextLogIndex % NUM_LOG_ENTRIES)
+	if oldestIndex < 0 {
+		oldestIndex += NUM_LOG_ENTRIES
+	}
+	return readEntries(b, r, func(rec PerfLogEntry) error {
+		statistic, desc := ByteToString(rec.Name[:], NAME_LEN), ByteToString(rec.Desc[:], NAME_LEN)
+		for entry := 0; entry < NUM_LOG_ENTRIES; entry++ {
+			index := (oldestIndex + entry) % NUM_LOG_ENTRIES
+			if hdr.EntryTimes[index].TimeTs == 0 {
+				continue
+			}
+			sample := PerfSample{statistic, desc, time.Unix(int64(hdr.EntryTimes[index].TimeTs), 0).UTC(), rec.Log[index]}
+			if err := emit(sample); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
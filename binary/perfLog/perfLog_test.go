@@ -0,0 +1,79 @@
+// perfLog_test
+package perflog
+
+import (
+	"bytes"
+	binDecode "decryptDiags/binary"
+	"encoding/binary"
+	"testing"
+)
+
+// Build an ARM perf log payload; the header, with the times of the samples given, and an entry per statistic
+func testPerfLogARM(nextLogIndex int32, times map[int]uint32, statistics ...string) []byte {
+	var payload bytes.Buffer
+	hdr := PerfLogHeaderARM{PauseReason: 3, RecordEntries: 2, NextLogIndex: nextLogIndex}
+	copy(hdr.Name[:], "Stats")
+	for index, t := range times {
+		hdr.EntryTimes[index].TimeTs = t
+	}
+	binary.Write(&payload, binary.LittleEndian, hdr)
+
+	for _, statistic := range statistics {
+		var ple PerfLogEntry
+		copy(ple.Name[:], statistic)
+		copy(ple.Desc[:], statistic+" per second")
+		for index := range ple.Log {
+			ple.Log[index] = uint64(index)
+		}
+		binary.Write(&payload, binary.LittleEndian, ple)
+	}
+	return payload.Bytes()
+}
+
+// ARM headers are converted to the MIPS layout with all their fields, not just the entry times
+func TestConvertArmHeader(t *testing.T) {
+	b := binDecode.BinaryHdr{DiagBinaryType: binDecode.BinaryFile_PerfLog, Architecture: binDecode.BinaryFile_ArchARM}
+	hdr, err := readHeader(b, bytes.NewReader(testPerfLogARM(5, map[int]uint32{5: 1000})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ByteToString(hdr.Name[:], NAME_LEN) != "Stats" || hdr.PauseReason != 3 || hdr.RecordEntries != 2 ||
+		hdr.NextLogIndex != 5 || hdr.EntryTimes[5].TimeTs != 1000 {
+		t.Errorf("Unexpected converted header %q %d %d %d", ByteToString(hdr.Name[:], NAME_LEN), hdr.PauseReason,
+			hdr.RecordEntries, hdr.NextLogIndex)
+	}
+}
+
+// Samples are decoded to records oldest first, leaving out the samples without a time, and written as CSV or JSON lines
+func TestPerfLogRecords(t *testing.T) {
+	var file bytes.Buffer
+	header := binDecode.BinaryHdr{HeaderVersion: binDecode.BinaryFile_HeaderVersion, DiagBinaryType: binDecode.BinaryFile_PerfLog,
+		Architecture: binDecode.BinaryFile_ArchARM}
+	binary.Write(&file, binary.BigEndian, header)
+	file.Write(testPerfLogARM(NUM_LOG_ENTRIES-2, map[int]uint32{NUM_LOG_ENTRIES - 2: 1000, NUM_LOG_ENTRIES - 1: 1001, 0: 1002}, "reads"))
+
+	_, records, err := binDecode.DecodeRecords(bytes.NewReader(file.Bytes()), binDecode.DecodeOptions{})
+	if err != nil || len(records) != 3 {
+		t.Fatalf("Unexpected records %+v %v", records, err)
+	}
+	if sample := records[2].(PerfSample); sample.Statistic != "reads" || sample.Time.Unix() != 1002 || sample.Value != 0 {
+		t.Errorf("Unexpected newest sample %+v", sample)
+	}
+
+	expected := map[string]string{
+		binDecode.FormatCSV: "statistic,description,time,value\n" +
+			"reads,reads per second,1970-01-01T00:16:40Z,898\n" +
+			"reads,reads per second,1970-01-01T00:16:41Z,899\n" +
+			"reads,reads per second,1970-01-01T00:16:42Z,0\n",
+		binDecode.FormatJSONLines: `{"statistic":"reads","description":"reads per second","time":"1970-01-01T00:16:40Z","value":898}` + "\n" +
+			`{"statistic":"reads","description":"reads per second","time":"1970-01-01T00:16:41Z","value":899}` + "\n" +
+			`{"statistic":"reads","description":"reads per second","time":"1970-01-01T00:16:42Z","value":0}` + "\n",
+	}
+	for format, text := range expected {
+		var output bytes.Buffer
+		err := binDecode.DecodeFileWithOptions(bytes.NewReader(file.Bytes()), &output, binDecode.DecodeOptions{Format: format})
+		if err != nil || output.String() != text {
+			t.Errorf("Unexpected %s decode %v\ngot:  %q\nwant: %q", format, err, output.String(), text)
+		}
+	}
+}
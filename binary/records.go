@@ -0,0 +1,253 @@
+// records.go
+//
+// Copyright (c) 2016 Drobo Inc. All rights reserved
+//
+// Decoding binary files to typed records, for scripts and spreadsheets, as well as to text.
+//
+// Decoders which implement RecordDecoder produce a Record per event, zone, perf log sample etc. The records are
+// available to other packages from DecodeRecords, and are written by DecodeFileWithOptions in the format given in
+// the decode options; JSON lines (an object per record) or CSV (a column per field). Other formats can be added
+// with RegisterFormatter. The text format is the decode from the decoder itself, as it has always been
+
+package binary
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Decode formats
+const (
+	FormatText      = "text"
+	FormatJSONLines = "jsonl"
+	FormatCSV       = "csv"
+)
+
+// Field is a named value of a record. Values are numbers, strings, bools, times or lists of strings
+type Field struct {
+	Name  string
+	Value interface{}
+}
+
+// Record is a record decoded from a binary file, e.g. an event. Records of the same kind have the same fields,
+// in the same order
+type Record interface {
+	Fields() []Field
+}
+
+// RecordDecoder is implemented by decoders which can decode a file to records, as well as to text. Each record
+// is passed to emit, and decoding stops at the first error from it
+type RecordDecoder interface {
+	DecodeRecords(b BinaryHdr, r io.Reader, opts DecodeOptions, emit func(Record) error) error
+}
+
+// Formatter writes records in an output format. Close flushes anything buffered, and doesn't close the writer
+type Formatter interface {
+	Format(rec Record) error
+	Close() error
+}
+
+var formatters = map[string]func(io.Writer) Formatter{}
+
+// RegisterFormatter
+//
+// Add an output format for records, by name
+func RegisterFormatter(name string, newFormatter func(io.Writer) Formatter) {
+	formatters[name] = newFormatter
+}
+
+// Formats
+//
+// Names of the decode formats, text first
+func Formats() []string {
+	var names []string
+	for name := range formatters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return append([]string{FormatText}, names...)
+}
+
+// ParseFormat
+//
+// Check a decode format name, ignoring case. An empty name is the text format
+func ParseFormat(name string) (string, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" {
+		return FormatText, nil
+	}
+	for _, format := range Formats() {
+		if format == name {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("unknown decode format %q; expected one of %s", name, strings.Join(Formats(), ", "))
+}
+
+// NoRecordDecoderError
+//
+// The decoder for the type only decodes to text
+type NoRecordDecoderError struct {
+	Type BinaryType
+}
+
+func (e *NoRecordDecoderError) Error() string {
+	return fmt.Sprintf("binary file type %v can only be decoded to text", e.Type)
+}
+
+// ReadRecords
+//
+// Decode a binary file to records, passing each to emit. The header is validated as for a text decode, and
+// returned. A payload which isn't the size given in the header is decoded as far as possible, and the size error
+// is returned
+func ReadRecords(reader io.Reader, opts DecodeOptions, emit func(Record) error) (BinaryHdr, error) {
+	header := make([]byte, HeaderSize)
+	n, err := io.ReadFull(reader, header)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = &TruncatedHeaderError{n}
+	}
+	if err != nil {
+		return BinaryHdr{}, err
+	}
+	binHdr, _ := ReadHeader(bytes.NewReader(header))
+
+	payload, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return binHdr, err
+	}
+
+	err = binHdr.Validate()
+	if err != nil {
+		return binHdr, err
+	}
+
+	decoder, ok := handlers[binHdr.DiagBinaryType].(RecordDecoder)
+	if !ok {
+		return binHdr, &NoRecordDecoderError{binHdr.DiagBinaryType}
+	}
+
+	sizeErr := binHdr.checkImageSize(payload)
+	if sizeErr != nil && len(payload) > int(binHdr.ImageSize) {
+		payload = payload[:binHdr.ImageSize]
+	}
+
+	err = decoder.DecodeRecords(binHdr, bytes.NewReader(payload), opts, emit)
+	if err != nil {
+		return binHdr, err
+	}
+	return binHdr, sizeErr
+}
+
+// DecodeRecords
+//
+// Decode a binary file to records, as ReadRecords. The records decoded before an error are returned with it
+func DecodeRecords(reader io.Reader, opts DecodeOptions) (BinaryHdr, []Record, error) {
+	var records []Record
+	binHdr, err := ReadRecords(reader, opts, func(rec Record) error {
+		records = append(records, rec)
+		return nil
+	})
+	return binHdr, records, err
+}
+
+// decodeFormatted
+//
+// Decode a binary file to records, written in the format given in the options
+func decodeFormatted(reader io.Reader, writer io.Writer, opts DecodeOptions) error {
+	newFormatter, ok := formatters[opts.Format]
+	if !ok {
+		_, err := ParseFormat(opts.Format)
+		return err
+	}
+
+	formatter := newFormatter(writer)
+	_, err := ReadRecords(reader, opts, formatter.Format)
+	if closeErr := formatter.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Register the built in formats
+func init() {
+	RegisterFormatter(FormatJSONLines, func(w io.Writer) Formatter { return &jsonLinesFormatter{w: w} })
+	RegisterFormatter(FormatCSV, func(w io.Writer) Formatter { return &csvFormatter{w: csv.NewWriter(w)} })
+}
+
+// jsonLinesFormatter writes each record as a JSON object on a line, with the fields in order
+type jsonLinesFormatter struct {
+	w io.Writer
+}
+
+func (f *jsonLinesFormatter) Format(rec Record) error {
+	var line bytes.Buffer
+	line.WriteByte('{')
+	for index, field := range rec.Fields() {
+		if index > 0 {
+			line.WriteByte(',')
+		}
+		name, _ := json.Marshal(field.Name)
+		value, err := json.Marshal(field.Value)
+		if err != nil {
+			return err
+		}
+		line.Write(name)
+		line.WriteByte(':')
+		line.Write(value)
+	}
+	line.WriteString("}\n")
+	_, err := f.w.Write(line.Bytes())
+	return err
+}
+
+func (f *jsonLinesFormatter) Close() error {
+	return nil
+}
+
+// csvFormatter writes each record as a CSV row, after a row of the field names. The names are written again if
+// they change, e.g. for a different kind of record
+type csvFormatter struct {
+	w     *csv.Writer
+	names []string
+}
+
+func (f *csvFormatter) Format(rec Record) error {
+	fields := rec.Fields()
+	names := make([]string, len(fields))
+	row := make([]string, len(fields))
+	for index, field := range fields {
+		names[index] = field.Name
+		row[index] = csvValue(field.Value)
+	}
+
+	if strings.Join(names, ",") != strings.Join(f.names, ",") {
+		f.names = names
+		if err := f.w.Write(names); err != nil {
+			return err
+		}
+	}
+	return f.w.Write(row)
+}
+
+func (f *csvFormatter) Close() error {
+	f.w.Flush()
+	return f.w.Error()
+}
+
+// Value of a field in a CSV cell. Times are RFC 3339, as in JSON, and lists are space separated
+func csvValue(value interface{}) string {
+	switch v := value.(type) {
+	case time.Time:
+		return v.Format(time.RFC3339)
+	case []string:
+		return strings.Join(v, " ")
+	}
+	return fmt.Sprint(value)
+}
@@ -0,0 +1,79 @@
+// records_test
+package binary
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testRecord is a record with the fields given
+type testRecord []Field
+
+func (rec testRecord) Fields() []Field {
+	return rec
+}
+
+// Records are written with their fields in order; CSV with a row of names whenever the names change, and JSON lines
+// with an object per record
+func TestFormatters(t *testing.T) {
+	when := time.Date(2016, 3, 1, 12, 30, 0, 0, time.UTC)
+	records := []Record{
+		testRecord{{"time", when}, {"text", `disk "1", removed`}, {"count", 2}},
+		testRecord{{"time", when.Add(time.Second)}, {"text", "line\nbreak"}, {"count", 3}},
+		testRecord{{"zone", 7}, {"flags", []string{"Metadata", "Initializing"}}, {"inUse", true}},
+	}
+
+	expected := map[string]string{
+		FormatCSV: "time,text,count\n" +
+			"2016-03-01T12:30:00Z,\"disk \"\"1\"\", removed\",2\n" +
+			"2016-03-01T12:30:01Z,\"line\nbreak\",3\n" +
+			"zone,flags,inUse\n" +
+			"7,Metadata Initializing,true\n",
+		FormatJSONLines: `{"time":"2016-03-01T12:30:00Z","text":"disk \"1\", removed","count":2}` + "\n" +
+			`{"time":"2016-03-01T12:30:01Z","text":"line\nbreak","count":3}` + "\n" +
+			`{"zone":7,"flags":["Metadata","Initializing"],"inUse":true}` + "\n",
+	}
+	for format, text := range expected {
+		var output bytes.Buffer
+		formatter := formatters[format](&output)
+		for _, rec := range records {
+			if err := formatter.Format(rec); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := formatter.Close(); err != nil || output.String() != text {
+			t.Errorf("Unexpected %s output %v\ngot:  %q\nwant: %q", format, err, output.String(), text)
+		}
+	}
+
+	// A value which can't be written as JSON is an error
+	err := formatters[FormatJSONLines](&bytes.Buffer{}).Format(testRecord{{"bad", make(chan int)}})
+	if err == nil {
+		t.Error("Expected an error writing a channel as JSON")
+	}
+}
+
+// Format names are checked ignoring case, and a decoder which only decodes to text is reported
+func TestDecodeFormats(t *testing.T) {
+	if formats := strings.Join(Formats(), ","); formats != "text,csv,jsonl" {
+		t.Errorf("Unexpected formats %s", formats)
+	}
+	for name, expected := range map[string]string{"": FormatText, " CSV": FormatCSV, "JsonL": FormatJSONLines} {
+		if format, err := ParseFormat(name); err != nil || format != expected {
+			t.Errorf("ParseFormat(%q) = %q %v, expected %q", name, format, err, expected)
+		}
+	}
+	if _, err := ParseFormat("xml"); err == nil {
+		t.Error("Expected an error for the xml format")
+	}
+
+	var output bytes.Buffer
+	err := DecodeFileWithOptions(bytes.NewReader(testBinaryFile(nil, make([]byte, 8))), &output, DecodeOptions{Format: FormatCSV})
+	var noRecords *NoRecordDecoderError
+	if !errors.As(err, &noRecords) || noRecords.Type != testBinaryType {
+		t.Errorf("Expected NoRecordDecoderError, got %v", err)
+	}
+}
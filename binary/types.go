@@ -0,0 +1,191 @@
+// types.go
+//
+// Copyright (c) 2016 Drobo Inc. All rights reserved
+//
+// Typed values of the binary diag file header fields; the binary file type, platform, architecture, endianness
+// and OS. Each has a name (String), and a reverse lookup (Parse...) from the name, ignoring case, or from the
+// number. Values without a name, e.g. a platform from newer firmware, are shown as their number, so every value
+// can be looked up from how it is shown. The pointer types are flag.Values, for tools taking them on the
+// command line (see binary/internal/convert)
+
+package binary
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// BinaryType is the type of data in a binary file
+type BinaryType uint32
+
+const (
+	BinaryFile_FlashEventLog BinaryType = iota
+	BinaryFile_DiskEventLog
+	BinaryFile_CachedEventLog
+	BinaryFile_ZoneTable
+	BinaryFile_PerfLog
+)
+
+var binaryTypeNames = []string{"flasheventlog", "diskeventlog", "cacheeventlog", "zonetable", "perflog"}
+
+// Platform is the Drobo model the file came from
+type Platform uint32
+
+// VxWorks version defined in HostAppManager.h
+const (
+	BinaryFile_PlatformDrobo Platform = iota
+	BinaryFile_PlatformDrobie
+	BinaryFile_PlatformDroboPro
+	BinaryFile_PlatformDrobo3
+	BinaryFile_PlatformDroboNAS
+	BinaryFile_PlatformGort
+	BinaryFile_PlatformVoltron
+	BinaryFile_PlatformB800i
+	BinaryFile_PlatformB800fs
+	BinaryFile_Platform5D
+	BinaryFile_Platform5N
+	BinaryFile_PlatformB810n
+	BinaryFile_PlatformB810i
+	BinaryFile_PlatformBender
+	BinaryFile_PlatformGerty
+)
+
+var platformNames = []string{"Drobo", "Drobie", "DroboPro", "Drobo3", "DroboNAS", "Gort", "Voltron", "B800i", "B800fs",
+	"5D", "5N", "B810n", "B810i", "Bender", "Gerty"}
+
+// Architecture is the processor architecture of the platform
+type Architecture uint32
+
+const (
+	BinaryFile_ArchARM Architecture = iota
+	BinaryFile_ArchMIPS
+)
+
+var architectureNames = []string{"ARM", "MIPS"}
+
+// Endianness is the byte order of the payload
+type Endianness uint32
+
+const (
+	BinaryFile_LittleEndian Endianness = iota
+	BinaryFile_BigEndian
+)
+
+var endiannessNames = []string{"little", "big"}
+
+// OperatingSystem is the OS the file was generated on
+type OperatingSystem uint32
+
+const (
+	BinaryFile_OSVxWorks OperatingSystem = iota
+	BinaryFile_OSLinux
+	BinaryFile_OSMac
+	BinaryFile_OSWindows
+)
+
+var operatingSystemNames = []string{"VxWorks", "Linux", "Mac", "Windows"}
+
+// Name of a value, or its number if it doesn't have one
+func enumName(names []string, value uint32) string {
+	if int64(value) < int64(len(names)) {
+		return names[value]
+	}
+	return strconv.FormatUint(uint64(value), 10)
+}
+
+// parseEnum
+//
+// Look up a value from its name, ignoring case, or from its number (decimal, or hex with 0x)
+func parseEnum(names []string, kind string, name string) (uint32, error) {
+	name = strings.TrimSpace(name)
+	for value, n := range names {
+		if strings.EqualFold(n, name) {
+			return uint32(value), nil
+		}
+	}
+	if value, err := strconv.ParseUint(name, 0, 32); err == nil {
+		return uint32(value), nil
+	}
+	return 0, fmt.Errorf("unknown %s %q; expected one of %s, or a number", kind, name, strings.Join(names, ", "))
+}
+
+func (t BinaryType) String() string { return enumName(binaryTypeNames, uint32(t)) }
+
+// Known is true for the types with a name. A type can be known without having a decoder
+func (t BinaryType) Known() bool { return int(t) < len(binaryTypeNames) }
+
+func ParseBinaryType(name string) (BinaryType, error) {
+	value, err := parseEnum(binaryTypeNames, "binary type", name)
+	return BinaryType(value), err
+}
+
+func (t *BinaryType) Set(name string) (err error) {
+	*t, err = ParseBinaryType(name)
+	return err
+}
+
+func (p Platform) String() string { return enumName(platformNames, uint32(p)) }
+
+func (p Platform) Known() bool { return int(p) < len(platformNames) }
+
+func ParsePlatform(name string) (Platform, error) {
+	value, err := parseEnum(platformNames, "platform", name)
+	return Platform(value), err
+}
+
+func (p *Platform) Set(name string) (err error) {
+	*p, err = ParsePlatform(name)
+	return err
+}
+
+func (a Architecture) String() string { return enumName(architectureNames, uint32(a)) }
+
+func (a Architecture) Known() bool { return int(a) < len(architectureNames) }
+
+func ParseArchitecture(name string) (Architecture, error) {
+	value, err := parseEnum(architectureNames, "architecture", name)
+	return Architecture(value), err
+}
+
+func (a *Architecture) Set(name string) (err error) {
+	*a, err = ParseArchitecture(name)
+	return err
+}
+
+func (e Endianness) String() string { return enumName(endiannessNames, uint32(e)) }
+
+func (e Endianness) Known() bool { return int(e) < len(endiannessNames) }
+
+func ParseEndianness(name string) (Endianness, error) {
+	value, err := parseEnum(endiannessNames, "endianness", name)
+	return Endianness(value), err
+}
+
+func (e *Endianness) Set(name string) (err error) {
+	*e, err = ParseEndianness(name)
+	return err
+}
+
+// ByteOrder to read the payload with
+func (e Endianness) ByteOrder() binary.ByteOrder {
+	if e != BinaryFile_LittleEndian {
+		return binary.BigEndian
+	}
+	return binary.LittleEndian
+}
+
+func (o OperatingSystem) String() string { return enumName(operatingSystemNames, uint32(o)) }
+
+func (o OperatingSystem) Known() bool { return int(o) < len(operatingSystemNames) }
+
+func ParseOperatingSystem(name string) (OperatingSystem, error) {
+	value, err := parseEnum(operatingSystemNames, "OS", name)
+	return OperatingSystem(value), err
+}
+
+func (o *OperatingSystem) Set(name string) (err error) {
+	*o, err = ParseOperatingSystem(name)
+	return err
+}
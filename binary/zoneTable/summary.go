@@ -0,0 +1,155 @@
+// summary.go
+//
+// Copyright (c) 2016 Drobo Inc. All rights reserved
+//
+// Summary of a zone table, shown ahead of the zones in the decode, to judge pack health and protection at a glance:
+//
+// - The zones in use of each redundancy type, with the regions they use (raw capacity) and the regions of data they
+//   hold (protected capacity). Every zone holds REGIONS_PER_ZONE_DEFAULT regions of data, and uses more regions for
+//   the redundancy (see GetRegionCount). The region size isn't in the zone table, so capacity is given in regions
+// - The zones flagged as needing relayout, initializing or transactional
+// - The regions used on each logical disk
+// - The zones in use without any regions allocated
+//
+// Only zones in use are summarized, as only they are shown in the decode
+
+package eventlog
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+const ZoneSummaryBanner = "------------------- ZONE TABLE SUMMARY -------------------"
+
+// Flags counted in the summary
+var summaryFlags = []ZoneFlags{RelayoutNeeded, InitInProgress, Transactional}
+
+// RedundancySummary is the zones of a redundancy type, with their capacity in regions
+type RedundancySummary struct {
+	Zones     int
+	Raw       uint64 // Regions used by the zones
+	Protected uint64 // Regions of data held by the zones
+}
+
+// ZoneSummary is the summary of the zones in use in a zone table
+type ZoneSummary struct {
+	Entries      int // Zone table entries, in use or not
+	Zones        int // Zones in use
+	ByRedundancy map[RedundancyType]*RedundancySummary
+	Flagged      map[ZoneFlags]int // Zones with each of the summaryFlags set
+	DiskRegions  map[LogicalDisk]int
+	NoRegions    []ZoneNumber
+}
+
+func NewZoneSummary() *ZoneSummary {
+	return &ZoneSummary{ByRedundancy: map[RedundancyType]*RedundancySummary{}, Flagged: map[ZoneFlags]int{},
+		DiskRegions: map[LogicalDisk]int{}}
+}
+
+// Add
+//
+// Add a zone table entry to the summary
+func (summary *ZoneSummary) Add(zte ZoneTableEntry) {
+	summary.Entries++
+	if !zte.Flags.InUse() {
+		return
+	}
+	summary.Zones++
+
+	for _, flag := range summaryFlags {
+		if zte.Flags&(1<<flag) == (1 << flag) {
+			summary.Flagged[flag]++
+		}
+	}
+
+	redundancy, ok := summary.ByRedundancy[zte.Redundancy]
+	if !ok {
+		redundancy = &RedundancySummary{}
+		summary.ByRedundancy[zte.Redundancy] = redundancy
+	}
+	redundancy.Zones++
+
+	if !zte.HasRegions() {
+		summary.NoRegions = append(summary.NoRegions, zte.ZoneNum)
+		return
+	}
+
+	regions := zoneTableDecoder.GetRegionCount(zte)
+	redundancy.Raw += uint64(regions)
+	redundancy.Protected += REGIONS_PER_ZONE_DEFAULT
+	for region := uint32(0); region < regions; region++ {
+		summary.DiskRegions[zte.LogicalDisks[region]]++
+	}
+}
+
+// Percentage of the raw capacity which holds data
+func efficiency(protected uint64, raw uint64) string {
+	if raw == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%d%%", protected*100/raw)
+}
+
+// WriteText
+//
+// Write the summary, as the section of the zone table decode
+func (summary *ZoneSummary) WriteText(w io.Writer) {
+	fmt.Fprintln(w, ZoneSummaryBanner)
+	fmt.Fprintf(w, "Zones in use: %d of %d entries\n\n", summary.Zones, summary.Entries)
+
+	// Zones and capacity by redundancy type
+	var types []RedundancyType
+	for t := range summary.ByRedundancy {
+		types = append(types, t)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+
+	fmt.Fprintf(w, "%-18s %8s %12s %12s %10s\n", "Redundancy", "Zones", "Raw", "Protected", "Efficiency")
+	var total RedundancySummary
+	for _, t := range types {
+		s := summary.ByRedundancy[t]
+		fmt.Fprintf(w, "%-18s %8d %12d %12d %10s\n", t, s.Zones, s.Raw, s.Protected, efficiency(s.Protected, s.Raw))
+		total.Zones += s.Zones
+		total.Raw += s.Raw
+		total.Protected += s.Protected
+	}
+	fmt.Fprintf(w, "%-18s %8d %12d %12d %10s\n", "Total", total.Zones, total.Raw, total.Protected,
+		efficiency(total.Protected, total.Raw))
+	fmt.Fprintln(w, "(capacity in regions)")
+	fmt.Fprintln(w)
+
+	for _, flag := range summaryFlags {
+		fmt.Fprintf(w, "Zones flagged %s: %d\n", ZoneFlagsStrings[flag].Name, summary.Flagged[flag])
+	}
+	fmt.Fprintln(w)
+
+	// Regions used on each logical disk
+	var disks []LogicalDisk
+	for disk := range summary.DiskRegions {
+		disks = append(disks, disk)
+	}
+	sort.Slice(disks, func(i, j int) bool { return disks[i] < disks[j] })
+
+	fmt.Fprintln(w, "Regions per logical disk:")
+	for _, disk := range disks {
+		fmt.Fprintf(w, "  Disk %d: %d\n", disk, summary.DiskRegions[disk])
+	}
+	fmt.Fprintln(w)
+
+	fmt.Fprintln(w, "Zones with no regions allocated:", len(summary.NoRegions))
+	for start := 0; start < len(summary.NoRegions); start += 16 {
+		end := start + 16
+		if end > len(summary.NoRegions) {
+			end = len(summary.NoRegions)
+		}
+		zones := make([]string, end-start)
+		for index, zone := range summary.NoRegions[start:end] {
+			zones[index] = fmt.Sprint(zone)
+		}
+		fmt.Fprintln(w, "    ", strings.Join(zones, " "))
+	}
+	fmt.Fprintln(w)
+}
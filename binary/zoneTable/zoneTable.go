@@ -4,6 +4,8 @@
 //
 // Methods for decoding binary zone table files from Drobo diagnostics
 //
+// The decode starts with a summary of the zones in use (see summary.go)
+//
 package eventlog
 
 import (
@@ -112,6 +114,14 @@ var (
 	}
 )
 
+// Name of the redundancy type, or its number if it doesn't have one
+func (t RedundancyType) String() string {
+	if int(t) < len(RedundancyTypeInfo) {
+		return RedundancyTypeInfo[t].name
+	}
+	return fmt.Sprint(uint32(t))
+}
+
 // Endian issue here!
 const (
 	MirrorOnly ZoneFlags = iota
@@ -160,6 +170,19 @@ var (
 	}
 )
 
+// Names of the flags shown for a zone; the flags which are set, or for the flags shown when clear, the flags
+// which aren't
+func (flags ZoneFlags) Names() []string {
+	names := []string{}
+	var bit ZoneFlags = 0
+	for ; bit < UnusedZoneTableFlag; bit++ {
+		if (flags&(1<<bit) == (1 << bit)) == ZoneFlagsStrings[bit].Sense {
+			names = append(names, ZoneFlagsStrings[bit].Name)
+		}
+	}
+	return names
+}
+
 func (flags ZoneFlags) InUse() bool {
 	if flags&(1<<InUse) == (1 << InUse) {
 		return true
@@ -210,20 +233,11 @@ func (zonetable *ZoneTableDecoder) DumpRecord(zte ZoneTableEntry, w io.Writer) {
 		regions := zonetable.GetRegionCount(zte)
 
 		fmt.Fprintf(w, "TableEntry: Zone= %d Redundancy:%s flags= 0x%x", zte.ZoneNum,
-			RedundancyTypeInfo[zte.Redundancy].name, zte.Flags)
+			zte.Redundancy, zte.Flags)
 
 		// Zone flags output
-		var bit ZoneFlags = 0
-		for ; bit < UnusedZoneTableFlag; bit++ {
-			if zte.Flags&(1<<bit) == (1 << bit) {
-				if ZoneFlagsStrings[bit].Sense {
-					fmt.Fprintf(w, " %s", ZoneFlagsStrings[bit].Name)
-				}
-			} else {
-				if !ZoneFlagsStrings[bit].Sense {
-					fmt.Fprintf(w, " %s", ZoneFlagsStrings[bit].Name)
-				}
-			}
+		for _, name := range zte.Flags.Names() {
+			fmt.Fprintf(w, " %s", name)
 		}
 
 		fmt.Fprintf(w, "\n  LastWrittenTimestamp = %d Small IOCount = %d block size = %d", zte.WriteTimestamp,
@@ -244,15 +258,15 @@ func (zonetable *ZoneTableDecoder) DumpRecord(zte ZoneTableEntry, w io.Writer) {
 	}
 }
 
-func (zoneTable *ZoneTableDecoder) Decoder(b binDecode.BinaryHdr, w io.Writer, r io.Reader) error {
+// readZones
+//
+// Read the zone table entries, passing each to fn. Reading stops at the end of the table, or at the first error
+// from fn
+func readZones(b binDecode.BinaryHdr, r io.Reader, fn func(ZoneTableEntry) error) error {
 
 	var zte ZoneTableEntry
 	var zone int = 0
-	var byteOrder binary.ByteOrder
-	byteOrder = binary.LittleEndian
-	if b.Endianness != 0 {
-		byteOrder = binary.BigEndian
-	}
+	byteOrder := b.Endianness.ByteOrder()
 
 	for true {
 		err := binary.Read(r, byteOrder, &zte)
@@ -265,13 +279,69 @@ func (zoneTable *ZoneTableDecoder) Decoder(b binDecode.BinaryHdr, w io.Writer, r
 		}
 
 		// The ZoneFlags don't appear be getting byte swapped, so force it by hand
-		if b.Endianness != 0 {
+		if b.Endianness == binDecode.BinaryFile_BigEndian {
 			zte.Flags.BitFlip()
 		}
 
-		zoneTable.DumpRecord(zte, w)
+		if err = fn(zte); err != nil {
+			return err
+		}
 		zone++
 	}
 
 	return nil
 }
+
+// Decoder
+//
+// Decode the zone table; the summary (see summary.go), followed by the zones in use. The zones before an error
+// reading the table are still shown
+func (zoneTable *ZoneTableDecoder) Decoder(b binDecode.BinaryHdr, w io.Writer, r io.Reader) error {
+	var zones []ZoneTableEntry
+	summary := NewZoneSummary()
+	err := readZones(b, r, func(zte ZoneTableEntry) error {
+		zones = append(zones, zte)
+		summary.Add(zte)
+		return nil
+	})
+
+	summary.WriteText(w)
+	for _, zte := range zones {
+		zoneTable.DumpRecord(zte, w)
+	}
+	return err
+}
+
+// Fields of a zone, as a record (see binary.Record). The regions are disk:region, as in the text decode
+func (zte ZoneTableEntry) Fields() []binDecode.Field {
+	regions := []string{}
+	if zte.HasRegions() {
+		count := zoneTableDecoder.GetRegionCount(zte)
+		for region := uint32(0); region < count; region++ {
+			regions = append(regions, fmt.Sprintf("%d:%d", zte.LogicalDisks[region], zte.Regions[region]))
+		}
+	}
+
+	return []binDecode.Field{
+		{Name: "zone", Value: zte.ZoneNum},
+		{Name: "redundancy", Value: zte.Redundancy.String()},
+		{Name: "flags", Value: uint32(zte.Flags)},
+		{Name: "flagNames", Value: zte.Flags.Names()},
+		{Name: "writeTimestamp", Value: zte.WriteTimestamp},
+		{Name: "ioCount", Value: zte.IoCount},
+		{Name: "blockSize", Value: zte.BlockSize},
+		{Name: "regions", Value: regions},
+	}
+}
+
+// DecodeRecords
+//
+// Decode the zones in use as records, as in the text decode
+func (zoneTable *ZoneTableDecoder) DecodeRecords(b binDecode.BinaryHdr, r io.Reader, opts binDecode.DecodeOptions, emit func(binDecode.Record) error) error {
+	return readZones(b, r, func(zte ZoneTableEntry) error {
+		if !zte.Flags.InUse() {
+			return nil
+		}
+		return emit(zte)
+	})
+}
@@ -0,0 +1,110 @@
+// zoneTable_test
+package eventlog
+
+import (
+	"bytes"
+	binDecode "decryptDiags/binary"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// A zone in use, with its regions spread across the logical disks given
+func testZone(zone ZoneNumber, redundancy RedundancyType, flags ZoneFlags, disks ...LogicalDisk) ZoneTableEntry {
+	zte := ZoneTableEntry{ZoneNum: zone, Redundancy: redundancy, Flags: flags | 1<<InUse}
+	if len(disks) > 0 {
+		for region := uint32(0); region < zoneTableDecoder.GetRegionCount(zte); region++ {
+			zte.LogicalDisks[region] = disks[int(region)%len(disks)]
+			zte.Regions[region] = RegionNumber(region + 1)
+		}
+	}
+	return zte
+}
+
+// The summary counts the zones in use by redundancy type and flag, with their capacity and the regions on each disk
+func TestZoneSummary(t *testing.T) {
+	zones := []ZoneTableEntry{
+		testZone(1, Mirrored, 0, 0, 1),
+		testZone(2, HStripe5, 1<<RelayoutNeeded|1<<Transactional, 0, 1, 2, 3, 4),
+		testZone(3, HStripe5, 1<<InitInProgress),
+		{ZoneNum: 4, Redundancy: Mirrored},
+	}
+
+	var payload bytes.Buffer
+	summary := NewZoneSummary()
+	for _, zte := range zones {
+		summary.Add(zte)
+		binary.Write(&payload, binary.LittleEndian, zte)
+	}
+
+	mirrored, striped := summary.ByRedundancy[Mirrored], summary.ByRedundancy[HStripe5]
+	if summary.Entries != 4 || summary.Zones != 3 || *mirrored != (RedundancySummary{1, 48, 24}) ||
+		*striped != (RedundancySummary{2, 30, 24}) {
+		t.Errorf("Unexpected summary %+v %+v %+v", summary, mirrored, striped)
+	}
+	if summary.Flagged[RelayoutNeeded] != 1 || summary.Flagged[Transactional] != 1 || summary.Flagged[InitInProgress] != 1 {
+		t.Errorf("Unexpected flag counts %v", summary.Flagged)
+	}
+	if summary.DiskRegions[0] != 24+6 || summary.DiskRegions[4] != 6 || len(summary.NoRegions) != 1 || summary.NoRegions[0] != 3 {
+		t.Errorf("Unexpected regions %v, zones without regions %v", summary.DiskRegions, summary.NoRegions)
+	}
+
+	// The summary comes before the zones in the decode
+	var output bytes.Buffer
+	err := zoneTableDecoder.Decoder(binDecode.BinaryHdr{}, &output, &payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decode := output.String()
+	for _, expected := range []string{"Zones in use: 3 of 4 entries", "Mirrored", "50%", "80%", "Zones flagged RelayoutNeeded: 1",
+		"  Disk 4: 6", "Zones with no regions allocated: 1"} {
+		if !strings.Contains(decode, expected) {
+			t.Errorf("Summary doesn't include %q\n%s", expected, decode)
+		}
+	}
+	if strings.Index(decode, ZoneSummaryBanner) > strings.Index(decode, "TableEntry:") {
+		t.Errorf("Summary isn't before the zones\n%s", decode)
+	}
+}
+
+// The zones in use are decoded to records, with their flags and regions, and written as CSV or JSON lines
+func TestZoneRecords(t *testing.T) {
+	var file bytes.Buffer
+	header := binDecode.BinaryHdr{HeaderVersion: binDecode.BinaryFile_HeaderVersion, DiagBinaryType: binDecode.BinaryFile_ZoneTable}
+	binary.Write(&file, binary.BigEndian, header)
+	for _, zte := range []ZoneTableEntry{testZone(1, Mirrored, 0, 0, 1), {ZoneNum: 2, Redundancy: Mirrored},
+		testZone(3, HStripe5, 1<<InitInProgress|1<<InitComplete)} {
+		binary.Write(&file, binary.LittleEndian, zte)
+	}
+
+	_, records, err := binDecode.DecodeRecords(bytes.NewReader(file.Bytes()), binDecode.DecodeOptions{})
+	if err != nil || len(records) != 2 {
+		t.Fatalf("Unexpected records %+v %v", records, err)
+	}
+	fields := records[0].Fields()
+	if regions := fields[len(fields)-1].Value.([]string); len(regions) != 48 || regions[0] != "0:1" || regions[1] != "1:2" {
+		t.Errorf("Unexpected regions %v", regions)
+	}
+
+	decode := func(format string) string {
+		var output bytes.Buffer
+		err := binDecode.DecodeFileWithOptions(bytes.NewReader(file.Bytes()), &output, binDecode.DecodeOptions{Format: format})
+		if err != nil {
+			t.Errorf("Decode to %s failed: %v", format, err)
+		}
+		return output.String()
+	}
+
+	lines := strings.Split(decode(binDecode.FormatCSV), "\n")
+	if len(lines) != 4 || lines[0] != "zone,redundancy,flags,flagNames,writeTimestamp,ioCount,blockSize,regions" ||
+		!strings.HasPrefix(lines[1], "1,Mirrored,4,InitializationIncomplete,0,0,0,0:1 1:2 0:3 ") ||
+		lines[2] != "3,HStripe5,52,Initializing,0,0,0," {
+		t.Errorf("Unexpected CSV decode\n%s", strings.Join(lines, "\n"))
+	}
+
+	lines = strings.Split(decode(binDecode.FormatJSONLines), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], `{"zone":1,"redundancy":"Mirrored","flags":4,"flagNames":["InitializationIncomplete"],`) ||
+		lines[1] != `{"zone":3,"redundancy":"HStripe5","flags":52,"flagNames":["Initializing"],"writeTimestamp":0,"ioCount":0,"blockSize":0,"regions":[]}` {
+		t.Errorf("Unexpected JSON lines decode\n%s", strings.Join(lines, "\n"))
+	}
+}
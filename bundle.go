@@ -0,0 +1,810 @@
+// bundle.go
+//
+// Copyright (c) 2016 Drobo Inc. All rights reserved
+//
+// A diags bundle is a collection of diag files. Dashboard uploads diags as a zip file, but some of our collection
+// scripts and field tools generate tar or tar.gz files, or leave a directory of extracted diag files.
+//
+// A Bundle gives the same view of each of these; a list of members which can be opened (in parallel) and read.
+// A BundleWriter generates a bundle in any of the formats, so diags can be decrypted to the same format as they
+// were supplied in, or converted to another format.
+//
+// tar files can only be read sequentially, so their members are extracted to a temporary directory when the
+// bundle is opened; the directory is removed when the bundle is closed
+//
+// Bundles can contain other archives (zip, tar, tar.gz, or a single gzip compressed file), such as per-app or
+// Dashboard log zips. These are expanded when the bundle is opened, so the files within them are processed like
+// any other file; they are named under a directory named after the archive, e.g. DashboardLogs.zip.d/system.log.
+// The archive itself is kept alongside its files, so decrypted bundles still contain the original archive
+//
+// Expanding archives means copying them to temporary files, so the web server, which opens a bundle for every
+// page, shares bundles between requests (see openSharedBundle)
+
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BundleFormat
+//
+// The format of a diags bundle
+type BundleFormat int
+
+const (
+	FormatZip   BundleFormat = iota
+	FormatTar                // Uncompressed tar
+	FormatTarGz              // gzip compressed tar
+	FormatDir                // A directory of files
+	FormatGz                 // A single gzip compressed file; only read, when found within another bundle
+)
+
+var bundleFormatNames = []string{"zip", "tar", "tar.gz", "dir", "gz"}
+
+func (format BundleFormat) String() string {
+	if format < 0 || int(format) >= len(bundleFormatNames) {
+		return fmt.Sprintf("BundleFormat(%d)", int(format))
+	}
+	return bundleFormatNames[format]
+}
+
+// Suffix of a bundle filename in this format
+func (format BundleFormat) Suffix() string {
+	switch format {
+	case FormatZip:
+		return ".zip"
+	case FormatTar:
+		return ".tar"
+	case FormatTarGz:
+		return ".tar.gz"
+	case FormatGz:
+		return ".gz"
+	}
+	return ""
+}
+
+// The format a bundle is decrypted to by default; the same format, unless it can't be written
+func (format BundleFormat) outputFormat() BundleFormat {
+	if format == FormatGz {
+		return FormatZip
+	}
+	return format
+}
+
+// parseBundleFormat
+//
+// Convert a format name (as used on the command line) to a BundleFormat
+func parseBundleFormat(name string) (BundleFormat, error) {
+	switch strings.ToLower(strings.TrimPrefix(name, ".")) {
+	case "zip":
+		return FormatZip, nil
+	case "tar":
+		return FormatTar, nil
+	case "tar.gz", "tgz":
+		return FormatTarGz, nil
+	case "dir", "directory":
+		return FormatDir, nil
+	}
+	return 0, fmt.Errorf("unknown bundle format %q; use zip, tar, tar.gz or dir", name)
+}
+
+// Known bundle filename suffixes; longest first so .tar.gz is found before .gz
+var bundleSuffixes = []struct {
+	suffix string
+	format BundleFormat
+}{
+	{".tar.gz", FormatTarGz},
+	{".tgz", FormatTarGz},
+	{".tar", FormatTar},
+	{".zip", FormatZip},
+}
+
+// Return the format implied by a filename suffix, and the filename without the suffix
+func bundleSuffix(filename string) (BundleFormat, string, bool) {
+	for _, known := range bundleSuffixes {
+		if strings.HasSuffix(strings.ToLower(filename), known.suffix) {
+			return known.format, filename[:len(filename)-len(known.suffix)], true
+		}
+	}
+	return 0, filename, false
+}
+
+// isBundleFilename
+//
+// Return true if the filename looks like a bundle (zip, tar or tar.gz)
+func isBundleFilename(filename string) bool {
+	_, _, ok := bundleSuffix(filename)
+	return ok
+}
+
+// decryptedBundleName
+//
+// Return the name of the decrypted version of a bundle; a _d suffix is added to the name, and the suffix for the
+// format is added, e.g. diags.tar.gz -> diags_d.zip
+func decryptedBundleName(filename string, format BundleFormat) string {
+	_, base, _ := bundleSuffix(strings.TrimRight(filename, `/\`))
+	return base + "_d" + format.Suffix()
+}
+
+// detectBundleFormat
+//
+// Work out the format of a bundle. Files are recognized from their content rather than their name, as uploaded
+// files are stored under temporary names
+func detectBundleFormat(filename string) (BundleFormat, error) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return 0, err
+	}
+	if info.IsDir() {
+		return FormatDir, nil
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(file, head)
+	head = head[:n]
+
+	switch {
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")), bytes.HasPrefix(head, []byte("PK\x05\x06")):
+		return FormatZip, nil
+	case bytes.HasPrefix(head, []byte{0x1f, 0x8b}):
+		if isGzippedTar(file) {
+			return FormatTarGz, nil
+		}
+		return FormatGz, nil
+	case len(head) >= 262 && string(head[257:262]) == "ustar":
+		return FormatTar, nil
+	}
+
+	// Fall back to the filename
+	if format, _, ok := bundleSuffix(filename); ok {
+		return format, nil
+	}
+	return 0, fmt.Errorf("%s: not a zip, tar or tar.gz file, or a directory", filename)
+}
+
+// Return true if the gzip file contains a tar file
+func isGzippedTar(file *os.File) bool {
+	_, err := file.Seek(0, io.SeekStart)
+	if err != nil {
+		return false
+	}
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return false
+	}
+	defer gz.Close()
+
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(gz, head)
+	return n >= 262 && string(head[257:262]) == "ustar"
+}
+
+// BundleMember
+//
+// A file within a bundle
+type BundleMember interface {
+	Name() string // Path within the bundle, using / as a separator
+	Size() int64
+	Modified() time.Time
+	Open() (io.ReadCloser, error)
+}
+
+// Bundle
+//
+// A bundle opened for reading
+type Bundle interface {
+	Format() BundleFormat
+	Members() []BundleMember
+	Close() error
+}
+
+// openBundle
+//
+// Open a zip, tar or tar.gz file, or a directory, as a bundle. Any archives within the bundle are expanded
+func openBundle(filename string) (Bundle, error) {
+	bundle, err := openBundleNamed(filename, filepath.Base(filename))
+	if err != nil {
+		return nil, err
+	}
+	return expandBundle(bundle, 1)
+}
+
+// Open a bundle, without expanding any archives within it. name is used to name the file within a gz file
+func openBundleNamed(filename string, name string) (Bundle, error) {
+	format, err := detectBundleFormat(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	switch format {
+	case FormatZip:
+		return openZipBundle(filename)
+	case FormatDir:
+		return openDirBundle(filename)
+	case FormatGz:
+		return openGzBundle(filename, name)
+	}
+	return openTarBundle(filename, format)
+}
+
+// Zip bundles
+
+type zipBundle struct {
+	r       *zip.ReadCloser
+	members []BundleMember
+}
+
+type zipMember struct {
+	f *zip.File
+}
+
+func (m zipMember) Name() string                 { return m.f.Name }
+func (m zipMember) Size() int64                  { return int64(m.f.UncompressedSize64) }
+func (m zipMember) Modified() time.Time          { return m.f.Modified }
+func (m zipMember) Open() (io.ReadCloser, error) { return m.f.Open() }
+
+func openZipBundle(filename string) (*zipBundle, error) {
+	r, err := zip.OpenReader(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	bundle := &zipBundle{r: r}
+	for _, f := range r.File {
+		if strings.HasSuffix(f.Name, "/") {
+			continue // Directory entry
+		}
+		bundle.members = append(bundle.members, zipMember{f})
+	}
+	return bundle, nil
+}
+
+func (b *zipBundle) Format() BundleFormat    { return FormatZip }
+func (b *zipBundle) Members() []BundleMember { return b.members }
+func (b *zipBundle) Close() error            { return b.r.Close() }
+
+// Directory bundles; tar bundles are extracted into a temporary directory, so also use fileMember
+
+type fileMember struct {
+	name     string
+	path     string
+	size     int64
+	modified time.Time
+}
+
+func (m fileMember) Name() string                 { return m.name }
+func (m fileMember) Size() int64                  { return m.size }
+func (m fileMember) Modified() time.Time          { return m.modified }
+func (m fileMember) Open() (io.ReadCloser, error) { return os.Open(m.path) }
+
+type dirBundle struct {
+	format  BundleFormat
+	members []BundleMember
+	tmpDir  string // Temporary directory holding extracted tar members
+}
+
+func (b *dirBundle) Format() BundleFormat    { return b.format }
+func (b *dirBundle) Members() []BundleMember { return b.members }
+
+func (b *dirBundle) Close() error {
+	if b.tmpDir != "" {
+		return os.RemoveAll(b.tmpDir)
+	}
+	return nil
+}
+
+func openDirBundle(dirname string) (*dirBundle, error) {
+	bundle := &dirBundle{format: FormatDir}
+
+	err := filepath.Walk(dirname, func(filename string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		name, err := filepath.Rel(dirname, filename)
+		if err != nil {
+			return err
+		}
+		bundle.members = append(bundle.members, fileMember{filepath.ToSlash(name), filename, info.Size(), info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return bundle, nil
+}
+
+// Tar bundles
+
+func openTarBundle(filename string, format BundleFormat) (*dirBundle, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var reader io.Reader = file
+	if format == FormatTarGz {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		reader = gz
+	}
+
+	tmpDir, err := ioutil.TempDir("", "decryptDiags")
+	if err != nil {
+		return nil, err
+	}
+	bundle := &dirBundle{format: format, tmpDir: tmpDir}
+
+	// Members are extracted under their index, so odd names in the tar (such as ../) can't escape the directory
+	archive := tar.NewReader(reader)
+	for index := 0; ; index++ {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			bundle.Close()
+			return nil, err
+		}
+		if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeRegA {
+			continue
+		}
+
+		extracted := filepath.Join(tmpDir, strconv.Itoa(index))
+		err = extractFile(extracted, archive)
+		if err != nil {
+			bundle.Close()
+			return nil, err
+		}
+
+		name := strings.TrimPrefix(path.Clean("/"+header.Name), "/")
+		bundle.members = append(bundle.members, fileMember{name, extracted, header.Size, header.ModTime})
+	}
+	return bundle, nil
+}
+
+// gzip files; the single compressed file is extracted into a temporary directory
+
+func openGzBundle(filename string, name string) (*dirBundle, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	tmpDir, err := ioutil.TempDir("", "decryptDiags")
+	if err != nil {
+		return nil, err
+	}
+	bundle := &dirBundle{format: FormatGz, tmpDir: tmpDir}
+
+	extracted := filepath.Join(tmpDir, "0")
+	err = extractFile(extracted, gz)
+	if err != nil {
+		bundle.Close()
+		return nil, err
+	}
+	info, err := os.Stat(extracted)
+	if err != nil {
+		bundle.Close()
+		return nil, err
+	}
+
+	// Use the name stored in the gzip header, or the name of the gz file without the .gz
+	memberName := path.Base(filepath.ToSlash(gz.Name))
+	if gz.Name == "" {
+		memberName = strings.TrimSuffix(name, path.Ext(name))
+	}
+	modified := gz.ModTime
+	if modified.IsZero() {
+		modified = info.ModTime()
+	}
+
+	bundle.members = append(bundle.members, fileMember{memberName, extracted, info.Size(), modified})
+	return bundle, nil
+}
+
+// Nested bundles
+
+// Maximum depth of archives within archives which are expanded
+const maxBundleNesting = 4
+
+// nestedBundle is a bundle with the archives within it expanded
+type nestedBundle struct {
+	Bundle
+	members  []BundleMember
+	nested   []Bundle
+	tmpFiles []string
+}
+
+func (b *nestedBundle) Members() []BundleMember { return b.members }
+
+func (b *nestedBundle) Close() error {
+	for _, nested := range b.nested {
+		nested.Close()
+	}
+	for _, tmp := range b.tmpFiles {
+		os.Remove(tmp)
+	}
+	return b.Bundle.Close()
+}
+
+// Suffix of the directory the files within an archive are named under. The names mustn't clash with the archive,
+// which is kept alongside its files, so bundles can be written as directories or extracted
+const nestedDirSuffix = ".d"
+
+// nestedMember is a file within an archive within a bundle, named with the path of the archive
+type nestedMember struct {
+	BundleMember
+	prefix string
+}
+
+func (m nestedMember) Name() string { return m.prefix + m.BundleMember.Name() }
+
+// Return true if a bundle member might be an archive that should be expanded
+func isNestedBundleName(name string) bool {
+	return isBundleFilename(name) || strings.HasSuffix(strings.ToLower(name), ".gz")
+}
+
+// Prefix of the names of the files within an archive in a bundle
+func nestedPrefix(name string) string {
+	return name + nestedDirSuffix + "/"
+}
+
+// Return true if the files within an archive are already in the bundle
+func expandedIn(bundle Bundle, name string) bool {
+	prefix := nestedPrefix(name)
+	for _, member := range bundle.Members() {
+		if strings.HasPrefix(member.Name(), prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// expandBundle
+//
+// Expand any archives within a bundle, recursively, up to maxBundleNesting deep. Each archive is kept, followed by
+// its files. Members which look like archives but can't be read as one are left as they are, as are archives
+// whose files are already in the bundle, e.g. in a decrypted bundle
+func expandBundle(bundle Bundle, depth int) (Bundle, error) {
+	expanded := &nestedBundle{Bundle: bundle}
+
+	for _, member := range bundle.Members() {
+		expanded.members = append(expanded.members, member)
+		if depth >= maxBundleNesting || !isNestedBundleName(member.Name()) || expandedIn(bundle, member.Name()) {
+			continue
+		}
+
+		inner, tmp, err := openNestedBundle(member)
+		if tmp != "" {
+			expanded.tmpFiles = append(expanded.tmpFiles, tmp)
+		}
+		if err != nil {
+			log.Println("Not expanding", member.Name(), err)
+			continue
+		}
+
+		inner, _ = expandBundle(inner, depth+1)
+		expanded.nested = append(expanded.nested, inner)
+		for _, innerMember := range inner.Members() {
+			expanded.members = append(expanded.members, nestedMember{innerMember, nestedPrefix(member.Name())})
+		}
+	}
+	return expanded, nil
+}
+
+// Open an archive within a bundle; it's copied to a temporary file so it can be opened like any other bundle
+func openNestedBundle(member BundleMember) (Bundle, string, error) {
+	reader, err := member.Open()
+	if err != nil {
+		return nil, "", err
+	}
+	defer reader.Close()
+
+	tmp, err := ioutil.TempFile("", "decryptDiags")
+	if err != nil {
+		return nil, "", err
+	}
+	_, err = io.Copy(tmp, reader)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, tmp.Name(), err
+	}
+
+	bundle, err := openBundleNamed(tmp.Name(), path.Base(member.Name()))
+	return bundle, tmp.Name(), err
+}
+
+// Shared bundles
+
+// Number of bundles kept open by openSharedBundle
+const sharedBundleCacheSize = 8
+
+// sharedBundleEntry is a bundle kept open between web requests
+type sharedBundleEntry struct {
+	bundle   Bundle
+	modified time.Time // Of the bundle file when it was opened
+	size     int64
+	refs     int  // Open sharedBundles
+	lastUsed int  // Order of use, for evicting the least recently used bundle
+	evicted  bool // Closed once the last sharedBundle is closed
+}
+
+var sharedBundles = struct {
+	sync.Mutex
+	entries map[string]*sharedBundleEntry
+	uses    int
+}{entries: map[string]*sharedBundleEntry{}}
+
+// sharedBundle is a use of a shared bundle; closing it releases the bundle rather than closing it
+type sharedBundle struct {
+	Bundle
+	entry  *sharedBundleEntry
+	closed bool
+}
+
+func (b *sharedBundle) Close() error {
+	sharedBundles.Lock()
+	defer sharedBundles.Unlock()
+
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	b.entry.refs--
+	return b.entry.closeIfUnused()
+}
+
+// Close an evicted bundle once nothing is using it
+func (entry *sharedBundleEntry) closeIfUnused() error {
+	if entry.evicted && entry.refs == 0 {
+		return entry.bundle.Close()
+	}
+	return nil
+}
+
+// Evict a bundle from the cache; it is closed once nothing is using it
+func evictSharedBundle(key string) {
+	entry := sharedBundles.entries[key]
+	delete(sharedBundles.entries, key)
+	entry.evicted = true
+	entry.closeIfUnused()
+}
+
+// openSharedBundle
+//
+// Open a bundle as openBundle, sharing it with any other use of the same file, so the archives within it are only
+// expanded once rather than for every web request. The bundle is opened again if the file has changed (its
+// modification time or size), and the least recently used bundles are closed once more than sharedBundleCacheSize
+// are open. Directories are always opened afresh, as their files can change without the directory changing
+func openSharedBundle(filename string) (Bundle, error) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return openBundle(filename)
+	}
+	key, err := filepath.Abs(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	sharedBundles.Lock()
+	defer sharedBundles.Unlock()
+
+	entry, ok := sharedBundles.entries[key]
+	if ok && (!entry.modified.Equal(info.ModTime()) || entry.size != info.Size()) {
+		evictSharedBundle(key)
+		ok = false
+	}
+	if !ok {
+		bundle, err := openBundle(filename)
+		if err != nil {
+			return nil, err
+		}
+		entry = &sharedBundleEntry{bundle: bundle, modified: info.ModTime(), size: info.Size()}
+		sharedBundles.entries[key] = entry
+
+		for len(sharedBundles.entries) > sharedBundleCacheSize {
+			oldest := ""
+			for k, e := range sharedBundles.entries {
+				if e != entry && (oldest == "" || e.lastUsed < sharedBundles.entries[oldest].lastUsed) {
+					oldest = k
+				}
+			}
+			evictSharedBundle(oldest)
+		}
+	}
+
+	sharedBundles.uses++
+	entry.lastUsed = sharedBundles.uses
+	entry.refs++
+	return &sharedBundle{Bundle: entry.bundle, entry: entry}, nil
+}
+
+// Write the contents of a reader to a new file
+func extractFile(filename string, reader io.Reader) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(file, reader)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// BundleWriter
+//
+// A bundle being generated
+type BundleWriter interface {
+	// Add a file to the bundle, reading size bytes of content from the reader
+	Add(name string, modified time.Time, size int64, reader io.Reader) error
+	Close() error
+}
+
+// createBundle
+//
+// Create a new bundle in the given format
+func createBundle(filename string, format BundleFormat) (BundleWriter, error) {
+	if format == FormatGz {
+		return nil, fmt.Errorf("%s: bundles can't be written as a single gz file", filename)
+	}
+	if format == FormatDir {
+		err := os.MkdirAll(filename, 0777)
+		if err != nil {
+			return nil, err
+		}
+		return &dirBundleWriter{filename}, nil
+	}
+
+	file, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	switch format {
+	case FormatZip:
+		return &zipBundleWriter{file, zip.NewWriter(file)}, nil
+	case FormatTarGz:
+		gz := gzip.NewWriter(file)
+		return &tarBundleWriter{file, gz, tar.NewWriter(gz)}, nil
+	}
+	return &tarBundleWriter{file, nil, tar.NewWriter(file)}, nil
+}
+
+type zipBundleWriter struct {
+	file    *os.File
+	archive *zip.Writer
+}
+
+func (w *zipBundleWriter) Add(name string, modified time.Time, size int64, reader io.Reader) error {
+	header := zip.FileHeader{Name: name, Method: zip.Deflate, Modified: modified}
+	writer, err := w.archive.CreateHeader(&header)
+	if err != nil {
+		return fmt.Errorf("creating archive header %s: %v", name, err)
+	}
+	_, err = io.Copy(writer, reader)
+	return err
+}
+
+// Copy a member of a zip bundle without decompressing and recompressing it, preserving its CRC and timestamps.
+// Returns false if the member isn't from a zip, and needs to be added with Add
+func (w *zipBundleWriter) copyRaw(member BundleMember) (bool, error) {
+	m, ok := member.(zipMember)
+	if !ok {
+		return false, nil
+	}
+	err := w.archive.Copy(m.f)
+	if err != nil {
+		return true, fmt.Errorf("copying %s: %v", m.f.Name, err)
+	}
+	return true, nil
+}
+
+func (w *zipBundleWriter) Close() error {
+	err := w.archive.Close()
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+type tarBundleWriter struct {
+	file    *os.File
+	gz      *gzip.Writer // nil for an uncompressed tar
+	archive *tar.Writer
+}
+
+func (w *tarBundleWriter) Add(name string, modified time.Time, size int64, reader io.Reader) error {
+	header := tar.Header{Name: name, Mode: 0644, Size: size, ModTime: modified, Typeflag: tar.TypeReg}
+	err := w.archive.WriteHeader(&header)
+	if err != nil {
+		return fmt.Errorf("creating archive header %s: %v", name, err)
+	}
+	_, err = io.CopyN(w.archive, reader, size)
+	return err
+}
+
+func (w *tarBundleWriter) Close() error {
+	err := w.archive.Close()
+	if w.gz != nil {
+		if gzErr := w.gz.Close(); err == nil {
+			err = gzErr
+		}
+	}
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+type dirBundleWriter struct {
+	root string
+}
+
+func (w *dirBundleWriter) Add(name string, modified time.Time, size int64, reader io.Reader) error {
+	// Don't allow members to be written outside the directory
+	clean := path.Clean("/" + name)
+	if clean == "/" {
+		return fmt.Errorf("invalid bundle member name %q", name)
+	}
+	filename := filepath.Join(w.root, filepath.FromSlash(clean))
+
+	err := os.MkdirAll(filepath.Dir(filename), 0777)
+	if err != nil {
+		return err
+	}
+
+	err = extractFile(filename, io.LimitReader(reader, size))
+	if err != nil {
+		return err
+	}
+	if !modified.IsZero() {
+		os.Chtimes(filename, modified, modified)
+	}
+	return nil
+}
+
+func (w *dirBundleWriter) Close() error {
+	return nil
+}
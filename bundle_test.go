@@ -0,0 +1,225 @@
+// bundle_test
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Read all the members of a bundle into a map of name to contents
+func readBundle(t *testing.T, filename string) map[string]string {
+	bundle, err := openBundle(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bundle.Close()
+
+	contents := map[string]string{}
+	for _, member := range bundle.Members() {
+		reader, err := member.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int64(len(data)) != member.Size() {
+			t.Errorf("%s: %s is %d bytes, but has size %d", filename, member.Name(), len(data), member.Size())
+		}
+		contents[member.Name()] = string(data)
+	}
+	return contents
+}
+
+// Diags can be decrypted from and to each of the bundle formats
+func TestBundleFormats(t *testing.T) {
+	var encrypted bytes.Buffer
+	err := encryptFile(strings.NewReader(testPlaintext), &encrypted)
+	if err != nil {
+		t.Fatal("encryptFile failed", err)
+	}
+
+	files := map[string]string{
+		"vxLockedDiags.txt":    encrypted.String(),
+		"Dashboard/system.log": "system log\n",
+	}
+	decrypted := decryptedString + versionString + "\n" + testPlaintext
+
+	dir := t.TempDir()
+
+	// Create the original diags in each format
+	originals := map[BundleFormat]string{}
+	for _, format := range []BundleFormat{FormatZip, FormatTar, FormatTarGz, FormatDir} {
+		filename := filepath.Join(dir, "diags_"+format.String()+format.Suffix())
+		archive, err := createBundle(filename, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{"vxLockedDiags.txt", "Dashboard/system.log"} {
+			err = archive.Add(name, time.Now(), int64(len(files[name])), strings.NewReader(files[name]))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = archive.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		detected, err := detectBundleFormat(filename)
+		if err != nil || detected != format {
+			t.Errorf("%s detected as %v %v", filename, detected, err)
+		}
+		originals[format] = filename
+	}
+
+	for inFormat, original := range originals {
+		if contents := readBundle(t, original); len(contents) != 2 || contents["Dashboard/system.log"] != files["Dashboard/system.log"] {
+			t.Errorf("%s: unexpected contents %q", original, contents)
+		}
+
+		for _, outFormat := range []BundleFormat{FormatZip, FormatTar, FormatTarGz, FormatDir} {
+			decryptFilename := decryptedBundleName(filepath.Join(dir, inFormat.String()+"_to"+outFormat.Suffix()), outFormat)
+			decryptZip(original, decryptFilename, outFormat, DecryptOptions{})
+
+			contents := readBundle(t, decryptFilename)
+			if contents["vxLockedDiags.txt"] != decrypted || contents["Dashboard/system.log"] != files["Dashboard/system.log"] {
+				t.Errorf("%v to %v: unexpected contents %q", inFormat, outFormat, contents)
+			}
+			if _, ok := contents[manifestFilename]; !ok {
+				t.Errorf("%v to %v: no manifest", inFormat, outFormat)
+			}
+
+			decrypted, err := bundleIsDecrypted(decryptFilename)
+			if err != nil || !decrypted {
+				t.Errorf("%v to %v: decrypted bundle not recognized %v", inFormat, outFormat, err)
+			}
+		}
+	}
+
+	if name := decryptedBundleName("diags.tar.gz", FormatZip); name != "diags_d.zip" {
+		t.Error("Unexpected decrypted bundle name", name)
+	}
+	if name := decryptedBundleName("diags"+string(os.PathSeparator), FormatDir); name != "diags_d" {
+		t.Error("Unexpected decrypted bundle name", name)
+	}
+}
+
+// Archives within a bundle are expanded and processed like any other file
+func TestNestedBundles(t *testing.T) {
+	var encrypted bytes.Buffer
+	err := encryptFile(strings.NewReader(testPlaintext), &encrypted)
+	if err != nil {
+		t.Fatal("encryptFile failed", err)
+	}
+	decrypted := decryptedString + versionString + "\n" + testPlaintext
+
+	dir := t.TempDir()
+
+	// Innermost tar.gz holding an encrypted file
+	innerTar := filepath.Join(dir, "inner.tar.gz")
+	archive, err := createBundle(innerTar, FormatTarGz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive.Add("vxLiveLog.txt", time.Now(), int64(encrypted.Len()), bytes.NewReader(encrypted.Bytes()))
+	archive.Close()
+	innerTarData, _ := ioutil.ReadFile(innerTar)
+
+	// A single gzip compressed log
+	var gzLog bytes.Buffer
+	gz := gzip.NewWriter(&gzLog)
+	gz.Write([]byte("nasd log\n"))
+	gz.Close()
+
+	// A zip holding the tar.gz, within the outer zip
+	innerZip := filepath.Join(dir, "DashboardLogs.zip")
+	writeTestZip(t, innerZip, map[string][]byte{"logs.tar.gz": innerTarData, "system.log": []byte("system log\n")},
+		[]string{"system.log", "logs.tar.gz"})
+	innerZipData, _ := ioutil.ReadFile(innerZip)
+
+	outer := filepath.Join(dir, "diags.zip")
+	writeTestZip(t, outer, map[string][]byte{
+		"vxLockedDiags.txt": encrypted.Bytes(),
+		"DashboardLogs.zip": innerZipData,
+		"nasd.log.gz":       gzLog.Bytes(),
+		"broken.zip":        []byte("not really a zip"),
+	}, []string{"vxLockedDiags.txt", "DashboardLogs.zip", "nasd.log.gz", "broken.zip"})
+
+	filelist, err := decryptZipFilelist(outer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"vxLockedDiags.txt", "DashboardLogs.zip", "DashboardLogs.zip.d/system.log", "DashboardLogs.zip.d/logs.tar.gz",
+		"DashboardLogs.zip.d/logs.tar.gz.d/vxLiveLog.txt", "nasd.log.gz", "nasd.log.gz.d/nasd.log", "broken.zip"}
+	if !reflect.DeepEqual(filelist, expected) {
+		t.Errorf("Unexpected file list\ngot:  %q\nwant: %q", filelist, expected)
+	}
+
+	// Files within nested archives can be viewed, and are decrypted
+	var display bytes.Buffer
+	report, err := decryptZipSpecificFile(outer, "DashboardLogs.zip.d/logs.tar.gz.d/vxLiveLog.txt", &display, DecryptOptions{})
+	if err != nil || report == nil || display.String() != decrypted {
+		t.Errorf("Nested file not decrypted: %q %v", display.String(), err)
+	}
+
+	decryptFilename := filepath.Join(dir, "diags_d.zip")
+	decryptZip(outer, decryptFilename, FormatZip, DecryptOptions{})
+
+	// The archives are kept alongside their decrypted files, and aren't expanded again when the decrypted bundle is
+	// opened
+	contents := readBundle(t, decryptFilename)
+	if contents["DashboardLogs.zip.d/logs.tar.gz.d/vxLiveLog.txt"] != decrypted || contents["vxLockedDiags.txt"] != decrypted ||
+		contents["nasd.log.gz.d/nasd.log"] != "nasd log\n" || contents["broken.zip"] != "not really a zip" ||
+		contents["DashboardLogs.zip"] != string(innerZipData) || contents["nasd.log.gz"] != gzLog.String() {
+		t.Errorf("Unexpected decrypted contents %q", contents)
+	}
+	if len(contents) != len(expected)+1 {
+		t.Errorf("Unexpected decrypted files %d, want %d with the manifest", len(contents), len(expected)+1)
+	}
+	if decrypted, err := bundleIsDecrypted(decryptFilename); err != nil || !decrypted {
+		t.Error("Decrypted bundle with nested archives not recognized", err)
+	}
+}
+
+// The web server shares a bundle between requests until the file changes
+func TestSharedBundle(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "diags.zip")
+	writeTestZip(t, filename, map[string][]byte{"nasd.log": []byte("nasd log\n")}, []string{"nasd.log"})
+
+	first, err := openSharedBundle(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := openSharedBundle(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.(*sharedBundle).entry != second.(*sharedBundle).entry {
+		t.Error("Bundle opened twice")
+	}
+	first.Close()
+	second.Close()
+
+	// A changed file is opened again
+	writeTestZip(t, filename, map[string][]byte{"nasd.log": []byte("nasd log\n"), "app.log": []byte("app log\n")},
+		[]string{"nasd.log", "app.log"})
+	os.Chtimes(filename, time.Now().Add(time.Minute), time.Now().Add(time.Minute))
+	changed, err := openSharedBundle(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer changed.Close()
+	if len(changed.Members()) != 2 || !first.(*sharedBundle).entry.evicted {
+		t.Errorf("Changed bundle not opened again %d", len(changed.Members()))
+	}
+}
@@ -0,0 +1,196 @@
+// coredump.go
+//
+// Copyright (c) 2016 Drobo Inc. All rights reserved
+//
+// Core dumps within diags (RTPCore1.z) are summarized, with a backtrace for each thread (see binary/core).
+//
+// Backtraces need the symbol files for the firmware the core came from. These are kept in a symbol directory
+// (-symbols), with a subdirectory for each firmware version, named as the version appears in the binary diag
+// file headers. e.g.
+//
+//   symbols/4.1.2-8.95.93281/RTPMain
+//   symbols/4.1.2-8.95.93281/libc.so.6
+//
+// The firmware version is taken from the binary diag files (event logs, zone table etc.) in the bundle, or can be
+// given with -firmware (or on the web backtrace page) for diags which don't have any
+
+package main
+
+import (
+	"decryptDiags/binary"
+	"decryptDiags/binary/core"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// firmwareDir
+//
+// Name of the symbol subdirectory for a firmware version. The version can come from a web request, so it must
+// name a directory within the symbol directory; separators are replaced, and . and .. are rejected
+func firmwareDir(firmware string) (string, error) {
+	dir := strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || unicode.IsSpace(r) {
+			return '_'
+		}
+		return r
+	}, firmware)
+	if dir == "." || dir == ".." {
+		return "", fmt.Errorf("invalid firmware version %q", firmware)
+	}
+	return dir, nil
+}
+
+// bundleFirmware
+//
+// Find the firmware version of a bundle from the headers of the binary diag files in it. Returns an empty string
+// if there aren't any
+func bundleFirmware(bundle Bundle) string {
+	for _, f := range bundle.Members() {
+		if !classifyMember(f.Name(), nil).binaryDiag() {
+			continue
+		}
+
+		reader, err := f.Open()
+		if err != nil {
+			continue
+		}
+		header, err := binary.ReadHeader(reader)
+		reader.Close()
+		if err != nil {
+			continue
+		}
+
+		firmware := header.Firmware()
+		if firmware != "" && strings.IndexFunc(firmware, func(r rune) bool { return !unicode.IsPrint(r) }) < 0 {
+			return firmware
+		}
+	}
+	return ""
+}
+
+// Fill in the firmware version of a bundle for the options, if needed to find core dump symbols
+func setBundleFirmware(bundle Bundle, opts *DecryptOptions) {
+	if opts.SymbolDir != "" && opts.Firmware == "" {
+		opts.Firmware = bundleFirmware(bundle)
+		if opts.Firmware != "" {
+			log.Println("Firmware version", opts.Firmware)
+		}
+	}
+}
+
+// coreSymbols
+//
+// Load the symbols for a core from the symbol directory for the firmware version. If there aren't any, the
+// reason is given in the symbol description
+func coreSymbols(dump *core.Core, opts DecryptOptions) *core.Symbols {
+	switch {
+	case opts.SymbolDir == "":
+		return core.NoSymbols("no symbol directory (-symbols)")
+	case opts.Firmware == "":
+		return core.NoSymbols("firmware version unknown (-firmware)")
+	}
+
+	dir, err := firmwareDir(opts.Firmware)
+	if err != nil {
+		return core.NoSymbols(err.Error())
+	}
+	symbols, err := dump.LoadSymbols(filepath.Join(opts.SymbolDir, dir))
+	if err != nil {
+		return core.NoSymbols(fmt.Sprintf("firmware %s: %v", opts.Firmware, err))
+	}
+	return symbols
+}
+
+// openCore
+//
+// Decompress and open a core dump. The ELF file has to be read at random, so the decompressed core is spooled to
+// a temporary file, which is removed by the returned cleanup function
+func openCore(src io.Reader) (*core.Core, func(), error) {
+	reader, err := core.Decompress(src)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tmp, err := ioutil.TempFile("", "decryptDiagsCore")
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup := func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}
+
+	size, err := io.Copy(tmp, reader)
+	if err == nil {
+		var dump *core.Core
+		dump, err = core.Open(tmp, size)
+		if err == nil {
+			return dump, cleanup, nil
+		}
+	}
+	cleanup()
+	return nil, nil, err
+}
+
+// summarizeCore
+//
+// Write a summary of a core dump, followed by a backtrace of each thread
+func summarizeCore(src io.Reader, writer io.Writer, opts DecryptOptions) error {
+	dump, cleanup, err := openCore(src)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	symbols := coreSymbols(dump, opts)
+	defer symbols.Close()
+
+	dump.Summary(writer)
+	fmt.Fprintln(writer)
+	dump.Backtraces(writer, symbols)
+	return nil
+}
+
+// coreBacktrace
+//
+// Write the backtraces of a core dump within a zipfile (or other bundle), for the web backtrace page
+func coreBacktrace(zipFilename string, filename string, writer io.Writer, opts DecryptOptions) error {
+	bundle, err := openSharedBundle(zipFilename)
+	if err != nil {
+		return err
+	}
+	defer bundle.Close()
+
+	setBundleFirmware(bundle, &opts)
+
+	for _, f := range bundle.Members() {
+		if f.Name() != filename {
+			continue
+		}
+
+		reader, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+
+		dump, cleanup, err := openCore(reader)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+
+		symbols := coreSymbols(dump, opts)
+		defer symbols.Close()
+
+		dump.Backtraces(writer, symbols)
+		return nil
+	}
+	return fmt.Errorf("%s not found in %s", filename, zipFilename)
+}
@@ -18,6 +18,8 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"decryptDiags/binary"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -48,46 +50,219 @@ const (
 	UnknownEncryption
 )
 
+func (scheme EncryptionScheme) String() string {
+	switch scheme {
+	case Decrypted:
+		return "decrypted"
+	case Unencrypted:
+		return "unencrypted"
+	case v1Encrypted:
+		return "v1"
+	case v2Encrypted:
+		return "v2"
+	}
+	return "unknown"
+}
+
+// Schemes are named in the bundle manifest
+func (scheme EncryptionScheme) MarshalText() ([]byte, error) {
+	return []byte(scheme.String()), nil
+}
+
+func (scheme *EncryptionScheme) UnmarshalText(text []byte) error {
+	for _, s := range []EncryptionScheme{Decrypted, Unencrypted, v1Encrypted, v2Encrypted} {
+		if s.String() == string(text) {
+			*scheme = s
+			return nil
+		}
+	}
+	*scheme = UnknownEncryption
+	return nil
+}
+
+// ByteRange describes a contiguous run of bytes, with Offset relative to the start of the source file
+type ByteRange struct {
+	Offset int
+	Length int
+}
+
+// ResyncEvent records a successful keystream resync, and how many keystream steps were skipped to find it
+type ResyncEvent struct {
+	Offset  int
+	Skipped int
+}
+
+// DecryptReport
+//
+// The outcome of decrypting a file, allowing callers to report on the integrity of each file and locate any
+// corrupted regions. Corrupted ranges are the bytes which were either replaced with the ERROR_INDICATOR or
+// required a resync to decrypt
+type DecryptReport struct {
+	Scheme           EncryptionScheme
+	HeaderLength     int // Length of the encryption header stripped from the source
+	BytesProcessed   int // Bytes of the source processed, including the header
+	Corrupted        []ByteRange
+	Resyncs          []ResyncEvent
+	FailedResyncs    int
+	RecoveryDisabled bool // Set if recovery was turned off after too many failed resyncs
+	Heroic           bool // Set if heroic recovery was used
+	Recovered        []RecoveredRegion
+	Segments         []Segment // Plaintext and encrypted segments found in the file
+	Unsupported      bool      // Set if an encrypted segment used a scheme we can't decrypt, and was copied as it is
+}
+
+// Segment describes a section of a file, which is either plaintext or encrypted with Scheme. Offset and Length
+// include the encryption header
+type Segment struct {
+	Offset int
+	Length int
+	Scheme EncryptionScheme
+}
+
+// DecryptOptions control how hard the decryptor works to recover from corruption
+type DecryptOptions struct {
+	Heroic    bool   // Use heroic recovery for badly corrupted diags
+	Jobs      int    // Number of zip members processed in parallel; GOMAXPROCS if not set
+	SymbolDir string // Directory of symbol files for core dumps, with a subdirectory per firmware version
+	Firmware  string // Firmware version of the diags; found from the binary diag files if not set
+
+	Decode binary.DecodeOptions // Options for decoding binary diag files, such as the event log filter
+}
+
+// Total number of corrupted bytes across all corrupted ranges
+func (report *DecryptReport) CorruptedBytes() int {
+	count := 0
+	for _, r := range report.Corrupted {
+		count += r.Length
+	}
+	return count
+}
+
+// One line summary of the report
+func (report *DecryptReport) String() string {
+	summary := fmt.Sprintf("%s: %d bytes processed, %d corrupted bytes in %d ranges, %d resyncs", report.Scheme,
+		report.BytesProcessed, report.CorruptedBytes(), len(report.Corrupted), len(report.Resyncs))
+	if report.FailedResyncs > 0 {
+		summary += fmt.Sprintf(", %d failed resyncs", report.FailedResyncs)
+	}
+	if report.RecoveryDisabled {
+		summary += ", recovery disabled"
+	}
+	if report.Heroic {
+		summary += fmt.Sprintf(", %d regions recovered heroically", len(report.Recovered))
+	}
+	if report.Unsupported {
+		summary += ", unsupported encryption scheme copied without decrypting"
+	}
+	return summary
+}
+
+// Merge the report for an encrypted segment into the report for the whole file
+func (report *DecryptReport) merge(segment DecryptReport) {
+	report.Corrupted = append(report.Corrupted, segment.Corrupted...)
+	report.Resyncs = append(report.Resyncs, segment.Resyncs...)
+	report.Recovered = append(report.Recovered, segment.Recovered...)
+	report.FailedResyncs += segment.FailedResyncs
+	report.RecoveryDisabled = report.RecoveryDisabled || segment.RecoveryDisabled
+}
+
+// Record a corrupted byte at offset, extending the previous range if it is contiguous
+func (report *DecryptReport) markCorrupt(offset int) {
+	if n := len(report.Corrupted); n > 0 {
+		last := &report.Corrupted[n-1]
+		if offset >= last.Offset && offset < last.Offset+last.Length {
+			return
+		}
+		if offset == last.Offset+last.Length {
+			last.Length++
+			return
+		}
+	}
+	report.Corrupted = append(report.Corrupted, ByteRange{offset, 1})
+}
+
+// UnsupportedSchemeError
+//
+// A file is encrypted with a scheme we can't decrypt. v1 diags are recognized from their header, but the v1
+// encryption scheme isn't known, so they are reported rather than decrypted to garbage
+type UnsupportedSchemeError struct {
+	Scheme EncryptionScheme
+	Offset int // Offset of the encryption header in the file
+}
+
+func (e *UnsupportedSchemeError) Error() string {
+	return fmt.Sprintf("unsupported %s encryption at offset %d; copied without decrypting", e.Scheme, e.Offset)
+}
+
 // checkHeader
 //
 // Check for a valid Drobo diags header indicating whether file has already been decrypted, or which encryption
 // mechanism has been used.
 //
-// This function will only look at the start of the file, although previous decryption code had the ability to
-// search forward in the file to find the header.
+// This function will only look at the start of the buffer; decryptFile uses atEncryptionHeader to search forward
+// through the file for further headers, so files with a plaintext preamble or multiple encrypted segments are handled.
 //
 // The function could also take the filename and use that to decide whether to skip encyption (for example, host
 // log files) although doesn't today.
 //
-// A file without an encryption header is assumed to be v2 encryption
+// A file without an encryption header is unencrypted
 //
 // returns: offset into the file after encryption header, encryption type, error value (nil == success)
 
 func checkHeader(bs []byte) (int, EncryptionScheme, error) {
 	checkLen := len(v2encryptedString)
+	if len(bs) < checkLen {
+		return 0, Unencrypted, nil
+	}
 	checkStr := string(bs[0:checkLen])
 
-	// Current implementation only supports v2 header
-
 	if strings.HasPrefix(checkStr, v2encryptedString) {
-		fmt.Println("v2 string found")
 		// Add 1 to offset to account for newline at end of header string
 		return checkLen + 1, v2Encrypted, nil
 	}
 
+	if strings.HasPrefix(checkStr, v1encryptedString) {
+		// The v1 header is also terminated with a newline
+		return len(v1encryptedString) + 1, v1Encrypted, nil
+	}
+
 	return 0, Unencrypted, nil
 }
 
+// detectScheme
+//
+// Work out the encryption scheme of a file from its first bytes, recognizing files we've already decrypted
+func detectScheme(head []byte) EncryptionScheme {
+	if bytes.HasPrefix(head, []byte(decryptedString)) {
+		return Decrypted
+	}
+	_, scheme, _ := checkHeader(head)
+	return scheme
+}
+
+// Return true if the reader is positioned at the start of an encryption header
+func atEncryptionHeader(br *bufio.Reader) bool {
+	bs, _ := br.Peek(len(v2encryptedString))
+	return bytes.Equal(bs, []byte(v2encryptedString)) || bytes.Equal(bs, []byte(v1encryptedString))
+}
+
+// All encryption headers start with this character, so it gives a quick check before looking for a full header
+const encryptionHeaderStart byte = 'D'
+
 const v2Seed uint32 = 0x137b12a4
 
 const ERROR_INDICATOR byte = 0x18 // CANcel
 
 // Generate random stream - pass by value so we update the seed as we go
 
+// RAND32 linear congruential generator constants
+const (
+	rand32Mult uint32 = 1664525
+	rand32Add  uint32 = 1013904223
+)
+
 func RAND32(seed *uint32) uint32 {
-	const mult uint32 = 1664525
-	const add uint32 = 1013904223
-	*seed = mult**seed + add
+	*seed = rand32Mult**seed + rand32Add
 	return *seed
 }
 
@@ -106,201 +281,431 @@ func RotateLeft(value byte, bits uint8) byte {
 const maxRecoverySteps int = 32726 * 10
 const maxRecoveryAttempt int = 20
 
-func decryptV2(bs []byte, offset int) (int, int, error) {
-	currentSeed := v2Seed
-	decryptLen := len(bs)
-	potentialCorruption := 0
-	failedRecovery := 0
-	attemptRecovery := true
-
-	// Decrypt data in-place
-
-	for cursor := offset; cursor < decryptLen; cursor++ {
-		// Reverse the encryption XOR/ROR.
-		var xorVal uint8 = uint8((RAND32(&currentSeed) & 0xff000000) >> 24)
-		var rotVal uint8 = uint8((RAND32(&currentSeed) & 0xff000000) >> 24)
-
-		var decryptByte byte = RotateLeft(bs[cursor], rotVal) ^ xorVal
-
-		if decryptByte&0x80 == 0x80 && attemptRecovery {
-			// 			fmt.Println("potential corruption at offset", cursor, "value =", uint8(bs[cursor]), "encrypt value =", uint8(tmpbyte), "rotVal =", rotVal, "xorVal=", xorVal, "&0x7f = ", string(uint8(bs[cursor]) & 0x7f))
-
-			// Skip forward and see if we can re-sync the decrypt
-			var corruptOffset = cursor
-			var correct bool = false
-
-			oldSeed := currentSeed
-			testSeed := v2Seed
-			var badCount = 0
-			var testDecrypt [32]byte
-			var skipped = 0
-
-			// Try to resync. We do this by walking the decrypt seeed forward one step,
-			// saving that, and then doing a test decrypt of 32 characters. If there are no errors,
-			// we've resynced, otherwise, we keep walking forward until we find success or give up
-
-			for attemptRecovery && !correct && corruptOffset < decryptLen {
-				// Reset seed to initial seed, and do one operation to reset
-				currentSeed = testSeed
-				var _ = uint8((RAND32(&currentSeed) & 0xff000000) >> 24)
-				var _ = uint8((RAND32(&currentSeed) & 0xff000000) >> 24)
-				testSeed = currentSeed
-				skipped++
-
-				badCount = 0
-				for test := 0; test < 32; test++ {
-					if corruptOffset+test >= decryptLen {
-						fmt.Println("Trying to decode beyond end of diag buffer (", corruptOffset, test, ") ... break out")
-						potentialCorruption++
-						break
-					}
-					var xorVal uint8 = uint8((RAND32(&currentSeed) & 0xff000000) >> 24)
-					var rotVal uint8 = uint8((RAND32(&currentSeed) & 0xff000000) >> 24)
-
-					testDecrypt[test] = RotateLeft(bs[corruptOffset+test], rotVal) ^ xorVal
-
-					if testDecrypt[test]&0x80 == 0x80 {
-						badCount++
-					}
-
-					if badCount >= 1 {
-						break
-					}
-				}
-
-				// If we've found a good run, store the good character in memory and carry on as normal
-				if badCount < 1 {
-
-					fmt.Println("Successful resync after", skipped, "resyncs at offset", corruptOffset)
-
-					// Even though we've found a good enough run of characters, the first character might still be corrupted
-					if testDecrypt[0]&0x80 == 0x80 {
-						bs[cursor] = ERROR_INDICATOR
-					} else {
-						bs[cursor] = testDecrypt[0]
-					}
-
-					currentSeed = testSeed
-					var _ = uint8((RAND32(&currentSeed) & 0xff000000) >> 24)
-					var _ = uint8((RAND32(&currentSeed) & 0xff000000) >> 24)
-
-					correct = true
-					potentialCorruption++
-				}
-
-				// Bail out if we're failing to sync for too long
-
-				if skipped > maxRecoverySteps {
-					fmt.Println("Failed to resync after", maxRecoverySteps, "resyncs at offset", corruptOffset)
-					// If we've had too many sections we can't recover from, turn off recovery unless we're in heroic recovery mode
-					failedRecovery++
-
-					// We weren't able to recover, so reset the seed to the previous value on the assumption we've not lost decrypt sync
-					currentSeed = oldSeed
-
-					if failedRecovery == maxRecoveryAttempt {
-						fmt.Println("Disable corruption recovery after", failedRecovery, "bad characters")
-						attemptRecovery = false
-					}
-					break
-				}
+// Number of bytes we test decrypt when trying to resync after a corruption. This is also the lookahead window
+// the streaming decryptor needs to hold in its read buffer
+const resyncWindow int = 32
+
+// Size of the read buffer used by the streaming decryptor
+const decryptBufferSize int = 64 * 1024
+
+// Return the next keystream byte, moving the seed on
+func keyByte(seed *uint32) uint8 {
+	return uint8((RAND32(seed) & 0xff000000) >> 24)
+}
+
+// decryptReader
+//
+// A streaming decryptor. It wraps the source reader and decrypts as data is read, keeping the keystream state
+// across reads so files never have to be held in memory. Corruption recovery only ever needs to look resyncWindow
+// bytes ahead of the current byte, which is peeked from the buffered source.
+type decryptReader struct {
+	src    *bufio.Reader
+	scheme EncryptionScheme
+	seed   uint32
+
+	offset          int // Offset in the source of the next byte to be decrypted
+	keyIndex        int // Position in the keystream of the key for the next byte
+	attemptRecovery bool
+	opts            DecryptOptions
+	heroicBackoff   int // Bytes to skip before attempting another heroic resync
+	heroicFailures  int // Consecutive failed heroic resyncs
+	report          DecryptReport
+}
+
+// newDecryptReader
+//
+// Create a streaming decryptor for the given scheme. The reader should be positioned immediately after the
+// encryption header; offset is the position in the source file, and is only used for reporting.
+//
+// The reader returns io.EOF at the end of the source, or when it reaches another encryption header
+func newDecryptReader(r io.Reader, scheme EncryptionScheme, offset int, opts DecryptOptions) *decryptReader {
+	d := &decryptReader{
+		scheme:          scheme,
+		offset:          offset,
+		attemptRecovery: true,
+		opts:            opts,
+		report:          DecryptReport{Scheme: scheme, HeaderLength: offset, Heroic: opts.Heroic},
+	}
+
+	if br, ok := r.(*bufio.Reader); ok && br.Size() >= heroicWindow {
+		d.src = br
+	} else {
+		d.src = bufio.NewReaderSize(r, decryptBufferSize)
+	}
+
+	d.seed = v2Seed
+
+	return d
+}
+
+// Report on the decrypt so far; complete once the reader has returned io.EOF
+func (d *decryptReader) Report() DecryptReport {
+	d.report.BytesProcessed = d.offset
+	d.report.RecoveryDisabled = !d.attemptRecovery
+	d.closeRecoveredRegion()
+	return d.report
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if next, err := d.src.Peek(1); err == nil && next[0] == encryptionHeaderStart && atEncryptionHeader(d.src) {
+			// Start of the next encrypted segment
+			return n, io.EOF
+		}
+
+		c, err := d.src.ReadByte()
+		if err != nil {
+			if n > 0 && err == io.EOF {
+				err = nil
 			}
+			return n, err
+		}
+
+		p[n] = d.decryptV2Byte(c)
+		d.offset++
+		n++
+	}
+	return n, nil
+}
+
+// decryptV2Byte
+//
+// Reverse the v2 encryption XOR/ROR for a single byte, attempting to resync the keystream if the byte doesn't
+// decrypt to a printable character
+func (d *decryptReader) decryptV2Byte(c byte) byte {
+	var xorVal uint8 = keyByte(&d.seed)
+	var rotVal uint8 = keyByte(&d.seed)
+	d.keyIndex++
+
+	var decryptByte byte = RotateLeft(c, rotVal) ^ xorVal
+
+	if d.heroicBackoff > 0 {
+		d.heroicBackoff--
+	} else if decryptByte&0x80 == 0x80 && d.opts.Heroic {
+		d.src.UnreadByte()
+		window, _ := d.src.Peek(heroicWindow)
+		d.src.ReadByte()
+
+		return d.resyncHeroic(window)
+	}
+
+	if decryptByte&0x80 == 0x80 && d.attemptRecovery && !d.opts.Heroic {
+		// Skip forward and see if we can re-sync the decrypt. The byte we've just read is the start of the window
+		d.src.UnreadByte()
+		window, _ := d.src.Peek(resyncWindow)
+		d.src.ReadByte()
 
-			if !correct {
-				bs[cursor] = ERROR_INDICATOR
-				potentialCorruption++
+		return d.resyncV2(window)
+	}
+
+	// We might have skipped recovery attempts - so double check if a printable character
+	if decryptByte&0x80 == 0x80 {
+		d.report.markCorrupt(d.offset)
+		return ERROR_INDICATOR
+	}
+	return decryptByte
+}
+
+// resyncV2
+//
+// Try to resync. We do this by walking the decrypt seeed forward one step, saving that, and then doing a test
+// decrypt of the window. If there are no errors, we've resynced, otherwise, we keep walking forward until we find
+// success or give up. window[0] is the corrupted byte; the decrypted value (or ERROR_INDICATOR) is returned
+func (d *decryptReader) resyncV2(window []byte) byte {
+	corruptOffset := d.offset
+	oldSeed := d.seed
+	testSeed := v2Seed
+	var testDecrypt [resyncWindow]byte
+	var skipped = 0
+
+	for skipped <= maxRecoverySteps {
+		// Reset seed to initial seed, and do one operation to reset
+		currentSeed := testSeed
+		keyByte(&currentSeed)
+		keyByte(&currentSeed)
+		testSeed = currentSeed
+		skipped++
+
+		badCount := 0
+		for test := 0; test < resyncWindow; test++ {
+			if test >= len(window) {
+				// Trying to decode beyond end of diag buffer ... break out
+				d.report.markCorrupt(corruptOffset)
+				break
 			}
+			var xorVal uint8 = keyByte(&currentSeed)
+			var rotVal uint8 = keyByte(&currentSeed)
 
-		} else {
-			// We might have skipped recovery attempts - so double check if a printable character
-			if decryptByte&0x80 == 0x80 {
-				bs[cursor] = ERROR_INDICATOR
-				potentialCorruption++
-			} else {
-				bs[cursor] = decryptByte
+			testDecrypt[test] = RotateLeft(window[test], rotVal) ^ xorVal
+
+			if testDecrypt[test]&0x80 == 0x80 {
+				badCount++
+				break
 			}
 		}
 
+		// If we've found a good run, use the good character and carry on as normal from the resynced seed
+		if badCount < 1 {
+			d.report.Resyncs = append(d.report.Resyncs, ResyncEvent{corruptOffset, skipped})
+
+			d.seed = testSeed
+			keyByte(&d.seed)
+			keyByte(&d.seed)
+			d.keyIndex = skipped + 1
+			d.report.markCorrupt(corruptOffset)
+
+			// Even though we've found a good enough run of characters, the first character might still be corrupted
+			if testDecrypt[0]&0x80 == 0x80 {
+				return ERROR_INDICATOR
+			}
+			return testDecrypt[0]
+		}
+	}
+
+	// Bail out if we're failing to sync for too long. If we've had too many sections we can't recover from,
+	// turn off recovery unless we're in heroic recovery mode
+	d.report.FailedResyncs++
+	if d.report.FailedResyncs == maxRecoveryAttempt {
+		d.attemptRecovery = false
 	}
 
-	fmt.Println("Decrypted diags from offset", offset, "to", decryptLen, "with", potentialCorruption, "corrupted bytes")
+	// We weren't able to recover, so reset the seed to the previous value on the assumption we've not lost decrypt sync
+	d.seed = oldSeed
+	d.report.markCorrupt(corruptOffset)
 
-	return offset, decryptLen, nil
+	return ERROR_INDICATOR
 }
 
-func writeDecrypted(bs []byte, writer io.Writer, header bool) error {
+// encryptV2
+//
+// Counterpart to the v2 decryptor, used to generate v2 encrypted diags from plaintext (for example, to build synthetic
+// diags for testing). The same keystream is used (see keyByte), with the XOR/ROR applied in reverse order.
+// Data is encrypted in place
+func encryptV2(bs []byte) {
+	currentSeed := v2Seed
+
+	for cursor := range bs {
+		var xorVal uint8 = keyByte(&currentSeed)
+		var rotVal uint8 = keyByte(&currentSeed)
+
+		// Rotating left by (8 - n) is the same as rotating right by n
+		bs[cursor] = RotateLeft(bs[cursor]^xorVal, 8-rotVal%8)
+	}
+}
+
+func writeDecrypted(reader io.Reader, writer io.Writer, header bool) error {
 
 	// Write the decrypted file to outfile
 
-	// Created a buffered writer based on our io.writer so we can write strings and byte slices
+	// Created a buffered writer based on our io.writer so we can write strings and stream the decrypted data
 	bwriter := bufio.NewWriter(writer)
 
 	if header {
 		// Write the header first
-		_, err2 := bwriter.WriteString(decryptedString + versionString + "\n")
-		if err2 != nil {
-			fmt.Println("Failed to output decrypt header", err2)
-			// return a specific error here
-			return nil
+		_, err := bwriter.WriteString(decryptedString + versionString + "\n")
+		if err != nil {
+			fmt.Println("Failed to output decrypt header", err)
+			return err
 		}
 	}
 
-	// Use a slice to write the decrypted buffer (is this comment correct?)
+	_, err := io.Copy(bwriter, reader)
+	if err != nil {
+		fmt.Println("Failed to output decrypted data", err)
+		return err
+	}
+
+	return bwriter.Flush()
+}
+
+// plainReader
+//
+// Pass through plaintext from the source until the end of the source, or until reaching an encryption header
+type plainReader struct {
+	src   *bufio.Reader
+	count int
+}
+
+func (pr *plainReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if next, err := pr.src.Peek(1); err == nil && next[0] == encryptionHeaderStart && atEncryptionHeader(pr.src) {
+			break
+		}
 
-	_, err3 := bwriter.Write(bs)
-	if err3 != nil {
-		fmt.Println("Failed to output decrypted data", err3)
-		// return a specific error here
-		return nil
+		c, err := pr.src.ReadByte()
+		if err != nil {
+			if n > 0 && err == io.EOF {
+				err = nil
+			}
+			return n, err
+		}
+		p[n] = c
+		pr.count++
+		n++
 	}
 
-	bwriter.Flush()
+	if n == 0 {
+		return 0, io.EOF
+	}
+	return n, nil
+}
 
-	return nil
+// decryptFile
+//
+// Decrypt a diags file from reader to writer. The file is streamed through the decryptor, so only the
+// read buffer is held in memory.
+//
+// The file is scanned for encryption headers; each encrypted segment is decrypted independently (with its header
+// replaced by the decrypted header) and any plaintext around the segments is passed through unchanged. A file
+// without any encryption header is output unchanged. A segment encrypted with a scheme we can't decrypt (v1) is
+// copied unchanged to the end of the file, and an UnsupportedSchemeError returned with the report.
+//
+// returns: a report describing the scheme found and any corruption, error value (nil == success)
+func decryptFile(reader io.Reader, writer io.Writer, opts DecryptOptions) (DecryptReport, error) {
+	breader := bufio.NewReaderSize(reader, decryptBufferSize)
+	bwriter := bufio.NewWriter(writer)
+
+	report := DecryptReport{Scheme: Unencrypted, Heroic: opts.Heroic}
+	position := 0
+
+	for {
+		// Plaintext up to the next encryption header (or the end of the file)
+		plain := &plainReader{src: breader}
+		_, err := io.Copy(bwriter, plain)
+		if err != nil {
+			return report, err
+		}
+		if plain.count > 0 {
+			report.Segments = append(report.Segments, Segment{position, plain.count, Unencrypted})
+			position += plain.count
+		}
+
+		bs, err := breader.Peek(len(v2encryptedString) + 1)
+		if err != nil && err != io.EOF {
+			return report, err
+		}
+		if len(bs) == 0 {
+			break
+		}
+
+		offset, encryptType, err := checkHeader(bs)
+		if err != nil {
+			// Report if encryption type unsupported or not found and exit
+			return report, err
+		}
+
+		if encryptType == v1Encrypted {
+			// Copy the rest of the file, header and all, so nothing is lost and it isn't mistaken for decrypted diags
+			n, err := io.Copy(bwriter, breader)
+			report.Scheme, report.HeaderLength, report.Unsupported = encryptType, offset, true
+			report.Segments = append(report.Segments, Segment{position, int(n), encryptType})
+			report.BytesProcessed = position + int(n)
+			if err == nil {
+				err = bwriter.Flush()
+			}
+			if err != nil {
+				return report, err
+			}
+			return report, &UnsupportedSchemeError{encryptType, position}
+		}
+
+		breader.Discard(offset)
+		if report.Scheme == Unencrypted {
+			report.Scheme = encryptType
+			report.HeaderLength = offset
+		}
+
+		decryptor := newDecryptReader(breader, encryptType, position+offset, opts)
+
+		err = writeDecrypted(decryptor, bwriter, true)
+		segment := decryptor.Report()
+		report.merge(segment)
+		report.Segments = append(report.Segments, Segment{position, segment.BytesProcessed - position, encryptType})
+		position = segment.BytesProcessed
+
+		if err != nil {
+			return report, err
+		}
+	}
+
+	report.BytesProcessed = position
+	return report, bwriter.Flush()
+}
+
+// Print a decrypt report, listing each corrupted range and resync
+func printDecryptReport(report DecryptReport) {
+	fprintDecryptReport(os.Stdout, report)
 }
 
-func decryptFile(reader io.Reader, writer io.Writer) {
+func fprintDecryptReport(w io.Writer, report DecryptReport) {
+	fmt.Fprintln(w, "Decrypt", report.String())
+	if len(report.Segments) > 1 {
+		for _, segment := range report.Segments {
+			fmt.Fprintln(w, "  segment at offset", segment.Offset, "length", segment.Length, segment.Scheme)
+		}
+	}
+	for _, r := range report.Corrupted {
+		fmt.Fprintln(w, "  corrupted bytes at offset", r.Offset, "length", r.Length)
+	}
+	for _, r := range report.Resyncs {
+		fmt.Fprintln(w, "  successful resync after", r.Skipped, "resyncs at offset", r.Offset)
+	}
+	for _, r := range report.Recovered {
+		fmt.Fprintf(w, "  recovered %d bytes at offset %d with %.1f%% confidence\n", r.Length, r.Offset, r.Confidence*100)
+	}
+}
+
+// encryptFile
+//
+// Encrypt a plaintext file using the v2 scheme, writing the v2 header followed by the encrypted data
+func encryptFile(reader io.Reader, writer io.Writer) error {
 	bs, err := ioutil.ReadAll(reader)
 	if err != nil {
-		fmt.Println(err)
-		return
+		return err
 	}
 
-	offset, encryptType, err := checkHeader(bs)
+	encryptV2(bs)
+
+	bwriter := bufio.NewWriter(writer)
 
+	_, err = bwriter.WriteString(v2encryptedString + "\n")
 	if err != nil {
-		// switch on error
-		// Report if encryption type unsupported or not found and exit
-		fmt.Println("Unsupported or non existed encryption type", err)
-		return
+		return err
 	}
 
-	fmt.Println("offset = ", offset, " encryptType = ", encryptType)
+	_, err = bwriter.Write(bs)
+	if err != nil {
+		return err
+	}
 
-	switch encryptType {
-	case v2Encrypted:
-		decryptOffset, decryptLen, err := decryptV2(bs, offset)
+	return bwriter.Flush()
+}
 
-		if err != nil {
-			fmt.Println("decryption failed", err)
-			return
-		}
+func encryptDiagFile(filename string, encryptFilename string) {
+	reader, err := os.Open(filename)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer reader.Close()
 
-		err2 := writeDecrypted(bs[decryptOffset:decryptLen], writer, true)
-		if err2 != nil {
-			fmt.Println("Failed to write decrypted diags", err2)
-		}
+	writer, err := os.Create(encryptFilename)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer writer.Close()
+	fmt.Println("Encrypting to", encryptFilename)
 
-	default:
-		// Nothing to decrypt - simply output the original file without a header
-		err2 := writeDecrypted(bs, writer, false)
-		if err2 != nil {
-			fmt.Println("Failed to write unencrypted diags", err2)
-		}
+	err = encryptFile(reader, writer)
+	if err != nil {
+		fmt.Println("Failed to encrypt diags", err)
 	}
 }
 
-func decryptDiagFile(filename string, decryptFilename string) {
+func decryptDiagFile(filename string, decryptFilename string, opts DecryptOptions) {
 	reader, err := os.Open(filename)
 	if err != nil {
 		fmt.Println(err)
@@ -316,7 +721,11 @@ func decryptDiagFile(filename string, decryptFilename string) {
 	defer writer.Close()
 	fmt.Println("Decrypting to", decryptFilename)
 
-	decryptFile(reader, writer)
+	report, err := decryptFile(reader, writer, opts)
+	if err != nil {
+		fmt.Println("Failed to decrypt diags", err)
+	}
+	printDecryptReport(report)
 }
 
 func copyFile(src string, dest string) {
@@ -11,8 +11,10 @@
 // a) copy the original zip file, and decrypt required files in place (many files inside a diags zip are not encrypted
 // and currently get copied in/out of a zip incurring a decompression/compression cycle.
 // NOT DONE: The zip library doesn't obviously allow modification to existing zip files
+// DONE: members which don't need decrypting are raw copied (compressed bytes to compressed bytes) into the new zip
 //
 // b) Decrypt diags in paralllel using go's concurrency mechanisms
+// DONE: decryptZip processes zip members with a pool of workers (-j)
 //
 // c) Have improved handling for corrupted diags. These are currently detected by looking for the top bit of a character being
 // set as this indicates a non-printable character. The old algorithm can be confused by genuine instances of top-bit usage
@@ -84,13 +86,14 @@
 //
 
 // NOTE: Decode speed is ~ 4 times speed of old decryptzip/decryptdiag, although probably due to inefficient uncompress/compress of non-encrypted files
+//       (non-encrypted files are now raw copied, avoiding this)
 
 // ISSUES
 
 // 1. Files with large amounts of "corruption" seem to stall - they are doing the same resync that the current code does (which at least says what's going on).
 //    This algorithm requires review. In many cases these aren't actually corrupted or incorrectly generated diag files, they just reflect non-printable
 //    characters in the source. Perhaps we should assume this, and provide agressive recovery as an selectable option.
-//    FIXED [heroic recovery not implemented)
+//    FIXED [heroic recovery is available as an option - see recovery.go]
 //
 
 package main
@@ -106,6 +109,7 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
 
@@ -132,18 +136,39 @@ func init() {
 	flag.StringVar(&filename, "filename", defaultFilename, usage)
 }
 
+var encryptFilename string
+
+// Tie the command-line flag to the encryptFilename variable and set usage info
+func init() {
+	const (
+		defaultFilename = ""
+		usage           = "A plaintext filename to encrypt with the v2 diags encryption scheme."
+	)
+	flag.StringVar(&encryptFilename, "e", defaultFilename, usage+shorthand)
+	flag.StringVar(&encryptFilename, "encrypt", defaultFilename, usage)
+}
+
 var zipFilename string
 
 // Tie the command-line flag to the zipFilename variable and set usage info
 func init() {
 	const (
 		defaultFilename = ""
-		usage           = "An encrypted zip filename."
+		usage           = "An encrypted zip filename. tar and tar.gz files, and directories of diags, are also accepted."
 	)
 	flag.StringVar(&zipFilename, "z", defaultFilename, usage+shorthand)
 	flag.StringVar(&zipFilename, "zipFilename", defaultFilename, usage)
 }
 
+var outputFormat string
+
+// Tie the command-line flag to the outputFormat variable and set usage info
+func init() {
+	const usage = "Format of the decrypted bundle: zip, tar, tar.gz or dir. Defaults to the format of the original"
+	flag.StringVar(&outputFormat, "of", "", usage+shorthand)
+	flag.StringVar(&outputFormat, "outputFormat", "", usage)
+}
+
 var dataFilename string
 
 // Tie the command-line flag to the dataFilename variable and set usage info
@@ -156,6 +181,78 @@ func init() {
 	flag.StringVar(&dataFilename, "dataFilename", defaultFilename, usage)
 }
 
+var heroicRecovery bool
+
+// Tie the command-line flag to the heroicRecovery variable and set usage info
+func init() {
+	const usage = "Use heroic recovery when decrypting badly corrupted diags. This is much slower"
+	flag.BoolVar(&heroicRecovery, "hr", false, usage+shorthand)
+	flag.BoolVar(&heroicRecovery, "heroic", false, usage)
+}
+
+var zipJobs int
+
+// Tie the command-line flag to the zipJobs variable and set usage info
+func init() {
+	usage := "Number of zip members to process in parallel"
+	flag.IntVar(&zipJobs, "j", runtime.GOMAXPROCS(0), usage+shorthand)
+	flag.IntVar(&zipJobs, "jobs", runtime.GOMAXPROCS(0), usage)
+}
+
+var rulesFilename string
+var printRules bool
+
+// Tie the command-line flags to the handling table configuration variables and set usage info
+func init() {
+	const (
+		usage      = "A JSON file of rules describing how to process each file in a zip, replacing the built-in rules"
+		usagePrint = "Print the effective rules for processing each file in a zip, in the -rules file format"
+	)
+	flag.StringVar(&rulesFilename, "rc", "", usage+shorthand)
+	flag.StringVar(&rulesFilename, "rules", "", usage)
+	flag.BoolVar(&printRules, "pr", false, usagePrint+shorthand)
+	flag.BoolVar(&printRules, "printRules", false, usagePrint)
+}
+
+var symbolDir string
+var firmwareVersion string
+
+// Tie the command-line flags to the core dump symbol variables and set usage info
+func init() {
+	const (
+		usage         = "Directory of symbol files for core dump backtraces, with a subdirectory for each firmware version"
+		usageFirmware = "Firmware version of the diags, for finding symbols. Defaults to the version in the binary diag files"
+	)
+	flag.StringVar(&symbolDir, "sd", "", usage+shorthand)
+	flag.StringVar(&symbolDir, "symbols", "", usage)
+	flag.StringVar(&firmwareVersion, "fw", "", usageFirmware+shorthand)
+	flag.StringVar(&firmwareVersion, "firmware", "", usageFirmware)
+}
+
+var eventSeverity string
+var eventCategories string
+
+// Tie the command-line flags to the event log filter variables and set usage info
+func init() {
+	const (
+		usage         = "Only decode events of this severity and above from event logs (Info, Warning, Error, Critical, or a number)"
+		usageCategory = "Only decode events in these categories from event logs (comma separated numbers)"
+	)
+	flag.StringVar(&eventSeverity, "sev", "", usage+shorthand)
+	flag.StringVar(&eventSeverity, "severity", "", usage)
+	flag.StringVar(&eventCategories, "cat", "", usageCategory+shorthand)
+	flag.StringVar(&eventCategories, "category", "", usageCategory)
+}
+
+var decodeFormat string
+
+// Tie the command-line flag to the decodeFormat variable and set usage info
+func init() {
+	const usage = "Format of binary diag file decodes: text, jsonl (JSON lines) or csv. Defaults to text"
+	flag.StringVar(&decodeFormat, "df", "", usage+shorthand)
+	flag.StringVar(&decodeFormat, "decodeFormat", "", usage)
+}
+
 var enableWebServer bool
 var webServerPort int
 
@@ -212,6 +309,20 @@ func main() {
 
 	fmt.Println("remainder of command line : ", flag.Args())
 
+	if rulesFilename != "" {
+		err := loadHandlingTable(rulesFilename)
+		if err != nil {
+			fmt.Println("Failed to load rules", err)
+			os.Exit(1)
+		}
+		fmt.Println("Using rules from", rulesFilename)
+	}
+
+	if printRules {
+		printHandlingTable(os.Stdout)
+		return
+	}
+
 	// Web support
 	//
 	// Add new flag -web to generate a web server.
@@ -226,11 +337,11 @@ func main() {
 	// Web server warning - multiple http requests can be processes in parallel as separate go routines, so we need to use concurrency protection
 
 	// If we've not been given a zip or file, see if there's any unconsumed arguments.
-	// If .zip, treat as a zip, otherwise treat as a file
+	// If .zip (or another bundle; .tar, .tar.gz or a directory), treat as a zip, otherwise treat as a file
 	// Note we could range across all arguments and process them as files to decrypt
 
-	if filename == "" && zipFilename == "" && dataFilename == "" && len(flag.Args()) != 0 {
-		if strings.HasSuffix(flag.Args()[0], ".zip") {
+	if filename == "" && zipFilename == "" && dataFilename == "" && encryptFilename == "" && len(flag.Args()) != 0 {
+		if info, err := os.Stat(flag.Args()[0]); isBundleFilename(flag.Args()[0]) || (err == nil && info.IsDir()) {
 			zipFilename = flag.Args()[0]
 		} else if strings.HasSuffix(flag.Args()[0], ".dat") {
 			dataFilename = flag.Args()[0]
@@ -242,27 +353,67 @@ func main() {
 	fmt.Println("Decrypting file", filename)
 	fmt.Println("Decrypting zip", zipFilename)
 	fmt.Println("Decoding datafile", dataFilename)
+	fmt.Println("Encrypting file", encryptFilename)
 
 	var path string
 
+	opts := DecryptOptions{Heroic: heroicRecovery, Jobs: zipJobs, SymbolDir: symbolDir, Firmware: firmwareVersion}
+	events, err := parseEventFilter(eventSeverity, eventCategories)
+	if err != nil {
+		fmt.Println("Invalid event filter", err)
+		os.Exit(1)
+	}
+	opts.Decode.Events = events
+	opts.Decode.Format, err = binary.ParseFormat(decodeFormat)
+	if err != nil {
+		fmt.Println("Invalid decode format", err)
+		os.Exit(1)
+	}
+
 	switch {
 	case filename != "":
 		var decryptFileSplit []string = strings.Split(filename, ".")
 		decryptFileSplit[0] += "_d"
 		var decryptFilename string = strings.Join(decryptFileSplit, ".")
-		decryptDiagFile(filename, decryptFilename)
+		decryptDiagFile(filename, decryptFilename, opts)
 		// path = absPathToOpen(decryptFilename)
+	case encryptFilename != "":
+		var encryptFileSplit []string = strings.Split(encryptFilename, ".")
+		encryptFileSplit[0] += "_e"
+		var encryptedFilename string = strings.Join(encryptFileSplit, ".")
+		encryptDiagFile(encryptFilename, encryptedFilename)
 	case dataFilename != "":
 		var decodeFileSplit []string = strings.Split(dataFilename, ".")
 		decodeFileSplit[0] += "_txt"
 		var decodeFilename string = strings.Join(decodeFileSplit, ".")
-		binary.DecodeDataFile(dataFilename, decodeFilename)
+		if opts.Decode.Format != binary.FormatText {
+			decodeFilename = strings.TrimSuffix(dataFilename, filepath.Ext(dataFilename)) + "." + opts.Decode.Format
+		}
+		binary.DecodeDataFile(dataFilename, decodeFilename, opts.Decode)
 		//		path = absPathToOpen(decodeFilename)
 	case zipFilename != "":
-		var decryptFileSplit []string = strings.Split(zipFilename, ".")
-		decryptFileSplit[0] += "_d"
-		var decryptFilename string = strings.Join(decryptFileSplit, ".")
-		decryptZip(zipFilename, decryptFilename)
+		// Decrypt to the same format as the original, unless another format was chosen
+		format, err := detectBundleFormat(zipFilename)
+		format = format.outputFormat()
+		if err == nil && outputFormat != "" {
+			format, err = parseBundleFormat(outputFormat)
+		}
+		if err != nil {
+			fmt.Println(err)
+			break
+		}
+		var decryptFilename string = decryptedBundleName(zipFilename, format)
+
+		decrypted, err := bundleIsDecrypted(zipFilename)
+		if err != nil {
+			fmt.Println(err)
+		} else if decrypted {
+			// Nothing to do; just open the zip if the web server is enabled
+			fmt.Println(zipFilename, "has already been decrypted")
+			decryptFilename = zipFilename
+		} else {
+			decryptZip(zipFilename, decryptFilename, format, opts)
+		}
 		// path is purely for use to automatically open a webpage
 		path = absPathToOpen(decryptFilename)
 	}
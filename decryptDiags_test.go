@@ -1,13 +1,206 @@
 // decryptDiags_test
 package main
 
-import "testing"
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
 
-func TestNew(t *testing.T) {
-	t.Error("Need to write some tests")
-}
+const testPlaintext = "-------------------- LOCKED DIAGS -----------------------\nInvoking DiagnosticHandler function for CAT\n"
 
 // Encrypt some known text, and then decrypt and validate its what we encrypted
 func TestDecrypt(t *testing.T) {
-	t.Error("Need to write decrypt file test")
+	var encrypted bytes.Buffer
+	err := encryptFile(bytes.NewBufferString(testPlaintext), &encrypted)
+	if err != nil {
+		t.Fatal("encryptFile failed", err)
+	}
+
+	if !bytes.HasPrefix(encrypted.Bytes(), []byte(v2encryptedString+"\n")) {
+		t.Error("Encrypted file is missing the v2 header")
+	}
+
+	var decrypted bytes.Buffer
+	report, err := decryptFile(&encrypted, &decrypted, DecryptOptions{})
+	if err != nil {
+		t.Fatal("decryptFile failed", err)
+	}
+
+	if report.Scheme != v2Encrypted || report.CorruptedBytes() != 0 || len(report.Resyncs) != 0 {
+		t.Error("Unexpected decrypt report", report.String())
+	}
+
+	expected := decryptedString + versionString + "\n" + testPlaintext
+	if decrypted.String() != expected {
+		t.Errorf("Decrypted text doesn't match original\ngot:  %q\nwant: %q", decrypted.String(), expected)
+	}
+}
+
+// v1 diags are recognized, but the v1 scheme isn't known, so they are copied as they are and reported as unsupported
+func TestDecryptV1Unsupported(t *testing.T) {
+	const preamble = "Plaintext crash log preamble\n"
+	v1 := preamble + v1encryptedString + "\n\x9c\x13\xfe encrypted data"
+
+	var decrypted bytes.Buffer
+	report, err := decryptFile(bytes.NewBufferString(v1), &decrypted, DecryptOptions{})
+	unsupported, ok := err.(*UnsupportedSchemeError)
+	if !ok || unsupported.Scheme != v1Encrypted || unsupported.Offset != len(preamble) {
+		t.Fatalf("v1 not reported as unsupported: %v", err)
+	}
+	if decrypted.String() != v1 {
+		t.Errorf("v1 file not copied unchanged\ngot:  %q\nwant: %q", decrypted.String(), v1)
+	}
+	if report.Scheme != v1Encrypted || !report.Unsupported || report.BytesProcessed != len(v1) {
+		t.Error("Unexpected decrypt report", report.String())
+	}
+}
+
+// A plaintext preamble followed by two encrypted segments - each segment is decrypted independently
+func TestDecryptSegments(t *testing.T) {
+	const preamble = "Plaintext crash log preamble\n"
+	const second = "-------------------- CRASH LOG FLASH FILE START --------------------\n"
+
+	var encrypted bytes.Buffer
+	encrypted.WriteString(preamble)
+	encryptFile(bytes.NewBufferString(testPlaintext), &encrypted)
+	encryptFile(bytes.NewBufferString(second), &encrypted)
+
+	var decrypted bytes.Buffer
+	report, err := decryptFile(&encrypted, &decrypted, DecryptOptions{})
+	if err != nil {
+		t.Fatal("decryptFile failed", err)
+	}
+
+	header := decryptedString + versionString + "\n"
+	expected := preamble + header + testPlaintext + header + second
+	if decrypted.String() != expected {
+		t.Errorf("Decrypted segments don't match\ngot:  %q\nwant: %q", decrypted.String(), expected)
+	}
+
+	if len(report.Segments) != 3 || report.Segments[0].Scheme != Unencrypted || report.Segments[2].Scheme != v2Encrypted ||
+		report.CorruptedBytes() != 0 {
+		t.Error("Unexpected segments in report", report.Segments, report.String())
+	}
+}
+
+// The jump-ahead seed must match stepping the generator
+func TestSeedAt(t *testing.T) {
+	seed := v2Seed
+	for index := 0; index < 1000; index++ {
+		if seedAt(index) != seed {
+			t.Fatal("seedAt mismatch at index", index)
+		}
+		keyByte(&seed)
+		keyByte(&seed)
+	}
+}
+
+// Corrupt bytes of an encrypted file, and drop a section so the keystream loses sync, and check the streaming
+// decryptor picks up again after each, reporting the corrupted ranges and the resync
+func TestDecryptResync(t *testing.T) {
+	plaintext := strings.Repeat("vxLockedDiags: module state is healthy, nothing to report here\n", 100)
+	header := decryptedString + versionString + "\n"
+	headerLen := len(v2encryptedString) + 1
+
+	var encrypted bytes.Buffer
+	if err := encryptFile(bytes.NewBufferString(plaintext), &encrypted); err != nil {
+		t.Fatal("encryptFile failed", err)
+	}
+
+	// Flipping every bit of a byte flips every bit of its decrypt, so the corrupted bytes aren't printable. They
+	// can't be resynced, as the keystream is still in sync, so they are marked and the decrypt carries on
+	const corruptAt, corruptLen = 1000, 3
+	corrupted := append([]byte{}, encrypted.Bytes()...)
+	for index := corruptAt; index < corruptAt+corruptLen; index++ {
+		corrupted[index] ^= 0xff
+	}
+
+	var decrypted bytes.Buffer
+	report, err := decryptFile(bytes.NewReader(corrupted), &decrypted, DecryptOptions{})
+	if err != nil {
+		t.Fatal("decryptFile failed", err)
+	}
+	expected := []byte(plaintext)
+	for index := corruptAt - headerLen; index < corruptAt-headerLen+corruptLen; index++ {
+		expected[index] = ERROR_INDICATOR
+	}
+	if decrypted.String() != header+string(expected) {
+		t.Errorf("Decrypt didn't carry on after the corrupted bytes\n%q", decrypted.String())
+	}
+	if len(report.Corrupted) != 1 || report.Corrupted[0] != (ByteRange{corruptAt, corruptLen}) || len(report.Resyncs) != 0 ||
+		report.FailedResyncs != corruptLen {
+		t.Errorf("Unexpected report %s %+v", report.String(), report.Corrupted)
+	}
+
+	// Once bytes are dropped, the keystream is out of sync from the first byte which doesn't decrypt, and is resynced
+	// to the key of the byte after the drop there
+	const dropAt, dropLen = 2000, 41
+	dropped := append(append([]byte{}, encrypted.Bytes()[:dropAt]...), encrypted.Bytes()[dropAt+dropLen:]...)
+
+	decrypted.Reset()
+	report, err = decryptFile(bytes.NewReader(dropped), &decrypted, DecryptOptions{})
+	if err != nil {
+		t.Fatal("decryptFile failed", err)
+	}
+	if len(report.Resyncs) != 1 || len(report.Corrupted) != 1 || report.FailedResyncs != 0 {
+		t.Fatalf("Expected a single resync %s", report.String())
+	}
+	resync := report.Resyncs[0]
+	if resync.Offset < dropAt || resync.Offset >= dropAt+resyncWindow || resync.Skipped != resync.Offset-headerLen+dropLen ||
+		report.Corrupted[0] != (ByteRange{resync.Offset, 1}) {
+		t.Errorf("Unexpected resync %+v, corrupted %+v", resync, report.Corrupted)
+	}
+
+	// The plaintext is restored from the resync, and the bytes between the drop and the resync are whatever they
+	// decrypted to
+	got := strings.TrimPrefix(decrypted.String(), header)
+	resumed := resync.Offset - headerLen
+	if len(got) != len(plaintext)-dropLen || got[:dropAt-headerLen] != plaintext[:dropAt-headerLen] ||
+		got[resumed:] != plaintext[resumed+dropLen:] {
+		t.Errorf("Decrypt didn't resume at offset %d\n%q", resync.Offset, got)
+	}
+}
+
+// Drop a section of an encrypted file so the keystream loses sync, and check heroic recovery picks it back up
+func TestHeroicRecovery(t *testing.T) {
+	plaintext := strings.Repeat("vxLockedDiags: module state is healthy, nothing to report here\n", 2000)
+
+	var encrypted bytes.Buffer
+	if err := encryptFile(bytes.NewBufferString(plaintext), &encrypted); err != nil {
+		t.Fatal("encryptFile failed", err)
+	}
+
+	bs := encrypted.Bytes()
+	const dropAt, dropLen = 40000, 41
+	corrupted := append(append([]byte{}, bs[:dropAt]...), bs[dropAt+dropLen:]...)
+
+	var decrypted bytes.Buffer
+	report, err := decryptFile(bytes.NewReader(corrupted), &decrypted, DecryptOptions{Heroic: true})
+	if err != nil {
+		t.Fatal("decryptFile failed", err)
+	}
+
+	if len(report.Recovered) != 1 || report.Recovered[0].Confidence < heroicMinConfidence {
+		t.Fatal("Expected a single recovered region", report.String())
+	}
+
+	header := decryptedString + versionString + "\n"
+	headerLen := len(v2encryptedString) + 1
+	expected := plaintext[:dropAt-headerLen] + plaintext[dropAt-headerLen+dropLen:]
+	got := strings.TrimPrefix(decrypted.String(), header)
+	if len(got) != len(expected) {
+		t.Fatal("Decrypted length mismatch", len(got), len(expected))
+	}
+
+	// Bytes between the drop and the corruption being detected can decrypt to garbage which happens to be printable
+	mismatches := 0
+	for i := range got {
+		if got[i] != expected[i] {
+			mismatches++
+		}
+	}
+	if mismatches > 8 || !strings.HasSuffix(got, expected[dropAt:]) {
+		t.Error("Heroic recovery didn't restore the plaintext", mismatches, report.String())
+	}
 }
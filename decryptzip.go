@@ -5,68 +5,109 @@
 // Process a whole zip file. Many of the files within the zip are not encrypted and don't need uncompressing/decoding/compressing, in
 // which case they are simply copied from one zip to the other.
 //
+// The same processing applies to the other bundle formats (tar, tar.gz and directories; see bundle.go); "zip" below
+// covers any bundle.
+//
 // 1. Process each file within the zip in turn.
 //    a. Identify each file in turn, either based on file type, or by looking for a header at the start of the file
 //    b. It would be nice to have an index file (possibly JSON) describing files within the zip and their encoding mechanism to
 //       allow the whole process to be better automated
+//       DONE: the decrypted zip contains a manifest.json describing how each file was processed (see manifest.go)
 
 package main
 
 import (
-	"archive/zip"
+	"bufio"
+	"bytes"
 	"decryptDiags/binary"
+	"decryptDiags/binary/eventlog"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
-type Flags uint
-
-// Additional action could be to create a CSV file
-const (
-	FlagCopy Flags = 1 << iota
-	FlagDecrypt
-	FlagDecode
-)
+// memberHead
+//
+// Read the start of a bundle member, for classifyMember
+func memberHead(f BundleMember) ([]byte, error) {
+	reader, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
 
-type FileHandlingTable struct {
-	searchKey string
-	flags     Flags
+	head := make([]byte, classifyHeadLength)
+	n, err := io.ReadFull(reader, head)
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		err = nil
+	}
+	return head[:n], err
 }
 
-var handlingTable []FileHandlingTable
+// isDecryptedBundle
+//
+// Return true if a bundle has already been decrypted by decryptDiags. Decrypted bundles contain a manifest which
+// lists every file in the bundle (see Manifest.describes), so a stray manifest.json in a raw bundle isn't enough.
+// Bundles decrypted before the manifest was added are recognized by the decrypted header written on each decrypted
+// file; every file the handling table would decrypt has to have it, so a raw bundle with one decrypted file in it is
+// still decrypted. The name of the bundle (e.g. a _d suffix) isn't used, so renamed bundles are still recognized
+func isDecryptedBundle(bundle Bundle) bool {
+	manifest, err := readManifest(bundle)
+	if err == nil && manifest != nil && manifest.describes(bundle) {
+		return true
+	}
+
+	decrypted := 0
+	for _, f := range bundle.Members() {
+		if !classifyMember(f.Name(), nil).has(ActionDecrypt) {
+			continue
+		}
+		head, err := memberHead(f)
+		if err != nil || detectScheme(head) != Decrypted {
+			return false
+		}
+		decrypted++
+	}
+	return decrypted > 0
+}
 
-// The search string is a prefix search only
-func init() {
-	handlingTable = []FileHandlingTable{
-		{"VX", FlagDecrypt},
-		{"LXDMESG", FlagDecrypt},
-		{"DROBODIAG_", FlagDecrypt},
-		{"EVENTLOG", FlagDecode},
-		{"DISKLOG", FlagDecode},
-    {"FLASHLOG", FlagDecode},
-		{"PERFLOG", FlagDecode | FlagCopy},
-		{"ZONETABLE", FlagDecode | FlagCopy},
+// bundleIsDecrypted
+//
+// Return true if the bundle (zip, tar, tar.gz or directory) has already been decrypted by decryptDiags
+func bundleIsDecrypted(filename string) (bool, error) {
+	bundle, err := openBundle(filename)
+	if err != nil {
+		return false, err
 	}
+	defer bundle.Close()
+
+	return isDecryptedBundle(bundle), nil
 }
 
 func decryptZipFilelist(filename string) ([]string, error) {
 
-	// Open a zip archive for reading.
-	r, err := zip.OpenReader(filename)
+	// Open a bundle for reading.
+	bundle, err := openSharedBundle(filename)
 	if err != nil {
 		//		log.Fatal(err)
 		return nil, err
 	}
-	defer r.Close()
+	defer bundle.Close()
 
 	var zipContent []string
 
-	// Iterate through the files in the archive, generating a list of names
-	for _, f := range r.File {
-		zipContent = append(zipContent, f.Name)
+	// Iterate through the files in the bundle, generating a list of names
+	for _, f := range bundle.Members() {
+		zipContent = append(zipContent, f.Name())
 	}
 	//	log.Println(zipContent)
 
@@ -75,214 +116,577 @@ func decryptZipFilelist(filename string) ([]string, error) {
 
 // decryptZipSpecificFile
 //
-// decrypt a specific file within a zipfile to an io.Writer
+// decrypt a specific file within a zipfile (or other bundle) to an io.Writer
+//
+// The file is classified in the same way as decryptZip (see classifyMember), and the transforms in its plan
+// (decrypt, decode) are applied in order. Copies within the plan only generate extra files in the decrypted
+// zip, so only the final output is written to the io.Writer
 //
-// The core behavior acts on a file; a binary file is decoded; an encrypted file is decrypted.
-// It is not possible to chain actions (e.g decrypt then decode)
-func decryptZipSpecificFile(zipFilename string, filename string, writer io.Writer) error {
-	// Open a zip archive for reading.
+// If the file was decrypted, the decrypt report is returned, otherwise the report is nil
+func decryptZipSpecificFile(zipFilename string, filename string, writer io.Writer, opts DecryptOptions) (*DecryptReport, error) {
+	// Open a bundle for reading.
 	log.Println("decryptZipSpecificFilename", zipFilename, filename)
-	r, err := zip.OpenReader(zipFilename)
+	bundle, err := openSharedBundle(zipFilename)
 	if err != nil {
-		log.Fatal(err)
-		return err
+		log.Println(err)
+		return nil, err
 	}
-	defer r.Close()
+	defer bundle.Close()
 
-	// Work out if zipfile name ends with _d
-	var decryptFileSplit []string = strings.Split(zipFilename, ".")
-	var skipDecode = strings.HasSuffix(decryptFileSplit[0], "_d")
+	// Files in a zip we've already decrypted are displayed as they are
+	var skipDecode = isDecryptedBundle(bundle)
 
-	// Iterate through the files in the archive, decrypting the ones we need to, and copying the others to the new archive
-	// printing some of their contents.
-	for _, f := range r.File {
-		if f.Name == filename {
-			reader, err := f.Open()
-			if err != nil {
-				log.Fatal(err)
-			}
-			defer reader.Close()
-
-			// Decode some of the files in the zip - many are in plaintext
-
-			switch {
-			case skipDecode:
-				// Copy unchanged to the io.Writer
-				fmt.Printf("copying: ")
-
-				_, err = io.Copy(writer, reader)
-				if err != nil {
-					log.Fatal(err)
-				}
-				fmt.Printf("complete\n")
-
-			case strings.HasPrefix(strings.ToUpper(f.Name), "VX"),
-				strings.HasPrefix(strings.ToUpper(f.Name), "LXDMESG"),
-				strings.HasPrefix(strings.ToUpper(f.Name), "DROBODIAG_"):
-				// Any file name starting with vx or Vx should be decrypted
-				fmt.Printf("decrypting: ")
-				// Decrypt file and output into io.Writer
-
-				decryptFile(reader, writer)
-
-				fmt.Printf("complete\n")
-			case strings.HasPrefix(strings.ToUpper(f.Name), "EVENTLOG"),
-				strings.HasPrefix(strings.ToUpper(f.Name), "DISKLOG"),
-        strings.HasPrefix(strings.ToUpper(f.Name), "FLASHLOG"),
-				strings.HasPrefix(strings.ToUpper(f.Name), "PERFLOG"),
-				strings.HasPrefix(strings.ToUpper(f.Name), "ZONETABLE"):
-				// Decode binary files
-				fmt.Printf("decoding: ")
-
-				binary.DecodeFile(reader, writer)
-
-				fmt.Printf("complete\n")
-			default:
-				// Copy unchanged to the io.Writer
-				fmt.Printf("copying: ")
-
-				_, err = io.Copy(writer, reader)
-				if err != nil {
-					log.Fatal(err)
-				}
-				fmt.Printf("complete\n")
-			}
+	setBundleFirmware(bundle, &opts)
+
+	for _, f := range bundle.Members() {
+		if f.Name() != filename {
+			continue
+		}
+
+		reader, err := f.Open()
+		if err != nil {
+			log.Println(err)
+			return nil, err
+		}
+		defer reader.Close()
+
+		breader := bufio.NewReader(reader)
+		head, _ := breader.Peek(classifyHeadLength)
+
+		plan := classifyMember(f.Name(), head)
+		if skipDecode {
+			plan = ProcessingPlan{Actions: []Action{ActionCopy}}
 		}
+
+		return displayPipeline(breader, plan, writer, opts)
 	}
-	return nil
+	return nil, nil
 }
 
-//decryptZip
+// displayPipeline
 //
-// Decrypt a whole zipfile to a new zipfile
-// Multiple rules can be applied to process each file in the zip, such as decrypting, decoding and copying
-// Note that currently actions can't be changed. i.e. you can't decrypt then decode
-func decryptZip(filename string, decryptFilename string) {
+// Apply the transforms in a plan to a reader, writing the final output to the writer
+func displayPipeline(reader io.Reader, plan ProcessingPlan, writer io.Writer, opts DecryptOptions) (*DecryptReport, error) {
+	var stream io.Reader = reader
+	var report *DecryptReport
+
+	var pipes []*io.PipeReader
+	defer func() {
+		for _, pipe := range pipes {
+			pipe.Close()
+		}
+	}()
+
+	for _, action := range plan.Actions {
+		switch action {
+		case ActionDecrypt:
+			fmt.Printf("decrypting: ")
+			var pipe *io.PipeReader
+			pipe, report = decryptingReader(stream, opts)
+			stream = pipe
+			pipes = append(pipes, pipe)
+		case ActionDecode:
+			fmt.Printf("decoding: ")
+			pipe := decodingReader(stream, opts)
+			stream = pipe
+			pipes = append(pipes, pipe)
+		case ActionCore:
+			fmt.Printf("summarizing core: ")
+			pipe := coreReader(stream, opts)
+			stream = pipe
+			pipes = append(pipes, pipe)
+		}
+	}
 
-	//	copyFile(filename, filename+"d")
+	if !plan.Transforms() {
+		fmt.Printf("copying: ")
+	}
 
-	// Open a zip archive for reading.
-	r, err := zip.OpenReader(filename)
+	_, err := io.Copy(writer, stream)
 	if err != nil {
-		log.Fatal(err)
+		log.Println("Failed to process", err)
 	}
-	defer r.Close()
+	fmt.Printf("complete\n")
 
-	// Open another one for writing
+	return report, err
+}
+
+// zipOutput is a file generated from a zip member, held in a temporary file until it can be added to the
+// decrypted archive. Members which are copied unchanged have no temporary file; the member is copied straight
+// into the new archive instead (raw, without decompressing, from one zip to another)
+type zipOutput struct {
+	name     string
+	modified time.Time
+	tmp      *os.File
+	raw      BundleMember
+	digest   *digest // Size and checksum of a temporary file
+}
 
-	zipfile, err := os.Create(decryptFilename)
+// zipResult is the outcome of processing a single zip member
+type zipResult struct {
+	index   int
+	outputs []zipOutput
+	log     bytes.Buffer // Progress messages, printed in order once the member is assembled
+	err     error
+	entry   ManifestEntry // How the member was processed, for the manifest
+	input   *digest       // Size and checksum of the member
+	skip    bool          // The member isn't added to the archive or the manifest
+}
+
+// Create a new temporary output for a member
+func (result *zipResult) newOutput(name string, modified time.Time) (io.Writer, error) {
+	tmp, err := ioutil.TempFile("", "decryptDiags")
 	if err != nil {
-		return // err
+		return nil, err
+	}
+	d := newDigest()
+	result.outputs = append(result.outputs, zipOutput{name, modified, tmp, nil, d})
+	return io.MultiWriter(tmp, d), nil
+}
+
+// Add an output which is a copy of the member; between zips, the compressed data, CRC and timestamps are preserved
+func (result *zipResult) newRawOutput(f BundleMember) {
+	result.outputs = append(result.outputs, zipOutput{f.Name(), f.Modified(), nil, f, nil})
+}
+
+// Remove any temporary files for the result
+func (result *zipResult) cleanup() {
+	for _, output := range result.outputs {
+		if output.tmp != nil {
+			output.tmp.Close()
+			os.Remove(output.tmp.Name())
+		}
+	}
+}
+
+// processZipMember
+//
+// Run the handling table pipeline for a single zip member, generating the outputs into temporary files.
+// This runs in a worker go routine, so all progress messages go to the result log
+func processZipMember(f BundleMember, opts DecryptOptions, result *zipResult) {
+	w := &result.log
+	fmt.Fprintf(w, "%s: ", f.Name())
+
+	if f.Name() == manifestFilename {
+		// The manifest from a previous decrypt is replaced by the manifest for this decrypt
+		fmt.Fprintln(w, "replaced by new manifest")
+		result.skip = true
+		return
+	}
+	if isTimelineFilename(f.Name()) {
+		fmt.Fprintln(w, "replaced by new timeline")
+		result.skip = true
+		return
+	}
+
+	result.entry.Name = f.Name()
+	result.input = newDigest()
+
+	// Work out what to do with the file from its name and content
+
+	head, err := memberHead(f)
+	if err != nil {
+		result.err = err
+		return
+	}
+
+	plan := classifyMember(f.Name(), head)
+	result.entry.Scheme = detectScheme(head)
+	result.entry.Rule = plan.Rule
+	result.entry.Actions = plan.Actions
+
+	result.err = runPipeline(f, plan, opts, result)
+
+	// Members which are only copied aren't read by the pipeline, so read them now for the manifest
+	if result.err == nil && !plan.Transforms() {
+		result.err = hashMember(f, result.input)
+	}
+	if result.err != nil {
+		return
+	}
+
+	result.entry.Size = result.input.size
+	result.entry.SHA256 = result.input.Sum()
+	for _, output := range result.outputs {
+		if output.raw != nil {
+			result.entry.Outputs = append(result.entry.Outputs, ManifestOutput{output.name, result.input.size, result.entry.SHA256})
+		} else {
+			result.entry.Outputs = append(result.entry.Outputs, ManifestOutput{output.name, output.digest.size, output.digest.Sum()})
+		}
+	}
+}
+
+// Read the whole of a member into a digest
+func hashMember(f BundleMember, d *digest) error {
+	reader, err := f.Open()
+	if err != nil {
+		return err
 	}
-	defer zipfile.Close()
-	fmt.Println("Decrypting to", decryptFilename)
+	defer reader.Close()
 
-	archive := zip.NewWriter(zipfile)
-	defer archive.Close()
+	_, err = io.Copy(d, reader)
+	return err
+}
 
-	fmt.Println("Files in ", filename)
-	// Iterate through the files in the archive, decrypting the ones we need to, and copying the others to the new archive
-	// printing some of their contents.
-	for _, f := range r.File {
-		fmt.Printf("%s: ", f.Name)
+// runPipeline
+//
+// Apply the actions to a zip member in order. Each transform (decrypt, decode) wraps the stream from the previous
+// action, so the member is only read once however many actions there are. A copy outputs the stream at that point
+// in the pipeline; a copy before any transform is a raw copy of the member. If the pipeline doesn't end with a copy,
+// the final stream is output under its (possibly renamed) name
+func runPipeline(f BundleMember, plan ProcessingPlan, opts DecryptOptions, result *zipResult) error {
+	w := &result.log
+	name := f.Name()
+	actions := plan.Actions
+
+	var stream io.Reader
+	var reports []*DecryptReport
+	transformed := false
+
+	// Make sure the go routines behind any transforms exit, even if we stop reading early
+	var pipes []*io.PipeReader
+	defer func() {
+		for _, pipe := range pipes {
+			pipe.Close()
+		}
+	}()
 
+	// Only open the member if it needs to be transformed
+	if len(actions) > 1 || actions[0] != ActionCopy {
 		reader, err := f.Open()
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
 		defer reader.Close()
+		stream = io.TeeReader(reader, result.input)
+	}
 
-		// Open new file inside archive
+	for _, action := range actions {
+		switch action {
+		case ActionCopy:
+			if !transformed {
+				// Copy unchanged to the decrypted archive file, without decompressing
+				fmt.Fprintln(w, "copying raw to", name)
+				result.newRawOutput(f)
+				continue
+			}
 
-		// Do all the fun zip header stuff - use the header from the source file
+			fmt.Fprintln(w, "copying to", name)
+			writer, err := result.newOutput(name, f.Modified())
+			if err != nil {
+				return err
+			}
+			stream = io.TeeReader(stream, writer)
+
+		case ActionDecrypt:
+			fmt.Fprintln(w, "decrypting", name)
+			pipe, report := decryptingReader(stream, opts)
+			stream = pipe
+			pipes = append(pipes, pipe)
+			reports = append(reports, report)
+			transformed = true
+
+		case ActionDecode:
+			// Adjust the name to change or add a .txt (or the rule's rename) suffix, or the suffix of the decode format
+			name = plan.decodedName(name)
+			if format := opts.Decode.Format; format != "" && format != binary.FormatText {
+				name = strings.TrimSuffix(name, path.Ext(name)) + "." + format
+			}
+
+			fmt.Fprintln(w, "decoding to", name)
+			pipe := decodingReader(stream, opts)
+			stream = pipe
+			pipes = append(pipes, pipe)
+			transformed = true
 
-		header := f.FileHeader
+		case ActionCore:
+			name = plan.decodedName(name)
 
-		// Lookup file in our file  handling table and work out what to do with it
+			fmt.Fprintln(w, "summarizing core to", name)
+			pipe := coreReader(stream, opts)
+			stream = pipe
+			pipes = append(pipes, pipe)
+			transformed = true
+		}
+	}
 
-		found := false
-		for _, entry := range handlingTable {
-			if strings.HasPrefix(strings.ToUpper(f.Name), entry.searchKey) {
+	if actions[len(actions)-1] != ActionCopy {
+		writer, err := result.newOutput(name, f.Modified())
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(writer, stream)
+		if err != nil {
+			return err
+		}
+	} else if transformed {
+		// Drive the stream through any pending copy
+		_, err := io.Copy(ioutil.Discard, stream)
+		if err != nil {
+			return err
+		}
+	}
 
-				found = true
+	for _, report := range reports {
+		fprintDecryptReport(w, *report)
+		result.entry.addReport(report)
+	}
 
-				// We've found a match. Work out what ways we need to process it
+	return nil
+}
 
-				if entry.flags&FlagDecrypt == FlagDecrypt {
-					// Decrypt file and output into new zip
+// decryptingReader
+//
+// Return a reader of the decrypted source. The report is complete once the returned reader reaches EOF
+func decryptingReader(src io.Reader, opts DecryptOptions) (*io.PipeReader, *DecryptReport) {
+	pr, pw := io.Pipe()
+	report := &DecryptReport{}
+
+	go func() {
+		var err error
+		*report, err = decryptFile(src, pw, opts)
+
+		// Files we can't decrypt are copied as they are, and flagged in the report, rather than failing the bundle
+		if unsupported, ok := err.(*UnsupportedSchemeError); ok {
+			log.Println("Not decrypted:", unsupported)
+			err = nil
+		}
+		pw.CloseWithError(err)
+	}()
 
-					// May need to adjust name if we decrypt it
+	return pr, report
+}
 
-					writer, err := archive.CreateHeader(&header)
-					if err != nil {
-						fmt.Println("Error (decrypt) creating archive header ", header.Name, err)
-						return // err
-					}
+// decodingReader
+//
+// Return a reader of the decoded binary source. Any of the source left unread by the decoder is drained, so
+// earlier actions in the pipeline always see the whole of the member
+func decodingReader(src io.Reader, opts DecryptOptions) *io.PipeReader {
+	pr, pw := io.Pipe()
 
-					// Decrypt file and output into io.Writer
-					fmt.Println("copying to", header.Name)
-					decryptFile(reader, writer)
-				}
-				if entry.flags&FlagDecode == FlagDecode {
-					// Decode binary files
+	go func() {
+		err := binary.DecodeFileWithOptions(src, pw, opts.Decode)
+		if err != nil {
+			log.Println("Decode incomplete:", err)
+		}
+		_, err = io.Copy(ioutil.Discard, src)
+		pw.CloseWithError(err)
+	}()
 
-					// Adjust the name to change or add a .log suffix
-					var decodeFileSplit []string = strings.Split(header.Name, ".")
-					decodeHeader := header
-					decodeHeader.Name = decodeFileSplit[0] + ".txt"
+	return pr
+}
 
-					// May need to adjust name if we decode it
+// parseEventFilter
+//
+// Parse the event log filter options; a minimum severity (by name or number), and a comma separated list of
+// category numbers. Either can be empty
+func parseEventFilter(severity string, categories string) (binary.EventFilter, error) {
+	var filter binary.EventFilter
+	if severity != "" {
+		minimum, err := eventlog.ParseSeverity(severity)
+		if err != nil {
+			return filter, err
+		}
+		filter.MinSeverity = uint8(minimum)
+	}
 
-					writer, err := archive.CreateHeader(&decodeHeader)
-					if err != nil {
-						fmt.Println("Error (decode) creating archive header", decodeHeader.Name, err)
-						return // err
-					}
+	for _, field := range strings.Split(categories, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		category, err := strconv.ParseUint(field, 0, 8)
+		if err != nil {
+			return filter, fmt.Errorf("invalid event category %q", field)
+		}
+		filter.Categories = append(filter.Categories, uint8(category))
+	}
+	return filter, nil
+}
 
-					fmt.Println("decoding to", decodeHeader.Name)
-					binary.DecodeFile(reader, writer)
-				}
-				if entry.flags&FlagCopy == FlagCopy {
-					// Copy unchanged to the decrypted archive file
-					fmt.Println("copying to", header.Name)
+// coreReader
+//
+// Return a reader of a text summary of the core dump source, with backtraces for each thread (see coredump.go).
+// A core that can't be read is reported in the summary rather than failing the member, as the original is
+// usually kept as well
+func coreReader(src io.Reader, opts DecryptOptions) *io.PipeReader {
+	pr, pw := io.Pipe()
+
+	go func() {
+		err := summarizeCore(src, pw, opts)
+		if err != nil {
+			fmt.Fprintln(pw, "Unable to read core:", err)
+		}
+		_, err = io.Copy(ioutil.Discard, src)
+		pw.CloseWithError(err)
+	}()
 
-					writer, err := archive.CreateHeader(&header)
-					if err != nil {
-						fmt.Println("Error (copy) creating archive header", header.Name, err)
-						return // err
-					}
-					//        defer writer.Close()
+	return pr
+}
 
-					_, err = io.Copy(writer, reader)
-					if err != nil {
-						log.Fatal(err)
-					}
-					fmt.Printf("complete\n")
-				}
+// Add the outputs of a processed member to the archive, in the order they were generated
+func assembleZipMember(archive BundleWriter, result *zipResult) error {
+	defer result.cleanup()
 
-				break
+	for _, output := range result.outputs {
+		if output.raw != nil {
+			err := copyMember(archive, output.raw)
+			if err != nil {
+				return err
 			}
+			continue
+		}
+
+		_, err := output.tmp.Seek(0, io.SeekStart)
+		if err != nil {
+			return err
 		}
 
-		if !found {
-			// Copy unchanged to the decrypted archive file
-			fmt.Printf("copying: ")
+		err = archive.Add(output.name, output.modified, output.digest.size, output.tmp)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-			writer, err := archive.CreateHeader(&header)
-			if err != nil {
-				fmt.Println("Error (copy2) creating archive header", header.Name, err)
-				return // err
+// Copy a member unchanged to the archive; raw copied from one zip to another
+func copyMember(archive BundleWriter, f BundleMember) error {
+	if zipArchive, ok := archive.(*zipBundleWriter); ok {
+		copied, err := zipArchive.copyRaw(f)
+		if copied {
+			return err
+		}
+	}
+
+	reader, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	return archive.Add(f.Name(), f.Modified(), f.Size(), reader)
+}
+
+//decryptZip
+//
+// Decrypt a whole zipfile (or other bundle) to a new bundle in the given format
+// Multiple rules can be applied to process each file in the zip, such as decrypting, decoding and copying.
+// The rules for a file are applied as a pipeline (see runPipeline), so actions can be chained, e.g. decrypt then decode
+//
+// Members are processed in parallel by a pool of opts.Jobs workers (GOMAXPROCS if not set), each generating its
+// output into temporary files. The outputs are then added to the new zipfile in the original member order, so
+// the decrypted zip is the same however many workers are used
+func decryptZip(filename string, decryptFilename string, format BundleFormat, opts DecryptOptions) {
+
+	start := time.Now()
+
+	// Open a bundle for reading.
+	bundle, err := openBundle(filename)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer bundle.Close()
+	members := bundle.Members()
+
+	// Core dumps need the firmware version to find their symbols
+	setBundleFirmware(bundle, &opts)
+
+	// Open another one for writing
+
+	archive, err := createBundle(decryptFilename, format)
+	if err != nil {
+		fmt.Println(err)
+		return // err
+	}
+	fmt.Println("Decrypting", bundle.Format(), "to", format, decryptFilename)
+
+	jobs := opts.Jobs
+	if jobs < 1 {
+		jobs = runtime.GOMAXPROCS(0)
+	}
+
+	fmt.Println("Files in ", filename, "processing with", jobs, "workers")
+
+	// Feed the member indexes to the workers, which send back results in whatever order they complete
+
+	work := make(chan int)
+	results := make(chan *zipResult)
+
+	go func() {
+		for index := range members {
+			work <- index
+		}
+		close(work)
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range work {
+				result := &zipResult{index: index}
+				processZipMember(members[index], opts, result)
+				results <- result
 			}
-			//        defer writer.Close()
+		}()
+	}
 
-			_, err = io.Copy(writer, reader)
-			if err != nil {
-				log.Fatal(err)
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	// Assemble the archive in member order, holding back any results which complete early
+
+	manifest := &Manifest{Version: versionString, Source: filepath.Base(filename)}
+
+	pending := map[int]*zipResult{}
+	next := 0
+	for result := range results {
+		pending[result.index] = result
+
+		for pending[next] != nil {
+			result := pending[next]
+			delete(pending, next)
+			next++
+
+			fmt.Print(result.log.String())
+			if result.skip {
+				continue
 			}
-			fmt.Printf("complete\n")
+			if result.err == nil {
+				result.err = assembleZipMember(archive, result)
+			} else {
+				result.cleanup()
+			}
+			if result.err != nil {
+				fmt.Println("Error processing", members[result.index].Name(), result.err)
+				result.entry.Error = result.err.Error()
+			}
+			manifest.Files = append(manifest.Files, result.entry)
+		}
+	}
+
+	// The event logs merged into a timeline
+	timeline := bundleTimeline(bundle)
+	if len(timeline.Events) > 0 {
+		fmt.Println("Event timeline of", len(timeline.Events), "events")
+		manifest.Generated, err = writeTimeline(archive, timeline)
+		if err != nil {
+			fmt.Println("Error writing timeline", err)
 		}
 	}
 
-	archive.Close()
-	fmt.Println("Decryptzip complete")
+	err = writeManifest(archive, manifest)
+	if err != nil {
+		fmt.Println("Error writing manifest", err)
+	}
+
+	err = archive.Close()
+	if err != nil {
+		fmt.Println("Error closing", decryptFilename, err)
+	}
+	fmt.Println("Decryptzip complete in", time.Since(start))
 }
@@ -0,0 +1,402 @@
+// decryptzip_test
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"decryptDiags/binary"
+	"decryptDiags/binary/core"
+	"decryptDiags/binary/eventlog"
+	"decryptDiags/internal/eventlogtest"
+	encodingBinary "encoding/binary"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// The known files in a Drobo diags bundle (see UnderstandingDiags.md) and how they should be processed
+func TestClassifyMember(t *testing.T) {
+	copyOnly := []Action{ActionCopy}
+	decrypt := []Action{ActionDecrypt}
+	decode := []Action{ActionDecode}
+	copyDecode := []Action{ActionCopy, ActionDecode}
+
+	tests := []struct {
+		name    string
+		rule    string
+		actions []Action
+	}{
+		{"vxLockedDiags.txt", "VX", decrypt},
+		{"vxLiveLog.txt", "VX", decrypt},
+		{"VxLxCLog.txt", "VX", decrypt},
+		{"LxDmesg.txt", "LXDMESG", decrypt},
+		{"LxDmesgiSCSId.txt", "LXDMESG", decrypt},
+		{"DroboDiag_20160712.log", "DROBODIAG_", decrypt},
+		{"EventLog.txt", "EVENTLOG", decode},
+		{"FlashLog.txt", "FLASHLOG", decode},
+		{"DiskLog.txt", "DISKLOG", decode},
+		{"ZoneTable.txt", "ZONETABLE", copyDecode},
+		{"PerfLog.bin", "PERFLOG", copyDecode},
+		{"UELog.bin", "", copyOnly},
+		{"PerfTable.txt", "", copyOnly},
+		{"RTPCore1.z", "RTPCORE", []Action{ActionCopy, ActionCore}},
+		{"nasd.log", "", copyOnly},
+		{"LxSystemInfo.txt", "", copyOnly},
+		{"DAPPS_crashplan_4.7.0.txt", "", copyOnly},
+		{"TMDiags1.log", "", copyOnly},
+		{"DDDiags0.log", "", copyOnly},
+		{"SystemInfo.info", "", copyOnly},
+		{"system.log", "", copyOnly},
+		{"systemdetailed.log", "", copyOnly},
+		{"ioreg.log", "", copyOnly},
+		{"Drobo Dashboard_2016-07-12-101010_iMac.crash", "", copyOnly},
+	}
+
+	for _, test := range tests {
+		plan := classifyMember(test.name, nil)
+		if plan.Rule != test.rule || !reflect.DeepEqual(plan.Actions, test.actions) {
+			t.Errorf("%s: got rule %q actions %v, want rule %q actions %v", test.name, plan.Rule, plan.Actions, test.rule, test.actions)
+		}
+	}
+}
+
+// Files which have already been decrypted or decoded are copied, whatever their name
+func TestClassifyMemberContent(t *testing.T) {
+	tests := []struct {
+		name string
+		head string
+	}{
+		{"vxLockedDiags.txt", decryptedString + versionString + "\n"},
+		{"EventLog.txt", binary.DecodeBanner + "\n"},
+		{"ZoneTable.txt", binary.DecodeBanner + "\n"},
+		{"RTPCore1.txt", core.SummaryBanner + "\n"},
+	}
+
+	for _, test := range tests {
+		plan := classifyMember(test.name, []byte(test.head))
+		if plan.Transforms() {
+			t.Errorf("%s: already processed file would be transformed: %v", test.name, plan.Actions)
+		}
+	}
+
+	plan := classifyMember("vxLockedDiags.txt", []byte(v2encryptedString+"\n"))
+	if !reflect.DeepEqual(plan.Actions, []Action{ActionDecrypt}) {
+		t.Errorf("encrypted vxLockedDiags.txt: got actions %v", plan.Actions)
+	}
+}
+
+// The printed rules can be read back as a configuration file, and glob, regex and rename rules work
+func TestHandlingTableConfig(t *testing.T) {
+	defaultTable := handlingTable
+	defer func() { handlingTable = defaultTable }()
+
+	var printed bytes.Buffer
+	err := printHandlingTable(&printed)
+	if err != nil {
+		t.Fatal("printHandlingTable failed", err)
+	}
+
+	rules, err := readHandlingTable(&printed)
+	if err != nil {
+		t.Fatal("Printed rules can't be read back", err)
+	}
+	if !reflect.DeepEqual(rules, defaultTable) {
+		t.Errorf("Printed rules don't match the built-in rules\ngot:  %v\nwant: %v", rules, defaultTable)
+	}
+
+	const config = `{ "rules": [
+		{ "glob": "uelog*.bin", "actions": [ "copy", "decode" ], "rename": ".log" },
+		{ "regex": "^nasd[0-9]*\\.log$", "actions": [ "decrypt" ] }
+	] }`
+	handlingTable, err = readHandlingTable(strings.NewReader(config))
+	if err != nil {
+		t.Fatal("readHandlingTable failed", err)
+	}
+
+	plan := classifyMember("UELog.bin", nil)
+	if plan.Rule != "uelog*.bin" || !reflect.DeepEqual(plan.Actions, []Action{ActionCopy, ActionDecode}) {
+		t.Errorf("UELog.bin: got rule %q actions %v", plan.Rule, plan.Actions)
+	}
+	if plan.decodedName("UELog.bin") != "UELog.log" || plan.decodedName("Logs.zip/UELog.bin") != "Logs.zip/UELog.log" {
+		t.Errorf("UELog.bin: decoded name %s", plan.decodedName("UELog.bin"))
+	}
+
+	if classifyMember("nasd1.log", nil).Rule == "" || classifyMember("NASD.log", nil).Rule != "" {
+		t.Error("Regex rule isn't matched exactly")
+	}
+	if classifyMember("vxLockedDiags.txt", nil).Transforms() {
+		t.Error("Built-in rules still in use after loading a configuration")
+	}
+
+	for _, bad := range []string{
+		`{ "rules": [ { "prefix": "VX", "glob": "VX*", "actions": [ "decrypt" ] } ] }`,
+		`{ "rules": [ { "prefix": "VX" } ] }`,
+		`{ "rules": [ { "prefix": "VX", "actions": [ "explode" ] } ] }`,
+		`{ "rules": [ { "regex": "(", "actions": [ "copy" ] } ] }`,
+		`{ "rules": [ { "glob": "[", "actions": [ "copy" ] } ] }`,
+	} {
+		if _, err := readHandlingTable(strings.NewReader(bad)); err == nil {
+			t.Error("Bad configuration accepted", bad)
+		}
+	}
+}
+
+// Create a zip file of test files
+func writeTestZip(t *testing.T, filename string, files map[string][]byte, order []string) {
+	file, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	archive := zip.NewWriter(file)
+	for _, name := range order {
+		writer, err := archive.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writer.Write(files[name])
+	}
+	err = archive.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// The decrypted zip has a manifest describing how each file was processed
+func TestDecryptZipManifest(t *testing.T) {
+	var encrypted bytes.Buffer
+	err := encryptFile(strings.NewReader(testPlaintext), &encrypted)
+	if err != nil {
+		t.Fatal("encryptFile failed", err)
+	}
+
+	dir := t.TempDir()
+	zipFilename := filepath.Join(dir, "diags.zip")
+	writeTestZip(t, zipFilename, map[string][]byte{
+		"vxLockedDiags.txt": encrypted.Bytes(),
+		"nasd.log":          []byte("nasd log\n"),
+	}, []string{"vxLockedDiags.txt", "nasd.log"})
+
+	decryptFilename := filepath.Join(dir, "diags_d.zip")
+	decryptZip(zipFilename, decryptFilename, FormatZip, DecryptOptions{Jobs: 2})
+
+	bundle, err := openBundle(decryptFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bundle.Close()
+
+	manifest, err := readManifest(bundle)
+	if err != nil || manifest == nil {
+		t.Fatal("No manifest in decrypted zip", err)
+	}
+
+	if manifest.Version != versionString || manifest.Source != "diags.zip" || len(manifest.Files) != 2 {
+		t.Fatalf("Unexpected manifest %+v", manifest)
+	}
+
+	vx := manifest.Files[0]
+	decrypted := decryptedString + versionString + "\n" + testPlaintext
+	if vx.Name != "vxLockedDiags.txt" || vx.Scheme != v2Encrypted || vx.Rule != "VX" ||
+		!reflect.DeepEqual(vx.Actions, []Action{ActionDecrypt}) || vx.CorruptedBytes != 0 {
+		t.Errorf("Unexpected manifest entry %+v", vx)
+	}
+	if vx.Size != int64(encrypted.Len()) || vx.SHA256 != sha256Hex(encrypted.Bytes()) {
+		t.Errorf("Wrong input size/checksum %+v", vx)
+	}
+	if len(vx.Outputs) != 1 || vx.Outputs[0].Size != int64(len(decrypted)) || vx.Outputs[0].SHA256 != sha256Hex([]byte(decrypted)) {
+		t.Errorf("Wrong outputs %+v", vx.Outputs)
+	}
+
+	nasd := manifest.Files[1]
+	if nasd.Scheme != Unencrypted || len(nasd.Outputs) != 1 || nasd.Outputs[0].SHA256 != sha256Hex([]byte("nasd log\n")) {
+		t.Errorf("Unexpected manifest entry %+v", nasd)
+	}
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Decrypted zips are recognized from their content, whatever they are called
+func TestDecryptedBundle(t *testing.T) {
+	var encrypted bytes.Buffer
+	err := encryptFile(strings.NewReader(testPlaintext), &encrypted)
+	if err != nil {
+		t.Fatal("encryptFile failed", err)
+	}
+
+	dir := t.TempDir()
+	zipFilename := filepath.Join(dir, "diags_d.zip")
+	writeTestZip(t, zipFilename, map[string][]byte{"vxLockedDiags.txt": encrypted.Bytes()}, []string{"vxLockedDiags.txt"})
+
+	decrypted, err := bundleIsDecrypted(zipFilename)
+	if err != nil || decrypted {
+		t.Error("Encrypted zip with a _d name seen as decrypted", err)
+	}
+
+	renamed := filepath.Join(dir, "renamed.zip")
+	decryptZip(zipFilename, renamed, FormatZip, DecryptOptions{})
+
+	decrypted, err = bundleIsDecrypted(renamed)
+	if err != nil || !decrypted {
+		t.Error("Renamed decrypted zip not recognized", err)
+	}
+
+	// Zips decrypted before manifests were added are recognized by their decrypted files
+	legacy := filepath.Join(dir, "legacy.zip")
+	writeTestZip(t, legacy, map[string][]byte{
+		"nasd.log":          []byte("nasd log\n"),
+		"vxLockedDiags.txt": []byte(decryptedString + versionString + "\n" + testPlaintext),
+	}, []string{"nasd.log", "vxLockedDiags.txt"})
+
+	decrypted, err = bundleIsDecrypted(legacy)
+	if err != nil || !decrypted {
+		t.Error("Legacy decrypted zip not recognized", err)
+	}
+
+	var display bytes.Buffer
+	report, err := decryptZipSpecificFile(renamed, "vxLockedDiags.txt", &display, DecryptOptions{})
+	if err != nil || report != nil || display.String() != decryptedString+versionString+"\n"+testPlaintext {
+		t.Errorf("Decrypted file not displayed as it is: %q %v", display.String(), err)
+	}
+}
+
+// Raw bundles containing a decrypted file, or a manifest which isn't theirs, are still decrypted
+func TestMixedBundle(t *testing.T) {
+	var encrypted bytes.Buffer
+	err := encryptFile(strings.NewReader(testPlaintext), &encrypted)
+	if err != nil {
+		t.Fatal("encryptFile failed", err)
+	}
+	decrypted := []byte(decryptedString + versionString + "\n" + testPlaintext)
+	unrelated := []byte(`{"version": "Version 6.3.2", "files": [{"name": "app.log", "outputs": [{"name": "app.log"}]}]}`)
+
+	dir := t.TempDir()
+	bundles := map[string]map[string][]byte{
+		"decrypted file": {"LXDMESG.txt": decrypted, "vxLockedDiags.txt": encrypted.Bytes()},
+		"manifest":       {manifestFilename: unrelated, "vxLockedDiags.txt": encrypted.Bytes()},
+	}
+	for name, files := range bundles {
+		zipFilename := filepath.Join(dir, strings.Replace(name, " ", "_", -1)+".zip")
+		var order []string
+		for member := range files {
+			order = append(order, member)
+		}
+		writeTestZip(t, zipFilename, files, order)
+
+		if isDecrypted, err := bundleIsDecrypted(zipFilename); err != nil || isDecrypted {
+			t.Errorf("%s: raw bundle seen as decrypted %v", name, err)
+		}
+
+		var display bytes.Buffer
+		report, err := decryptZipSpecificFile(zipFilename, "vxLockedDiags.txt", &display, DecryptOptions{})
+		if err != nil || report == nil || report.Scheme != v2Encrypted || !strings.Contains(display.String(), testPlaintext) {
+			t.Errorf("%s: encrypted file not decrypted for display %v %q", name, err, display.String())
+		}
+	}
+}
+
+// The firmware version used to find core dump symbols comes from the binary diag file headers
+func TestBundleFirmware(t *testing.T) {
+	header := binary.BinaryHdr{HeaderVersion: 1}
+	copy(header.FirmwareVersion[:], "4.1.2-8.95.93281")
+	var eventLog bytes.Buffer
+	encodingBinary.Write(&eventLog, encodingBinary.BigEndian, header)
+
+	filename := filepath.Join(t.TempDir(), "diags.zip")
+	writeTestZip(t, filename, map[string][]byte{"nasd.log": []byte("nasd log\n"), "EventLog.txt": eventLog.Bytes()},
+		[]string{"nasd.log", "EventLog.txt"})
+
+	bundle, err := openBundle(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bundle.Close()
+
+	if firmware := bundleFirmware(bundle); firmware != "4.1.2-8.95.93281" {
+		t.Errorf("Unexpected firmware version %q", firmware)
+	}
+	if dir, err := firmwareDir("4.1.2 beta/1"); dir != "4.1.2_beta_1" || err != nil {
+		t.Errorf("Unexpected firmware directory %q %v", dir, err)
+	}
+	for _, firmware := range []string{".", "..", "../.."} {
+		if dir, err := firmwareDir(firmware); err == nil && (dir == "." || dir == "..") {
+			t.Errorf("Firmware %q gives directory %q outside the symbol directory", firmware, dir)
+		}
+	}
+}
+
+// Event log filters are given as a severity name (or number) and a list of category numbers
+func TestParseEventFilter(t *testing.T) {
+	filter, err := parseEventFilter("warning", "3, 7")
+	if err != nil || filter.MinSeverity != 1 || len(filter.Categories) != 2 || filter.Categories[1] != 7 {
+		t.Errorf("Unexpected filter %+v %v", filter, err)
+	}
+	if filter, err := parseEventFilter("", ""); err != nil || !filter.All() {
+		t.Errorf("Empty filter %+v %v", filter, err)
+	}
+	if _, err := parseEventFilter("", "disk"); err == nil {
+		t.Errorf("Invalid category accepted")
+	}
+	if _, err := parseEventFilter("urgent", ""); err == nil {
+		t.Errorf("Invalid severity accepted")
+	}
+}
+
+// Build a binary event log file, with a header, and an event per text at increasing times
+func testEventLogFile(logType binary.BinaryType, start uint32, texts ...string) []byte {
+	var events []eventlogtest.Event
+	for index, text := range texts {
+		events = append(events, eventlogtest.NewEvent(start+uint32(index)*100, uint8(eventlog.SeverityError), 0, 0, text))
+	}
+	return eventlogtest.File(binary.BinaryHdr{HeaderVersion: binary.BinaryFile_HeaderVersion, DiagBinaryType: logType}, events)
+}
+
+// Decrypted zips contain a merged timeline of the event logs, which the web timeline page reads back
+func TestDecryptZipTimeline(t *testing.T) {
+	dir := t.TempDir()
+	zipFilename := filepath.Join(dir, "diags.zip")
+	writeTestZip(t, zipFilename, map[string][]byte{
+		"FlashLog.txt": testEventLogFile(binary.BinaryFile_FlashEventLog, 1000, "Drobo started", "Disk 1 failed"),
+		"EventLog.txt": testEventLogFile(binary.BinaryFile_DiskEventLog, 1100, "Disk 1 failed", "Disk 1 replaced"),
+	}, []string{"FlashLog.txt", "EventLog.txt"})
+
+	// The saved timeline has every event, whatever the event filter for the decodes
+	decryptFilename := filepath.Join(dir, "diags_d.zip")
+	filtered := DecryptOptions{Decode: binary.DecodeOptions{Events: binary.EventFilter{MinSeverity: uint8(eventlog.SeverityCritical)}}}
+	decryptZip(zipFilename, decryptFilename, FormatZip, filtered)
+
+	var timeline bytes.Buffer
+	_, err := decryptZipSpecificFile(decryptFilename, timelineTextFilename, &timeline, DecryptOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(timeline.String()), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[1], "[flash+disk]") || !strings.HasSuffix(lines[2], "Disk 1 replaced") {
+		t.Errorf("Unexpected timeline\n%s", timeline.String())
+	}
+
+	bundle, err := openBundle(decryptFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := readManifest(bundle)
+	bundle.Close()
+	if err != nil || manifest == nil || len(manifest.Generated) != 2 || manifest.Generated[0].Name != timelineTextFilename {
+		t.Errorf("Timeline not in manifest %+v %v", manifest, err)
+	}
+
+	for _, filename := range []string{zipFilename, decryptFilename} {
+		read, err := readTimeline(filename)
+		if err != nil || len(read.Events) != 3 || read.Events[1].SourceTag() != "flash+disk" {
+			t.Errorf("Unexpected timeline read from %s: %+v %v", filename, read, err)
+		}
+	}
+}
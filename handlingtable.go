@@ -0,0 +1,299 @@
+// handlingtable.go
+//
+// Copyright (c) 2016 Drobo Inc. All rights reserved
+//
+// The file handling table decides how each file within a diags zip is processed (decrypted, decoded, copied).
+//
+// The built-in table covers the files we know about, but new diag files appear with firmware releases, so the
+// table can be replaced by a JSON configuration file (-rules) without rebuilding. The effective table can be
+// printed with -printRules, which is also a good starting point for writing a configuration file. e.g.
+//
+// {
+//   "rules": [
+//     { "prefix": "VX", "actions": [ "decrypt" ] },
+//     { "glob": "*.bin", "actions": [ "copy", "decode" ], "rename": ".txt" },
+//     { "regex": "(?i)^nasd[0-9]*\\.log$", "actions": [ "copy" ] }
+//   ]
+// }
+//
+// Rules are tried in order, and the first rule that matches a file is used. Prefix and glob matches are case
+// insensitive, and match the file name without any directory or archive path (files can be within directories
+// or nested archives, e.g. DashboardLogs.zip/system.log). A regex is used as it is, so use (?i) for a case
+// insensitive match, and is matched against the whole path
+
+package main
+
+import (
+	"bytes"
+	"decryptDiags/binary"
+	"decryptDiags/binary/core"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Action
+//
+// An action applied to a file within the zip. Actions are applied in order as a pipeline, each acting on the
+// output of the previous action, so a file can be (for example) decrypted then decoded.
+// Additional action could be to create a CSV file
+type Action int
+
+const (
+	ActionCopy    Action = iota // Output the file as it is at this point in the pipeline
+	ActionDecrypt               // Decrypt the file
+	ActionDecode                // Decode a binary file to text; the output is renamed (by default with a .txt suffix)
+	ActionCore                  // Summarize a (compressed) ELF core dump as text; the output is renamed as for decode
+)
+
+var actionNames = []string{"copy", "decrypt", "decode", "core"}
+
+func (action Action) String() string {
+	if action < 0 || int(action) >= len(actionNames) {
+		return fmt.Sprintf("Action(%d)", int(action))
+	}
+	return actionNames[action]
+}
+
+// Actions are named in the configuration file
+func (action Action) MarshalText() ([]byte, error) {
+	if action < 0 || int(action) >= len(actionNames) {
+		return nil, fmt.Errorf("unknown action %d", int(action))
+	}
+	return []byte(actionNames[action]), nil
+}
+
+func (action *Action) UnmarshalText(text []byte) error {
+	for index, name := range actionNames {
+		if strings.EqualFold(name, string(text)) {
+			*action = Action(index)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown action %q", text)
+}
+
+// Suffix given to decoded files if the rule doesn't specify one
+const defaultDecodeSuffix = ".txt"
+
+// FileHandlingTable
+//
+// A rule in the handling table. Exactly one of Prefix, Glob or Regex is used to match the file name.
+// Rename replaces the suffix of the file name (from the first .) when it is decoded
+type FileHandlingTable struct {
+	Prefix  string   `json:"prefix,omitempty"`
+	Glob    string   `json:"glob,omitempty"`
+	Regex   string   `json:"regex,omitempty"`
+	Actions []Action `json:"actions"`
+	Rename  string   `json:"rename,omitempty"`
+
+	regex *regexp.Regexp
+}
+
+// Return the pattern used by the rule
+func (entry *FileHandlingTable) pattern() string {
+	switch {
+	case entry.Glob != "":
+		return entry.Glob
+	case entry.Regex != "":
+		return entry.Regex
+	}
+	return entry.Prefix
+}
+
+// Check the rule is usable, and compile any regex
+func (entry *FileHandlingTable) compile() error {
+	patterns := 0
+	for _, pattern := range []string{entry.Prefix, entry.Glob, entry.Regex} {
+		if pattern != "" {
+			patterns++
+		}
+	}
+	if patterns != 1 {
+		return fmt.Errorf("rule needs exactly one of prefix, glob or regex")
+	}
+
+	if len(entry.Actions) == 0 {
+		return fmt.Errorf("rule %q has no actions", entry.pattern())
+	}
+
+	if entry.Glob != "" {
+		if _, err := path.Match(entry.Glob, ""); err != nil {
+			return fmt.Errorf("rule %q: %v", entry.Glob, err)
+		}
+	}
+
+	if entry.Regex != "" {
+		regex, err := regexp.Compile(entry.Regex)
+		if err != nil {
+			return fmt.Errorf("rule %q: %v", entry.Regex, err)
+		}
+		entry.regex = regex
+	}
+	return nil
+}
+
+// Return true if the rule matches the file name
+func (entry *FileHandlingTable) match(name string) bool {
+	base := strings.ToUpper(path.Base(name))
+	switch {
+	case entry.Glob != "":
+		matched, _ := path.Match(strings.ToUpper(entry.Glob), base)
+		return matched
+	case entry.Regex != "":
+		return entry.regex != nil && entry.regex.MatchString(name)
+	}
+	return strings.HasPrefix(base, strings.ToUpper(entry.Prefix))
+}
+
+var handlingTable []FileHandlingTable
+
+// The built-in table; these are prefix searches only
+func init() {
+	handlingTable = []FileHandlingTable{
+		{Prefix: "VX", Actions: []Action{ActionDecrypt}},
+		{Prefix: "LXDMESG", Actions: []Action{ActionDecrypt}},
+		{Prefix: "DROBODIAG_", Actions: []Action{ActionDecrypt}},
+		{Prefix: "EVENTLOG", Actions: []Action{ActionDecode}},
+		{Prefix: "DISKLOG", Actions: []Action{ActionDecode}},
+		{Prefix: "FLASHLOG", Actions: []Action{ActionDecode}},
+		// Keep the original binary file as well as the decoded version, so it can be processed further in future
+		{Prefix: "PERFLOG", Actions: []Action{ActionCopy, ActionDecode}},
+		{Prefix: "ZONETABLE", Actions: []Action{ActionCopy, ActionDecode}},
+		// Keep the core for gdb, as well as a summary of its threads and memory
+		{Prefix: "RTPCORE", Actions: []Action{ActionCopy, ActionCore}},
+	}
+}
+
+// Layout of the handling table configuration file
+type handlingConfig struct {
+	Rules []FileHandlingTable `json:"rules"`
+}
+
+// readHandlingTable
+//
+// Read and check a handling table configuration
+func readHandlingTable(reader io.Reader) ([]FileHandlingTable, error) {
+	var config handlingConfig
+
+	decoder := json.NewDecoder(reader)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&config)
+	if err != nil {
+		return nil, err
+	}
+
+	for index := range config.Rules {
+		err = config.Rules[index].compile()
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %v", index+1, err)
+		}
+	}
+	return config.Rules, nil
+}
+
+// loadHandlingTable
+//
+// Replace the built-in handling table with the rules in a configuration file
+func loadHandlingTable(filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	rules, err := readHandlingTable(file)
+	if err != nil {
+		return fmt.Errorf("%s: %v", filename, err)
+	}
+
+	handlingTable = rules
+	return nil
+}
+
+// printHandlingTable
+//
+// Write the effective handling table, in the configuration file format
+func printHandlingTable(writer io.Writer) error {
+	data, err := json.MarshalIndent(handlingConfig{handlingTable}, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(writer, string(data))
+	return err
+}
+
+// Number of bytes from the start of a member passed to classifyMember
+const classifyHeadLength = 64
+
+// ProcessingPlan
+//
+// How a file within the zip is processed; the actions to apply, and the handling table rule which chose them
+type ProcessingPlan struct {
+	Rule    string // Pattern of the matching handling table rule; empty if no rule matched
+	Actions []Action
+	Rename  string // Suffix given to the file when it is decoded
+}
+
+// Return true if the plan transforms the file, rather than just copying it
+func (plan ProcessingPlan) Transforms() bool {
+	for _, action := range plan.Actions {
+		if action != ActionCopy {
+			return true
+		}
+	}
+	return false
+}
+
+// Return true if the plan includes the action
+func (plan ProcessingPlan) has(action Action) bool {
+	for _, planned := range plan.Actions {
+		if planned == action {
+			return true
+		}
+	}
+	return false
+}
+
+// Return true if the plan is for a binary diag file, which is decoded without being decrypted first
+func (plan ProcessingPlan) binaryDiag() bool {
+	return plan.has(ActionDecode) && !plan.has(ActionDecrypt)
+}
+
+// Return the name of the file once it has been decoded (or summarized)
+func (plan ProcessingPlan) decodedName(name string) string {
+	suffix := plan.Rename
+	if suffix == "" {
+		suffix = defaultDecodeSuffix
+	}
+	dir, base := path.Split(name)
+	return dir + strings.Split(base, ".")[0] + suffix
+}
+
+// classifyMember
+//
+// Work out how to process a file within the zip. This is the single place that decides what to do with a file;
+// both the zip decrypt and the web view of a single file use it.
+//
+// The name is looked up in the handling table. Anything we don't recognize is simply copied. If head (the first
+// bytes of the file) is supplied, files which have already been decrypted or decoded are recognized from their
+// content and copied as they are
+func classifyMember(name string, head []byte) ProcessingPlan {
+	if bytes.HasPrefix(head, []byte(decryptedString)) || bytes.HasPrefix(head, []byte(binary.DecodeBanner)) ||
+		bytes.HasPrefix(head, []byte(core.SummaryBanner)) {
+		return ProcessingPlan{Actions: []Action{ActionCopy}}
+	}
+
+	for index := range handlingTable {
+		entry := &handlingTable[index]
+		if entry.match(name) {
+			return ProcessingPlan{Rule: entry.pattern(), Actions: entry.Actions, Rename: entry.Rename}
+		}
+	}
+
+	return ProcessingPlan{Actions: []Action{ActionCopy}}
+}
@@ -0,0 +1,71 @@
+// eventlogtest.go
+//
+// Copyright (c) 2016 Drobo Inc. All rights reserved
+//
+// Event log fixtures for tests. The event log tests (binary/eventlog) and the bundle tests (main) build their
+// event logs here, so a change to the event log layout is only made in one place. The layout is the 6.2.5 stream
+// (see binary/eventlog/layout.go); the event log header, followed by an entry per event
+
+package eventlogtest
+
+import (
+	"bytes"
+	binDecode "decryptDiags/binary"
+	"encoding/binary"
+)
+
+// Layout of the event log header and entries, as binary/eventlog eventLogHdr and eventLogRecord
+type eventLogHdr struct {
+	NumEntries      uint32
+	UnsafeBootCount uint32
+	SoftwareVersion [60]byte
+	PackVer         uint32
+}
+
+type eventLogRecord struct {
+	Timestamp uint32
+	MessageID uint32
+	EventText [120]byte
+}
+
+// Event is an event in a test event log
+type Event struct {
+	Timestamp uint32
+	Severity  uint8
+	Category  uint8
+	Template  uint16
+	Text      string
+}
+
+func NewEvent(timestamp uint32, severity uint8, category uint8, template uint16, text string) Event {
+	return Event{Timestamp: timestamp, Severity: severity, Category: category, Template: template, Text: text}
+}
+
+// Payload
+//
+// Build an event log payload, in the byte order given; the header, with the number of events, and the events
+func Payload(byteOrder binary.ByteOrder, events []Event) []byte {
+	var payload bytes.Buffer
+	header := eventLogHdr{NumEntries: uint32(len(events)), PackVer: 3<<16 | 1}
+	copy(header.SoftwareVersion[:], "4.1.2")
+	binary.Write(&payload, byteOrder, header)
+
+	for _, event := range events {
+		rec := eventLogRecord{Timestamp: event.Timestamp,
+			MessageID: uint32(event.Severity)<<24 | uint32(event.Category)<<16 | uint32(event.Template)}
+		copy(rec.EventText[:], event.Text)
+		binary.Write(&payload, byteOrder, rec)
+	}
+	return payload.Bytes()
+}
+
+// File
+//
+// Build an event log binary file; the header given (in network byte order), followed by the payload in the
+// endianness of the header
+func File(header binDecode.BinaryHdr, events []Event) []byte {
+	var file bytes.Buffer
+	binary.Write(&file, binary.BigEndian, header)
+	file.Write(Payload(header.Endianness.ByteOrder(), events))
+	return file.Bytes()
+}
@@ -0,0 +1,151 @@
+// manifest.go
+//
+// Copyright (c) 2016 Drobo Inc. All rights reserved
+//
+// Every decrypted zip contains a manifest (manifest.json) describing how it was generated; for each file in the
+// original zip, the encryption scheme found, the actions applied, the files generated from it, their sizes and
+// SHA-256 checksums, and any corruption found while decrypting. Downstream tools (and the web server) can use the
+// manifest to see how a decrypted zip was generated without having to process the original again
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"time"
+)
+
+// Name of the manifest within a decrypted zip
+const manifestFilename = "manifest.json"
+
+// Manifest
+//
+// Description of a decrypted zip
+type Manifest struct {
+	Version string          `json:"version"` // Version of decryptDiags which generated the zip
+	Source  string          `json:"source"`  // The original zip
+	Files   []ManifestEntry `json:"files"`
+
+	Generated []ManifestOutput `json:"generated,omitempty"` // Files generated from the whole zip, e.g. the event timeline
+}
+
+// ManifestEntry
+//
+// How a file in the original zip was processed
+type ManifestEntry struct {
+	Name            string           `json:"name"`
+	Size            int64            `json:"size"`
+	SHA256          string           `json:"sha256"`
+	Scheme          EncryptionScheme `json:"scheme"`
+	Rule            string           `json:"rule,omitempty"`
+	Actions         []Action         `json:"actions"`
+	Outputs         []ManifestOutput `json:"outputs"`
+	CorruptedBytes  int              `json:"corruptedBytes"`
+	CorruptedRanges int              `json:"corruptedRanges"`
+	Resyncs         int              `json:"resyncs"`
+	Error           string           `json:"error,omitempty"`
+}
+
+// ManifestOutput
+//
+// A file in the decrypted zip
+type ManifestOutput struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Add the corruption found by a decrypt to the entry
+func (entry *ManifestEntry) addReport(report *DecryptReport) {
+	if report.Scheme != Unencrypted {
+		entry.Scheme = report.Scheme
+	}
+	entry.CorruptedBytes += report.CorruptedBytes()
+	entry.CorruptedRanges += len(report.Corrupted)
+	entry.Resyncs += len(report.Resyncs)
+}
+
+// digest calculates the size and SHA-256 of the data written to it
+type digest struct {
+	hash hash.Hash
+	size int64
+}
+
+func newDigest() *digest {
+	return &digest{hash: sha256.New()}
+}
+
+func (d *digest) Write(p []byte) (int, error) {
+	d.size += int64(len(p))
+	return d.hash.Write(p)
+}
+
+func (d *digest) Sum() string {
+	return hex.EncodeToString(d.hash.Sum(nil))
+}
+
+// writeManifest
+//
+// Add the manifest to a decrypted bundle
+func writeManifest(archive BundleWriter, manifest *Manifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	return archive.Add(manifestFilename, time.Now(), int64(len(data)), bytes.NewReader(data))
+}
+
+// readManifest
+//
+// Read the manifest from a bundle; returns nil if the bundle doesn't have one
+func readManifest(bundle Bundle) (*Manifest, error) {
+	for _, f := range bundle.Members() {
+		if f.Name() != manifestFilename {
+			continue
+		}
+
+		reader, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+
+		var manifest Manifest
+		err = json.NewDecoder(io.LimitReader(reader, 64<<20)).Decode(&manifest)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", manifestFilename, err)
+		}
+		return &manifest, nil
+	}
+	return nil, nil
+}
+
+// describes
+//
+// Return true if the manifest describes the bundle; every file in the bundle, other than the manifest, is an output
+// listed in the manifest
+func (manifest *Manifest) describes(bundle Bundle) bool {
+	outputs := map[string]bool{}
+	for _, entry := range manifest.Files {
+		for _, output := range entry.Outputs {
+			outputs[output.Name] = true
+		}
+	}
+	for _, output := range manifest.Generated {
+		outputs[output.Name] = true
+	}
+
+	for _, f := range bundle.Members() {
+		if f.Name() != manifestFilename && !outputs[f.Name()] {
+			return false
+		}
+	}
+	return len(outputs) > 0
+}
@@ -0,0 +1,194 @@
+// recovery.go
+//
+// Copyright (c) 2016 Drobo Inc. All rights reserved
+//
+// Heroic recovery of badly corrupted v2 diags
+//
+// The standard resync in decrypt.go looks for the first keystream position which decrypts a short window without
+// any top-bit-set characters, and gives up on recovery entirely after maxRecoveryAttempt failures. That works for
+// the occasional corruption, but badly damaged diags need more effort.
+//
+// Heroic recovery:
+//
+// a) never disables recovery, although it backs off for a while after a failed resync so we don't spend forever
+//    re-searching the keystream on every byte of a damaged section
+// b) searches the keystream in order of likelihood - first close to where we expected to be, then at offsets which
+//    follow the ~32727 byte block pattern we see on the Drobo (see OTHER NOTES in decryptDiags.go), then a much
+//    broader linear scan than the standard resync
+// c) scores each candidate alignment by how much of a larger window decrypts to printable text, rather than
+//    requiring a perfect run, as genuine diags can contain the odd non-printable character
+// d) reports each recovered region with the confidence (score) of the alignment used
+
+package main
+
+// Size of the window scored for each candidate keystream alignment
+const heroicWindow int = 128
+
+// Observed block size at which the keystream loses sync
+const heroicBlockSize int = 32727
+
+// Number of blocks either side of the expected keystream position to try
+const heroicBlockMultiples int = 32
+
+// Distance either side of a likely keystream position to search
+const heroicNearSearch int = 64
+
+// Length of the final broad linear scan of the keystream
+const heroicRecoverySteps int = maxRecoverySteps * 4
+
+// Minimum score for a candidate alignment to be accepted, and the score at which we stop looking further
+const heroicMinConfidence float64 = 0.9
+const heroicAcceptConfidence float64 = 0.99
+
+// Maximum backoff (as a shift of heroicWindow) after repeated failed resyncs
+const heroicMaxBackoffShift uint = 9
+
+// RecoveredRegion describes a region decrypted after a heroic resync, and the confidence in the alignment used
+type RecoveredRegion struct {
+	Offset     int
+	Length     int
+	KeyIndex   int     // Keystream position used to decrypt the region
+	Confidence float64 // Fraction of the scored window which decrypted to printable text
+}
+
+// seedAt
+//
+// Return the v2 seed positioned at keystream index (i.e. ready to decrypt byte index of an unbroken stream).
+// Each byte uses two RAND32 steps; rather than stepping the generator we use the standard LCG jump-ahead, composing
+// the generator with itself by repeated squaring
+func seedAt(index int) uint32 {
+	mult, add := rand32Mult, rand32Add
+	accMult, accAdd := uint32(1), uint32(0)
+
+	for n := uint64(index) * 2; n > 0; n >>= 1 {
+		if n&1 == 1 {
+			accMult, accAdd = mult*accMult, mult*accAdd+add
+		}
+		mult, add = mult*mult, (mult+1)*add
+	}
+
+	return accMult*v2Seed + accAdd
+}
+
+func isPrintable(b byte) bool {
+	return b == '\n' || b == '\r' || b == '\t' || (b >= 0x20 && b < 0x7f)
+}
+
+// scoreAlignment
+//
+// Decrypt the window using the seed and return the fraction of printable characters, along with the decrypted
+// first byte. Scoring gives up early once the candidate can't reach heroicMinConfidence
+func scoreAlignment(window []byte, seed uint32) (float64, byte) {
+	allowedBad := int((1 - heroicMinConfidence) * float64(len(window)))
+	bad := 0
+	var first byte
+
+	for i, c := range window {
+		var xorVal uint8 = keyByte(&seed)
+		var rotVal uint8 = keyByte(&seed)
+
+		decryptByte := RotateLeft(c, rotVal) ^ xorVal
+		if i == 0 {
+			first = decryptByte
+		}
+		if !isPrintable(decryptByte) {
+			bad++
+			if bad > allowedBad {
+				return 0, first
+			}
+		}
+	}
+
+	return float64(len(window)-bad) / float64(len(window)), first
+}
+
+// heroicSearch tracks the best candidate alignment found so far
+type heroicSearch struct {
+	window    []byte
+	bestIndex int
+	bestScore float64
+	bestFirst byte
+}
+
+// Score count candidates starting at keystream index start. Returns true once a candidate is good enough to stop
+func (h *heroicSearch) scan(start int, count int) bool {
+	if start < 0 {
+		count += start
+		start = 0
+	}
+	if count <= 0 {
+		return false
+	}
+
+	seed := seedAt(start)
+	for index := start; index < start+count; index++ {
+		score, first := scoreAlignment(h.window, seed)
+		if score > h.bestScore {
+			h.bestIndex, h.bestScore, h.bestFirst = index, score, first
+			if score >= heroicAcceptConfidence {
+				return true
+			}
+		}
+		keyByte(&seed)
+		keyByte(&seed)
+	}
+	return false
+}
+
+// resyncHeroic
+//
+// Heroic counterpart to resyncV2. window[0] is the corrupted byte; the decrypted value (or ERROR_INDICATOR) is
+// returned
+func (d *decryptReader) resyncHeroic(window []byte) byte {
+	corruptOffset := d.offset
+	expected := d.keyIndex - 1
+
+	d.closeRecoveredRegion()
+	d.report.markCorrupt(corruptOffset)
+
+	search := heroicSearch{window: window}
+
+	found := search.scan(expected-heroicNearSearch, heroicNearSearch*2+1)
+
+	// Try the block pattern - both relative to where we are, and from the start of the keystream
+	for m := 1; m <= heroicBlockMultiples && !found; m++ {
+		found = search.scan(expected+m*heroicBlockSize-heroicNearSearch, heroicNearSearch*2+1) ||
+			search.scan(expected-m*heroicBlockSize-heroicNearSearch, heroicNearSearch*2+1) ||
+			search.scan(m*heroicBlockSize-heroicNearSearch, heroicNearSearch*2+1)
+	}
+
+	if !found {
+		search.scan(0, heroicRecoverySteps)
+	}
+
+	if search.bestScore < heroicMinConfidence {
+		// Leave the keystream where it was, and back off for longer each time we fail in succession
+		d.report.FailedResyncs++
+		d.heroicFailures++
+		shift := uint(d.heroicFailures)
+		if shift > heroicMaxBackoffShift {
+			shift = heroicMaxBackoffShift
+		}
+		d.heroicBackoff = heroicWindow << shift
+		return ERROR_INDICATOR
+	}
+
+	d.heroicFailures = 0
+	d.report.Resyncs = append(d.report.Resyncs, ResyncEvent{corruptOffset, search.bestIndex})
+	d.report.Recovered = append(d.report.Recovered, RecoveredRegion{corruptOffset, 0, search.bestIndex, search.bestScore})
+
+	d.seed = seedAt(search.bestIndex + 1)
+	d.keyIndex = search.bestIndex + 1
+
+	if !isPrintable(search.bestFirst) {
+		return ERROR_INDICATOR
+	}
+	return search.bestFirst
+}
+
+// Complete the length of the most recent recovered region, which runs up to the current offset
+func (d *decryptReader) closeRecoveredRegion() {
+	if n := len(d.report.Recovered); n > 0 && d.report.Recovered[n-1].Length == 0 {
+		d.report.Recovered[n-1].Length = d.offset - d.report.Recovered[n-1].Offset
+	}
+}
@@ -0,0 +1,210 @@
+// timeline.go
+//
+// Copyright (c) 2016 Drobo Inc. All rights reserved
+//
+// A merged timeline of the flash, disk and cached event logs in a bundle (see binary/eventlog/timeline.go).
+//
+// The event logs are replaced by their decodes when a bundle is decrypted, so the timeline is generated then, and
+// added to the decrypted bundle as text and JSON (EventTimeline.txt and EventTimeline.json). The web timeline page
+// shows it as a table; from the JSON in a decrypted bundle, or from the event logs in a bundle which hasn't been
+// decrypted
+
+package main
+
+import (
+	"bytes"
+	"decryptDiags/binary"
+	"decryptDiags/binary/eventlog"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"text/template"
+	"time"
+)
+
+// Names of the timeline within a decrypted bundle
+const (
+	timelineTextFilename = "EventTimeline.txt"
+	timelineJSONFilename = "EventTimeline.json"
+)
+
+const HTML_TIMELINE_FILE = "timeline.html"
+
+// Return true if the member is a timeline from a previous decrypt
+func isTimelineFilename(name string) bool {
+	return name == timelineTextFilename || name == timelineJSONFilename
+}
+
+// bundleTimeline
+//
+// Merge the event logs in a bundle into a timeline. Files which aren't valid event logs are left out, and a
+// truncated event log adds the events before the truncation
+func bundleTimeline(bundle Bundle) *eventlog.Timeline {
+	timeline := &eventlog.Timeline{}
+
+	for _, f := range bundle.Members() {
+		if !classifyMember(f.Name(), nil).binaryDiag() {
+			continue
+		}
+
+		reader, err := f.Open()
+		if err != nil {
+			continue
+		}
+		header, err := binary.ReadHeader(reader)
+		if err != nil || !eventlog.IsEventLog(header.DiagBinaryType) || header.Validate() != nil {
+			reader.Close()
+			continue
+		}
+
+		var payload io.Reader = reader
+		if header.ImageSize != 0 {
+			payload = io.LimitReader(reader, int64(header.ImageSize))
+		}
+		events, err := eventlog.ReadLog(header, payload)
+		reader.Close()
+		if err != nil {
+			log.Println("Timeline of", f.Name(), "incomplete:", err)
+		}
+		if events != nil {
+			timeline.Add(events)
+		}
+	}
+	return timeline
+}
+
+// writeTimeline
+//
+// Add the timeline to a decrypted bundle, as text and JSON. Every event is saved, whatever the event filter for the
+// decodes, as the saved timeline is read back as the whole timeline; filters are applied when it is shown. Returns
+// the files added, for the manifest
+func writeTimeline(archive BundleWriter, timeline *eventlog.Timeline) ([]ManifestOutput, error) {
+	var outputs []ManifestOutput
+
+	formats := []struct {
+		name  string
+		write func(io.Writer, binary.EventFilter) error
+	}{
+		{timelineTextFilename, timeline.WriteText},
+		{timelineJSONFilename, timeline.WriteJSON},
+	}
+	for _, format := range formats {
+		var data bytes.Buffer
+		err := format.write(&data, binary.EventFilter{})
+		if err != nil {
+			return outputs, err
+		}
+
+		digest := newDigest()
+		digest.Write(data.Bytes())
+		err = archive.Add(format.name, time.Now(), int64(data.Len()), &data)
+		if err != nil {
+			return outputs, err
+		}
+		outputs = append(outputs, ManifestOutput{format.name, digest.size, digest.Sum()})
+	}
+	return outputs, nil
+}
+
+// readTimeline
+//
+// Read the timeline of a zipfile (or other bundle); from the JSON timeline in a decrypted bundle, or from the
+// event logs in one which hasn't been decrypted
+func readTimeline(zipFilename string) (*eventlog.Timeline, error) {
+	bundle, err := openSharedBundle(zipFilename)
+	if err != nil {
+		return nil, err
+	}
+	defer bundle.Close()
+
+	if !isDecryptedBundle(bundle) {
+		return bundleTimeline(bundle), nil
+	}
+
+	for _, f := range bundle.Members() {
+		if f.Name() != timelineJSONFilename {
+			continue
+		}
+
+		reader, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		return eventlog.ReadTimelineJSON(reader)
+	}
+	return &eventlog.Timeline{}, nil
+}
+
+// An event on the web timeline page
+type timelineRow struct {
+	eventlog.TimelineEvent
+	Class string // Bootstrap row class, highlighting the more severe events
+}
+
+// Data passed to the timeline page template
+type timelinePage struct {
+	ZipFilepath string
+	ZipFilename string
+	Rows        []timelineRow
+	Total       int // Events in the timeline, before filtering
+	Severity    string
+	Category    string
+	Severities  []string
+	Query       string // Filter query, for the links to the text and JSON timelines
+}
+
+// timelineHandler
+//
+// Serve the event timeline of a zip; as a table, or as text or JSON with format=text or format=json. The events
+// can be filtered by severity and category, as on the display page
+func timelineHandler(w http.ResponseWriter, req *http.Request) {
+	_, filename := GetActionAndFilename(req)
+
+	timeline, err := readTimeline(filename)
+	if err != nil {
+		log.Println("Failed to read timeline", filename, err)
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	filter := webDecryptOptions(req).Decode.Events
+
+	switch req.FormValue("format") {
+	case "text":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		timeline.WriteText(w, filter)
+		return
+	case "json":
+		w.Header().Set("Content-Type", "application/json")
+		timeline.WriteJSON(w, filter)
+		return
+	}
+
+	page := timelinePage{ZipFilepath: filename, ZipFilename: filepath.Base(filename), Total: len(timeline.Events),
+		Severity: req.FormValue("severity"), Category: req.FormValue("category")}
+	for _, severity := range eventlog.Severities() {
+		page.Severities = append(page.Severities, severity.String())
+	}
+	if page.Severity != "" || page.Category != "" {
+		page.Query = "&" + url.Values{"severity": {page.Severity}, "category": {page.Category}}.Encode()
+	}
+
+	for _, event := range timeline.Filtered(filter) {
+		row := timelineRow{TimelineEvent: event}
+		switch {
+		case event.Severity() >= eventlog.SeverityError:
+			row.Class = "danger"
+		case event.Severity() == eventlog.SeverityWarning:
+			row.Class = "warning"
+		}
+		page.Rows = append(page.Rows, row)
+	}
+
+	output := template.Must(template.ParseFiles(filepath.Join(HTML_TEMPLATES_DIR, HTML_TIMELINE_FILE)))
+	if err := output.Execute(w, page); err != nil {
+		fmt.Println("template generation failed", err)
+	}
+}
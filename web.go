@@ -34,6 +34,9 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"decryptDiags/binary"
+	"decryptDiags/binary/eventlog"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -41,6 +44,7 @@ import (
 	"mime"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
 	"sort"
 	"strconv"
@@ -98,10 +102,56 @@ type webPageInfo struct {
 	Path        string
 	Dirlist     fileDateOrder
 	Filelist    []string
+	Entries     []zipEntry // Filelist, as the entries in the directory (or nested archive) being browsed
+	Dir         string     // Directory (or nested archive) within the zip being browsed
+	ParentDir   string     // Directory containing Dir
 	Version     string
 	UploadDir   string
 	JiraCookie  JIRA_LOGIN_STATE
 	JiraBugID   string
+	Report      *DecryptReport // Decrypt integrity report; nil if the file wasn't decrypted
+	Binary      bool           // Filename is a binary diag file, which can have its events filtered
+	Severity    string         // Event filter; minimum severity
+	Severities  []string       // Names of the severities which can be filtered on
+	Category    string         // Event filter; categories
+	Format      string         // Decode format of a binary diag file
+	Formats     []string       // Names of the decode formats
+}
+
+// An entry in the zip listing; a file, or a directory or nested archive which can be browsed
+type zipEntry struct {
+	Name   string // Name within the directory being browsed
+	Path   string // Full path within the zip
+	Folder bool
+	Core   bool // A core dump, with a backtrace page
+	Binary bool // A binary diag file, with a header page
+}
+
+// zipListing
+//
+// Generate the entries for browsing a directory (or nested archive, e.g. DashboardLogs.zip/) within a zip
+func zipListing(filelist []string, dir string) []zipEntry {
+	var entries []zipEntry
+	folders := map[string]bool{}
+
+	for _, name := range filelist {
+		if !strings.HasPrefix(name, dir) {
+			continue
+		}
+		rest := strings.TrimPrefix(name, dir)
+
+		if slash := strings.Index(rest, "/"); slash >= 0 {
+			folder := rest[:slash]
+			if !folders[folder] {
+				folders[folder] = true
+				entries = append(entries, zipEntry{folder, dir + folder + "/", true, false, false})
+			}
+			continue
+		}
+		plan := classifyMember(name, nil)
+		entries = append(entries, zipEntry{rest, name, false, plan.has(ActionCore), plan.binaryDiag()})
+	}
+	return entries
 }
 
 func GetActionAndFilename(r *http.Request) (action string, filename string) {
@@ -132,6 +182,104 @@ func GetActionAndFilename(r *http.Request) (action string, filename string) {
 	return action, filename
 }
 
+// Decrypt options for a request; heroic recovery can be selected on upload or when viewing a file, the firmware
+// version used to find core dump symbols can be given when viewing a backtrace, and event logs can be filtered by
+// severity and category, and binary diag files decoded as JSON lines or CSV (decodeFormat), when viewing them.
+// An invalid filter or format is ignored
+func webDecryptOptions(r *http.Request) DecryptOptions {
+	opts := DecryptOptions{Heroic: r.FormValue("heroic") != "", SymbolDir: symbolDir, Firmware: firmwareVersion}
+	if firmware := r.FormValue("firmware"); firmware != "" {
+		opts.Firmware = firmware
+	}
+
+	events, err := parseEventFilter(r.FormValue("severity"), r.FormValue("category"))
+	if err != nil {
+		log.Println("Ignoring event filter:", err)
+	} else {
+		opts.Decode.Events = events
+	}
+
+	format, err := binary.ParseFormat(r.FormValue("decodeFormat"))
+	if err != nil {
+		log.Println("Ignoring decode format:", err)
+	} else {
+		opts.Decode.Format = format
+	}
+	return opts
+}
+
+// webBundleFile
+//
+// Split a request for a file within a bundle into the bundle path and the name of the file within it. Links from
+// the zip page name the file with a file query parameter, as directories and tar files don't have a .zip suffix
+// to split the path on; older links simply append the file to the zip path
+func webBundleFile(r *http.Request, filename string) (bundlePath string, bundleName string, member string) {
+	bundlePath = filename
+	member = r.FormValue("file")
+	if member == "" {
+		segments := strings.SplitAfterN(filename, ".zip", 2)
+		bundlePath = segments[0]
+		if len(segments) > 1 {
+			member = strings.TrimPrefix(segments[1], string(os.PathSeparator))
+		}
+	}
+
+	return bundlePath, filepath.Base(bundlePath), member
+}
+
+// Format of the decrypted version of an upload; the same as the upload unless another format is chosen.
+// Only file formats are offered, as the web server works with the files in the upload directory
+func webBundleFormat(r *http.Request, uploaded string) (BundleFormat, error) {
+	format, err := detectBundleFormat(uploaded)
+	if err != nil {
+		return format, err
+	}
+	format = format.outputFormat()
+	if name := r.FormValue("format"); name != "" {
+		format, err = parseBundleFormat(name)
+		if err == nil && format == FormatDir {
+			err = fmt.Errorf("diags can't be decrypted to a directory by the web server")
+		}
+	}
+	return format, err
+}
+
+// bundleHeader
+//
+// Return the header of a binary diag file within a zipfile (or other bundle) as JSON. In a decrypted bundle, the
+// binary file has been replaced by its decode, which gives the header
+func bundleHeader(zipFilename string, filename string) ([]byte, error) {
+	bundle, err := openSharedBundle(zipFilename)
+	if err != nil {
+		return nil, err
+	}
+	defer bundle.Close()
+
+	for _, f := range bundle.Members() {
+		if f.Name() != filename {
+			continue
+		}
+
+		reader, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+
+		buffered := bufio.NewReader(reader)
+		if head, _ := buffered.Peek(len(binary.DecodeBanner)); string(head) == binary.DecodeBanner {
+			return binary.DecodedHeader(buffered)
+		}
+
+		header, err := binary.ReadHeader(buffered)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(header)
+	}
+	return nil, fmt.Errorf("%s not found in %s", filename, zipFilename)
+}
+
 var styleList []string
 
 //var styleList []os.FileInfo
@@ -185,8 +333,6 @@ func (t *templateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 		// Open the file file and get the filelist
 
-		// Should we handle already decrypted files somehow? A flag, or just use the _d in the name?
-
 		var err error
 		webpage.Filelist, err = decryptZipFilelist(filename)
 		if err != nil {
@@ -198,6 +344,11 @@ func (t *templateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		//		log.Println("zipfile", filename, "contains", webpage.Filelist)
 
 		webpage.Filename = filename
+		webpage.Dir = r.FormValue("dir")
+		webpage.Entries = zipListing(webpage.Filelist, webpage.Dir)
+		if parent := path.Dir(strings.TrimSuffix(webpage.Dir, "/")); parent != "." {
+			webpage.ParentDir = parent + "/"
+		}
 
 	case "del":
 		log.Println("del case")
@@ -265,21 +416,31 @@ func (t *templateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		decryptWriter := bufio.NewWriter(&webpage.Body)
 
 		// split filename into zip file name, and file within the zip
-		segments := strings.SplitAfter(filename, ".zip")
+		webpage.ZipFilepath, webpage.ZipFilename, webpage.Filename = webBundleFile(r, filename)
 
-		//		log.Println("segments", segments)
+		// decryptZipSpecificFile recognizes zips we've already decrypted from their content
 
-		webpage.ZipFilepath = segments[0]
-		filesplit := strings.Split(segments[0], string(os.PathSeparator))
+		webpage.Report, _ = decryptZipSpecificFile(webpage.ZipFilepath, webpage.Filename, decryptWriter, webDecryptOptions(r))
+		webpage.Binary = classifyMember(webpage.Filename, nil).binaryDiag()
+		webpage.Severity, webpage.Category = r.FormValue("severity"), r.FormValue("category")
+		webpage.Format, webpage.Formats = r.FormValue("decodeFormat"), binary.Formats()
+		for _, severity := range eventlog.Severities() {
+			webpage.Severities = append(webpage.Severities, severity.String())
+		}
+		decryptWriter.Flush()
+		//		w.Header().Set("Content-Type", "text/plain")
 
-		webpage.ZipFilename = filesplit[len(filesplit)-1] // Get the zip filename without path
-		webpage.Filename = strings.TrimPrefix(segments[1], string(os.PathSeparator))
+	case "backtrace":
+		log.Println("backtrace case")
 
-		// Should we handle already decrypted files somehow? A flag, or just use the _d in the name?
-		// Right now decryptZipSpecificFile looks at the filename for _d
+		// Backtraces of the threads in a core dump within a zip
+		webpage.ZipFilepath, webpage.ZipFilename, webpage.Filename = webBundleFile(r, filename)
 
-		decryptZipSpecificFile(webpage.ZipFilepath, webpage.Filename, decryptWriter)
-		//		w.Header().Set("Content-Type", "text/plain")
+		err := coreBacktrace(webpage.ZipFilepath, webpage.Filename, &webpage.Body, webDecryptOptions(r))
+		if err != nil {
+			log.Println("Failed to generate backtrace", webpage.Filename, err)
+			fmt.Fprintln(&webpage.Body, "Unable to generate backtrace:", err)
+		}
 
 	case "":
 		log.Println("empty case - i.e. /")
@@ -361,7 +522,7 @@ func (t *templateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 		// Decrypt directly to the http response ioWriter
 
-		decryptFile(reader, decryptWriter)
+		decryptFile(reader, decryptWriter, webDecryptOptions(r))
 		// Make sure we close the writer, or the reader will never complete
 
 		//	reader.Close()
@@ -399,6 +560,29 @@ func (t *templateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 // As a first pass, we'll capture the filename and pass that to /decryptzip
 // Later we can injest and cache locally (ideally in memory)
 
+// headerHandler
+//
+// Serve the header of a binary diag file within a zip as JSON, with the platform, type etc. by name
+func headerHandler(w http.ResponseWriter, req *http.Request) {
+	_, filename := GetActionAndFilename(req)
+	zipFilepath, _, member := webBundleFile(req, filename)
+
+	header, err := bundleHeader(zipFilepath, member)
+	if err != nil {
+		log.Println("Failed to read header", member, err)
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, header, "", "  "); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	indented.WriteTo(w)
+}
+
 func uploaderHandler(w http.ResponseWriter, req *http.Request) {
 	file, header, err := req.FormFile("zipFile")
 	if err != nil {
@@ -435,12 +619,33 @@ func uploaderHandler(w http.ResponseWriter, req *http.Request) {
 	// Now decrypt - with some refactoring, we could probably do the load and decrypt as a single operation
 
 	filename := filepath.Join(uploadDir, header.Filename)
-	var decryptFileSplit []string = strings.Split(filename, ".")
-	decryptFileSplit[0] += "_d"
-	var decryptFilename string = strings.Join(decryptFileSplit, ".")
 
-	log.Println("decrypt to", decryptFilename)
-	decryptZip(tmpFile.Name(), decryptFilename)
+	decrypted, err := bundleIsDecrypted(tmpFile.Name())
+	if err != nil {
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	var decryptFilename string
+	if decrypted {
+		// A zip we've already decrypted is kept as it is, whatever it is called
+		decryptFilename = filename
+		log.Println("already decrypted, keeping as", decryptFilename)
+		if err := os.Rename(tmpFile.Name(), decryptFilename); err != nil {
+			io.WriteString(w, err.Error())
+			return
+		}
+	} else {
+		format, err := webBundleFormat(req, tmpFile.Name())
+		if err != nil {
+			io.WriteString(w, err.Error())
+			return
+		}
+		decryptFilename = decryptedBundleName(filename, format)
+
+		log.Println("decrypt to", decryptFilename)
+		decryptZip(tmpFile.Name(), decryptFilename, format, webDecryptOptions(req))
+	}
 
 	// Now redirect to the decryptzip page with the uploaded file
 
@@ -453,8 +658,6 @@ func uploaderHandler(w http.ResponseWriter, req *http.Request) {
 	// Work out path to file, and send to the zip handler
 	// We do the join this way because we only want the separator between the cwd and the filename to be OS specific
 
-	// Indicate somehow that we've already decrypted this file
-
 	log.Println("Redirect to", "/zip/"+absPath)
 	http.Redirect(w, req, "/zip/"+absPath, http.StatusFound)
 
@@ -497,8 +700,11 @@ func createWebServer() {
 	http.Handle("/about/", &templateHandler{filename: HTML_ABOUT_FILE})
 	http.Handle("/zip/", &templateHandler{filename: HTML_ZIP_FILE})
 	http.Handle("/decryptzip/", &templateHandler{filename: HTML_DISPLAY_FILE})
+	http.Handle("/backtrace/", &templateHandler{filename: HTML_DISPLAY_FILE})
 
 	http.HandleFunc("/uploader", uploaderHandler)
+	http.HandleFunc("/header/", headerHandler)
+	http.HandleFunc("/timeline/", timelineHandler)
 	http.HandleFunc("/jiralogin", jiraloginHandler)
 	http.HandleFunc("/jira/", jirapostHandler)
 	http.HandleFunc("/decryptziphtml/", fileGenerateHtmlMarkup)